@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Heng-Bian/memory-chat/pkg/memory"
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+)
+
+// memorySetting 一个可通过命令行参数或环境变量覆盖的记忆配置项，
+// 命令行参数优先，均未设置时使用按模型选择的默认值
+type memorySetting struct {
+	flag  string
+	env   string
+	usage string
+	apply func(cfg *memory.Config, value string) error
+	value *string
+}
+
+var memorySettings = []*memorySetting{
+	{flag: "max-context-tokens", env: "MEMORY_MAX_CONTEXT_TOKENS", usage: "上下文token预算",
+		apply: intSetting(func(c *memory.Config) *int { return &c.MaxContextTokens })},
+	{flag: "summarize-threshold", env: "MEMORY_SUMMARIZE_THRESHOLD", usage: "上下文超过该token数时生成摘要",
+		apply: intSetting(func(c *memory.Config) *int { return &c.SummarizationThreshold })},
+	{flag: "summary-budget", env: "MEMORY_SUMMARY_BUDGET", usage: "摘要总token数超过该值时向上汇总",
+		apply: intSetting(func(c *memory.Config) *int { return &c.SummaryBudget })},
+	{flag: "keep-recent", env: "MEMORY_KEEP_RECENT", usage: "生成摘要时保留的最近消息数",
+		apply: intSetting(func(c *memory.Config) *int { return &c.KeepRecent })},
+	{flag: "reflection-interval", env: "MEMORY_REFLECTION_INTERVAL", usage: "每隔多少条消息生成反思 (0 表示不生成)",
+		apply: intSetting(func(c *memory.Config) *int { return &c.ReflectionInterval })},
+	{flag: "retrieval-top-k", env: "MEMORY_RETRIEVAL_TOP_K", usage: "每轮注入的相关历史消息数",
+		apply: intSetting(func(c *memory.Config) *int { return &c.RetrievalTopK })},
+	{flag: "archive-after", env: "MEMORY_ARCHIVE_AFTER", usage: "已被摘要覆盖的消息超过该数量时移入归档段 (0 表示不归档)",
+		apply: intSetting(func(c *memory.Config) *int { return &c.ArchiveAfter })},
+	{flag: "extract-facts", env: "MEMORY_EXTRACT_FACTS", usage: "每轮对话后是否提取用户事实 (true/false)",
+		apply: func(c *memory.Config, value string) error {
+			v, err := strconv.ParseBool(value)
+			c.ExtractFacts = v
+			return err
+		}},
+	{flag: "detect-notes", env: "MEMORY_DETECT_NOTES", usage: "是否把用户要求记住的内容自动加为置顶笔记 (true/false)",
+		apply: func(c *memory.Config, value string) error {
+			v, err := strconv.ParseBool(value)
+			c.DetectNotes = v
+			return err
+		}},
+	{flag: "language", env: "MEMORY_LANGUAGE", usage: "未设置语言的用户使用的提示词语言 (如 zh、en)",
+		apply: func(c *memory.Config, value string) error {
+			c.Language = value
+			return nil
+		}},
+	{flag: "reflection-weights", env: "MEMORY_REFLECTION_WEIGHTS", usage: "反思排序权重: 时近性,重要性,相关性",
+		apply: parseReflectionWeights},
+	{flag: "reflection-decay", env: "MEMORY_REFLECTION_DECAY", usage: "反思时近性每小时的衰减底数",
+		apply: func(c *memory.Config, value string) error {
+			v, err := strconv.ParseFloat(value, 64)
+			c.Reflection.DecayPerHour = v
+			return err
+		}},
+	{flag: "reflection-top-k", env: "MEMORY_REFLECTION_TOP_K", usage: "每轮最多注入的反思条数",
+		apply: intSetting(func(c *memory.Config) *int { return &c.Reflection.TopK })},
+	{flag: "reflection-tokens", env: "MEMORY_REFLECTION_TOKENS", usage: "反思部分的token预算 (0 表示不单独限制)",
+		apply: intSetting(func(c *memory.Config) *int { return &c.Reflection.TokenBudget })},
+}
+
+// registerMemoryFlags 注册记忆配置的命令行参数，需在 flag.Parse 之前调用
+func registerMemoryFlags() {
+	for _, s := range memorySettings {
+		s.value = flag.String(s.flag, "", fmt.Sprintf("%s (环境变量 %s，默认按模型选择)", s.usage, s.env))
+	}
+}
+
+// loadMemoryConfig 以模型默认配置为基础，依次应用环境变量和命令行参数并校验
+func loadMemoryConfig(model string) (memory.Config, error) {
+	cfg := memory.ConfigForModel(model)
+	for _, s := range memorySettings {
+		value, source := *s.value, "-"+s.flag
+		if value == "" {
+			value, source = os.Getenv(s.env), s.env
+		}
+		if value == "" {
+			continue
+		}
+		if err := s.apply(&cfg, strings.TrimSpace(value)); err != nil {
+			return cfg, fmt.Errorf("%s=%q: %w", source, value, err)
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// intSetting 创建设置整数字段的配置项
+func intSetting(field func(*memory.Config) *int) func(*memory.Config, string) error {
+	return func(c *memory.Config, value string) error {
+		v, err := strconv.Atoi(value)
+		*field(c) = v
+		return err
+	}
+}
+
+// parseReflectionWeights 解析逗号分隔的三项反思排序权重
+func parseReflectionWeights(c *memory.Config, value string) error {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("want 3 comma-separated numbers")
+	}
+	var w [3]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return err
+		}
+		w[i] = v
+	}
+	c.Reflection.RecencyWeight, c.Reflection.ImportanceWeight, c.Reflection.RelevanceWeight = w[0], w[1], w[2]
+	return nil
+}
+
+// loadKeyring 读取记忆加密密钥：环境变量 MEMORY_ENCRYPTION_KEY 和 MEMORY_KEY_FILE
+// 指向的文件中的 base64 密钥依次组成密钥环，第一个为主密钥。都未设置时返回 nil，以明文保存
+func loadKeyring() (*storage.Keyring, error) {
+	text := os.Getenv("MEMORY_ENCRYPTION_KEY")
+	if path := os.Getenv("MEMORY_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read key file: %w", err)
+		}
+		text += "\n" + string(data)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+
+	keys, err := storage.ParseKeyring(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse encryption keys: %w", err)
+	}
+	return keys, nil
+}
@@ -2,4 +2,9 @@ module github.com/Heng-Bian/memory-chat
 
 go 1.21
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	go.etcd.io/bbolt v1.3.10
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.4.0 // indirect
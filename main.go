@@ -5,25 +5,52 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Heng-Bian/memory-chat/pkg/llm"
 	"github.com/Heng-Bian/memory-chat/pkg/memory"
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
 	"github.com/Heng-Bian/memory-chat/pkg/server"
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/tokenizer"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
 )
 
 func main() {
 	// 命令行参数
-	mode := flag.String("mode", "cli", "运行模式: cli 或 server")
+	mode := flag.String("mode", "cli", "运行模式: cli、server、migrate、export 或 import")
 	addr := flag.String("addr", ":8080", "HTTP服务器地址 (仅server模式)")
+	storeKind := flag.String("store", "yaml", "记忆存储后端: yaml 或 bolt")
+	memoryDir := flag.String("memory-dir", "memories", "记忆存储目录")
+	tokenizerDir := flag.String("tokenizer-dir", "tokenizers", "BPE词表目录（cl100k_base.tiktoken / o200k_base.tiktoken）")
+	maxUsers := flag.Int("max-users", server.DefaultMaxResidentUsers, "常驻内存的用户数上限，0 表示不限制 (仅server模式)")
+	idleTimeout := flag.Duration("idle-timeout", server.DefaultIdleTimeout, "用户空闲多久后写回并释放记忆，0 表示不释放 (仅server模式)")
+	dryRun := flag.Bool("dry-run", false, "只报告需要迁移的记忆，不写入 (仅migrate模式)")
+	userFlag := flag.String("user", "", "导出或导入的用户ID，默认使用 USER_ID 环境变量 (仅export/import模式)")
+	format := flag.String("format", "json", "导出格式: json、markdown 或 jsonl (仅export模式)")
+	file := flag.String("file", "", "导出写入或导入读取的文件 (仅export/import模式)")
+	promptsDir := flag.String("prompts-dir", "", "提示词模板目录，按语言分子目录覆盖内置模板 (如 prompts/en/summarize.system.tmpl)")
+	registerMemoryFlags()
 	flag.Parse()
 
 	fmt.Println("🤖 Memory Chat - 带记忆机制的智能对话系统")
 	fmt.Println("=" + strings.Repeat("=", 60))
 	fmt.Println()
 
+	// 离线迁移、导出和导入不需要访问模型
+	switch *mode {
+	case "migrate":
+		runMigrate(*storeKind, *memoryDir, *dryRun)
+		return
+	case "export", "import":
+		runTransfer(*mode, *storeKind, *memoryDir, *userFlag, *format, *file)
+		return
+	}
+
 	// 从环境变量获取配置
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
@@ -53,77 +80,338 @@ func main() {
 		model = "gpt-3.5-turbo"
 	}
 
+	memoryConfig, err := loadMemoryConfig(model)
+	if err != nil {
+		fmt.Printf("❌ 记忆配置无效: %v\n", err)
+		os.Exit(1)
+	}
+
+	// 加载提示词模板
+	promptSet, err := prompts.Load(*promptsDir)
+	if err != nil {
+		fmt.Printf("❌ 加载提示词模板失败: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := promptSet.Resolve(memoryConfig.Language); err != nil {
+		fmt.Printf("❌ 记忆配置无效: %v\n", err)
+		os.Exit(1)
+	}
+
 	// 创建LLM客户端
 	llmClient := llm.NewOpenAIClient(apiKey, baseURL, model)
+	if llmClient.ResponseFormat, err = llm.ParseResponseFormat(os.Getenv("OPENAI_RESPONSE_FORMAT")); err != nil {
+		fmt.Printf("❌ OPENAI_RESPONSE_FORMAT 无效: %v\n", err)
+		os.Exit(1)
+	}
+	llmClient.Prompts = promptSet
+
+	// 设置 EMBEDDING_MODEL 后启用向量检索
+	var embedder llm.Embedder
+	if embeddingModel := os.Getenv("EMBEDDING_MODEL"); embeddingModel != "" {
+		embeddingURL := os.Getenv("EMBEDDING_BASE_URL")
+		if embeddingURL == "" {
+			embeddingURL = baseURL
+		}
+		embedder = llm.NewOpenAIEmbedder(apiKey, embeddingURL, embeddingModel)
+	}
+
+	// 打开记忆存储
+	store, storeDesc, err := openStore(*storeKind, *memoryDir)
+	if err != nil {
+		fmt.Printf("❌ 打开记忆存储失败: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	// 加载分词器，缺少词表时退化为估算
+	counter, err := tokenizer.ForModel(*tokenizerDir, model)
+	if err != nil {
+		fmt.Printf("⚠️  未加载BPE词表，使用估算的token数: %v\n", err)
+	}
 
 	// 根据模式运行
 	switch *mode {
 	case "server":
-		runServer(llmClient, *addr, model)
+		runServer(llmClient, embedder, store, storeDesc, counter, memoryConfig, *maxUsers, *idleTimeout, *addr, model)
 	case "cli":
-		runCLI(llmClient, model)
+		runCLI(llmClient, embedder, store, storeDesc, counter, memoryConfig, model)
 	default:
-		fmt.Printf("❌ 未知模式: %s (支持: cli, server)\n", *mode)
+		fmt.Printf("❌ 未知模式: %s (支持: cli, server, migrate, export, import)\n", *mode)
 		os.Exit(1)
 	}
 }
 
-func runServer(llmClient *llm.OpenAIClient, addr string, model string) {
+// openStore 根据类型创建记忆存储后端，配置了密钥时加密保存
+func openStore(kind, dir string) (storage.Store, string, error) {
 	// 创建记忆目录
-	memoryDir := "memories"
-	if err := os.MkdirAll(memoryDir, 0755); err != nil {
-		fmt.Printf("❌ 创建记忆目录失败: %v\n", err)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, "", fmt.Errorf("create memory directory: %w", err)
+	}
+
+	keys, err := loadKeyring()
+	if err != nil {
+		return nil, "", err
+	}
+	encrypted := ""
+	if keys != nil {
+		encrypted = ", 加密"
+	}
+
+	switch kind {
+	case "yaml":
+		store := storage.NewYAMLStore(dir)
+		store.Keys = keys
+		return store, dir + " (yaml" + encrypted + ")", nil
+	case "bolt":
+		path := filepath.Join(dir, "memories.db")
+		store, err := storage.OpenBoltStore(path)
+		if err != nil {
+			return nil, "", err
+		}
+		store.Keys = keys
+		return store, path + " (bolt" + encrypted + ")", nil
+	default:
+		return nil, "", fmt.Errorf("unknown store %q (supported: yaml, bolt)", kind)
+	}
+}
+
+// runMigrate 把存储中所有用户的记忆升级到当前格式版本，dryRun 时只输出报告
+func runMigrate(storeKind, memoryDir string, dryRun bool) {
+	store, storeDesc, err := openStore(storeKind, memoryDir)
+	if err != nil {
+		fmt.Printf("❌ 打开记忆存储失败: %v\n", err)
 		os.Exit(1)
 	}
+	defer store.Close()
 
+	migrator, ok := store.(storage.Migrator)
+	if !ok {
+		fmt.Printf("❌ 存储后端不支持迁移: %s\n", storeDesc)
+		os.Exit(1)
+	}
+	users, err := migrator.Users()
+	if err != nil {
+		fmt.Printf("❌ 列出用户失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	if dryRun {
+		fmt.Printf("🔍 预演迁移 %s (当前版本 v%d，不写入)\n\n", storeDesc, storage.CurrentSchemaVersion)
+	} else {
+		fmt.Printf("🔧 迁移记忆 %s 到版本 v%d\n\n", storeDesc, storage.CurrentSchemaVersion)
+	}
+
+	pending, failed := 0, 0
+	for _, userID := range users {
+		report, err := migrator.Migrate(userID, dryRun)
+		if err != nil {
+			failed++
+			fmt.Printf("  ❌ %s: %v\n", userID, err)
+			continue
+		}
+		if !report.Pending() {
+			fmt.Printf("  ✔️  %s: 已是最新版本\n", userID)
+			continue
+		}
+		pending++
+		fmt.Printf("  ⬆️  %s: %s → v%d\n", userID, schemaLabel(report.FromVersion), report.ToVersion)
+		for _, step := range report.Steps {
+			fmt.Printf("      - %s\n", step)
+		}
+		if report.Reencrypt {
+			fmt.Printf("      - 按当前密钥重新加密\n")
+		}
+	}
+
+	fmt.Println()
+	action := "已迁移"
+	if dryRun {
+		action = "需要迁移"
+	}
+	fmt.Printf("📊 共 %d 个用户，%s %d 个，失败 %d 个\n", len(users), action, pending, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// runTransfer 导出用户记忆到文件，或把 JSON 格式导出的记忆合并到用户记忆
+func runTransfer(mode, storeKind, memoryDir, userID, format, file string) {
+	if userID == "" {
+		userID = os.Getenv("USER_ID")
+	}
+	if userID == "" {
+		userID = "default_user"
+	}
+	if file == "" {
+		fmt.Println("❌ 需要通过 -file 指定文件")
+		os.Exit(1)
+	}
+
+	store, storeDesc, err := openStore(storeKind, memoryDir)
+	if err != nil {
+		fmt.Printf("❌ 打开记忆存储失败: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	mm := memory.NewManager(userID, nil, store, memory.DefaultConfig())
+	defer mm.Close()
+	if err := mm.Load(); err != nil {
+		fmt.Printf("❌ 加载记忆失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	if mode == "export" {
+		exportFormat, err := memory.ParseExportFormat(format)
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			fmt.Printf("❌ 创建文件失败: %v\n", err)
+			os.Exit(1)
+		}
+		err = mm.Export(f, exportFormat)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Printf("❌ 导出失败: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("📤 已导出用户 %s 的记忆 (%s) 到 %s\n", userID, exportFormat, file)
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Printf("❌ 打开文件失败: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	result, err := mm.Import(f)
+	if err != nil {
+		fmt.Printf("❌ 导入失败: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("📥 已导入到用户 %s (%s)\n", userID, storeDesc)
+	fmt.Printf("  会话: %d 个有更新\n", result.Threads)
+	fmt.Printf("  消息: 新增 %d 条，跳过重复 %d 条\n", result.Messages, result.Duplicates)
+	fmt.Printf("  摘要: 新增 %d 条\n", result.Summaries)
+	fmt.Printf("  反思: 新增 %d 条\n", result.Reflections)
+	fmt.Printf("  置顶笔记: 新增 %d 条\n", result.Notes)
+	for threadID, id := range result.Branches {
+		fmt.Printf("🌿 会话 %s 导入的分支没有接在当前分支之后，可在对话中输入 'thread %s' 和 'checkout %s' 切换过去\n", threadID, threadID, shortID(id))
+	}
+}
+
+// schemaLabel 返回记忆格式版本的显示文本
+func schemaLabel(version int) string {
+	if version == 0 {
+		return "无版本号"
+	}
+	return fmt.Sprintf("v%d", version)
+}
+
+func runServer(llmClient *llm.OpenAIClient, embedder llm.Embedder, store storage.Store, storeDesc string, counter tokenizer.Counter, memoryConfig memory.Config, maxUsers int, idleTimeout time.Duration, addr string, model string) {
 	fmt.Printf("📊 配置信息:\n")
 	fmt.Printf("  模型: %s\n", model)
-	fmt.Printf("  记忆目录: %s\n", memoryDir)
+	fmt.Printf("  记忆存储: %s\n", storeDesc)
+	fmt.Printf("  上下文预算: %d tokens (摘要阈值 %d)\n", memoryConfig.MaxContextTokens, memoryConfig.SummarizationThreshold)
+	defaultLang, _ := llmClient.Prompts.Resolve(memoryConfig.Language)
+	fmt.Printf("  默认提示词语言: %s (可用: %s)\n", defaultLang, strings.Join(llmClient.Prompts.Languages(), ", "))
+	if embedder != nil {
+		fmt.Printf("  向量模型: %s\n", embedder.Model())
+	}
+	fmt.Printf("  常驻用户上限: %d (空闲 %s 后释放)\n", maxUsers, idleTimeout)
 	fmt.Printf("  HTTP地址: %s\n", addr)
 	fmt.Println()
 
 	// 创建并启动服务器
-	srv := server.NewServer(llmClient, memoryDir)
+	srv := server.NewServer(llmClient, store, counter, memoryConfig)
+	srv.SetCacheLimits(maxUsers, idleTimeout)
+	srv.SetPrompts(llmClient.Prompts)
+
+	// 退出前等待后台摘要和反思完成
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println("\n⏳ 正在保存记忆...")
+		srv.Close()
+		store.Close()
+		os.Exit(0)
+	}()
+
+	if embedder != nil {
+		srv.SetEmbedder(embedder)
+	}
 	if err := srv.Start(addr); err != nil {
 		fmt.Printf("❌ 服务器启动失败: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func runCLI(llmClient *llm.OpenAIClient, model string) {
+func runCLI(llmClient *llm.OpenAIClient, embedder llm.Embedder, store storage.Store, storeDesc string, counter tokenizer.Counter, memoryConfig memory.Config, model string) {
 	userID := os.Getenv("USER_ID")
 	if userID == "" {
 		userID = "default_user"
 	}
 
 	// 创建记忆管理器
-	memoryPath := filepath.Join("memories", userID+".yaml")
-	memoryManager := memory.NewManager(userID, llmClient, memoryPath)
+	memoryManager := memory.NewManager(userID, llmClient, store, memoryConfig)
+	memoryManager.SetTokenCounter(counter)
+	memoryManager.SetPrompts(llmClient.Prompts)
+	if embedder != nil {
+		memoryManager.SetEmbedder(embedder)
+	}
+
+	if threadID := os.Getenv("THREAD_ID"); threadID != "" {
+		if err := memoryManager.SetThread(threadID); err != nil {
+			fmt.Printf("❌ 会话ID无效: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	// 加载历史记忆
 	if err := memoryManager.Load(); err != nil {
 		fmt.Printf("⚠️  加载记忆失败: %v\n", err)
 	} else {
 		mem := memoryManager.GetMemory()
-		if len(mem.Messages) > 0 {
+		branch := memoryManager.Branch()
+		if len(branch) > 0 {
 			fmt.Printf("✅ 已加载历史记忆 (%d 条消息, %d 条反思)\n",
-				len(mem.Messages), len(mem.Reflections))
-			if mem.Summary != "" {
-				fmt.Println("📝 历史摘要已加载")
+				len(branch), len(mem.Reflections))
+			if summaries := memoryManager.Summaries(); len(summaries) > 0 {
+				fmt.Printf("📝 历史摘要已加载 (%d 条)\n", len(summaries))
 			}
 		}
+		if len(mem.Threads) > 1 {
+			fmt.Printf("🧵 共有 %d 个会话，输入 'threads' 查看\n", len(mem.Threads))
+		}
 	}
 
 	fmt.Println()
 	fmt.Println("配置信息:")
 	fmt.Printf("  模型: %s\n", model)
 	fmt.Printf("  用户ID: %s\n", userID)
-	fmt.Printf("  记忆文件: %s\n", memoryPath)
+	fmt.Printf("  当前会话: %s\n", memoryManager.Thread())
+	fmt.Printf("  提示词语言: %s\n", memoryManager.Language())
+	fmt.Printf("  记忆存储: %s\n", storeDesc)
+	fmt.Printf("  上下文预算: %d tokens (摘要阈值 %d)\n", memoryConfig.MaxContextTokens, memoryConfig.SummarizationThreshold)
 	fmt.Println()
 	fmt.Println("提示: 输入 'quit' 或 'exit' 退出")
 	fmt.Println("      输入 'memory' 查看当前记忆状态")
 	fmt.Println("      输入 'summary' 查看对话摘要")
-	fmt.Println("      输入 'reflections' 查看反思记录")
+	fmt.Println("      输入 'reflections' 查看反思记录，'facts' 查看已知的用户信息")
+	fmt.Println("      输入 'search <关键词>' 检索历史记忆")
+	fmt.Println("      输入 'threads' 查看所有会话，'thread <名称>' 切换会话")
+	fmt.Println("      输入 'history' 查看当前分支，'edit <消息ID> <新内容>' 编辑消息")
+	fmt.Println("      输入 'regenerate' 重新生成回复，'checkout <消息ID>' 切换分支")
+	fmt.Println("      输入 'forget <消息ID>' 或 'forget-topic <关键词>' 彻底删除记忆")
+	fmt.Println("      输入 'pin <内容>' 置顶一条总会记住的笔记，'notes' 查看笔记，'unpin <笔记ID>' 删除笔记")
+	fmt.Println("      输入 'lang <语言>' 设置摘要、反思和上下文使用的语言 (如 zh、en)")
 	fmt.Println()
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -143,6 +431,7 @@ func runCLI(llmClient *llm.OpenAIClient, model string) {
 		switch input {
 		case "quit", "exit":
 			fmt.Println("👋 再见!")
+			memoryManager.Close()
 			if err := memoryManager.Save(); err != nil {
 				fmt.Printf("⚠️  保存记忆失败: %v\n", err)
 			} else {
@@ -161,76 +450,325 @@ func runCLI(llmClient *llm.OpenAIClient, model string) {
 		case "reflections":
 			showReflections(memoryManager)
 			continue
+
+		case "facts":
+			showFacts(memoryManager)
+			continue
+
+		case "notes":
+			showNotes(memoryManager)
+			continue
+
+		case "threads":
+			showThreads(memoryManager)
+			continue
+
+		case "history":
+			showHistory(memoryManager)
+			continue
+
+		case "regenerate":
+			if err := memoryManager.Regenerate(); err != nil {
+				fmt.Printf("❌ 错误: %v\n", err)
+				continue
+			}
+			respond(llmClient, memoryManager)
+			continue
+		}
+		if name, ok := strings.CutPrefix(input, "thread "); ok {
+			switchThread(memoryManager, strings.TrimSpace(name))
+			continue
+		}
+		if query, ok := strings.CutPrefix(input, "search "); ok {
+			showSearch(memoryManager, strings.TrimSpace(query))
+			continue
+		}
+		if prefix, ok := strings.CutPrefix(input, "checkout "); ok {
+			checkoutMessage(memoryManager, strings.TrimSpace(prefix))
+			continue
+		}
+		if prefix, ok := strings.CutPrefix(input, "forget "); ok {
+			id, err := resolveMessageID(memoryManager, strings.TrimSpace(prefix))
+			if err != nil {
+				fmt.Printf("❌ 错误: %v\n", err)
+				continue
+			}
+			forget(memoryManager, memory.ForgetQuery{Thread: memoryManager.Thread(), MessageIDs: []string{id}})
+			continue
+		}
+		if lang, ok := strings.CutPrefix(input, "lang "); ok {
+			if err := memoryManager.SetLanguage(strings.TrimSpace(lang)); err != nil {
+				fmt.Printf("❌ 错误: %v\n", err)
+				continue
+			}
+			fmt.Printf("🌐 提示词语言已切换为 %s\n", memoryManager.Language())
+			continue
+		}
+		if content, ok := strings.CutPrefix(input, "pin "); ok {
+			pinNote(memoryManager, content)
+			continue
+		}
+		if prefix, ok := strings.CutPrefix(input, "unpin "); ok {
+			unpinNote(memoryManager, strings.TrimSpace(prefix))
+			continue
+		}
+		if topic, ok := strings.CutPrefix(input, "forget-topic "); ok {
+			forget(memoryManager, memory.ForgetQuery{Topic: strings.TrimSpace(topic)})
+			continue
+		}
+		if args, ok := strings.CutPrefix(input, "edit "); ok {
+			if editMessage(memoryManager, args) {
+				respond(llmClient, memoryManager)
+			}
+			continue
 		}
 
-		// 添加用户消息到记忆
+		// 添加用户消息到记忆，"请记住……" 会被自动加为置顶笔记
+		notes := len(memoryManager.Notes())
 		if err := memoryManager.AddMessage("user", input); err != nil {
 			fmt.Printf("❌ 错误: %v\n", err)
 			continue
 		}
+		if added := memoryManager.Notes(); len(added) > notes {
+			fmt.Printf("📌 已记住: %s\n", added[len(added)-1].Content)
+		}
+		respond(llmClient, memoryManager)
+	}
 
-		// 获取上下文消息并发送给LLM
-		contextMessages := memoryManager.GetContextMessages()
+	// 程序结束前等待后台摘要和反思完成并保存记忆
+	memoryManager.Close()
+	if err := memoryManager.Save(); err != nil {
+		fmt.Printf("⚠️  保存记忆失败: %v\n", err)
+	}
+}
 
-		fmt.Print("🤖 助手: ")
-		
-		// 使用流式响应
-		var fullResponse strings.Builder
-		tokens, err := llmClient.ChatStream(contextMessages, func(chunk string) error {
-			if _, err := fmt.Print(chunk); err != nil {
-				return fmt.Errorf("failed to print chunk: %w", err)
-			}
-			fullResponse.WriteString(chunk)
-			return nil
-		})
-		if err != nil {
-			fmt.Printf("❌ 错误: %v\n", err)
-			continue
+// respond 在token预算内组装当前分支的上下文，流式输出回复并写入记忆
+func respond(llmClient *llm.OpenAIClient, memoryManager *memory.Manager) {
+	result := memoryManager.BuildContext("")
+	if len(result.Dropped) > 0 {
+		fmt.Printf("ℹ️  上下文超出预算，已省略 %d 条较早的内容\n", len(result.Dropped))
+	}
+	contextMessages := result.Messages
+
+	fmt.Print("🤖 助手: ")
+
+	// 使用流式响应
+	var fullResponse strings.Builder
+	tokens, err := llmClient.ChatStream(contextMessages, func(chunk string) error {
+		if _, err := fmt.Print(chunk); err != nil {
+			return fmt.Errorf("failed to print chunk: %w", err)
 		}
+		fullResponse.WriteString(chunk)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("❌ 错误: %v\n", err)
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("   (使用 %d tokens)\n", tokens)
+
+	// 添加助手响应到记忆
+	if err := memoryManager.AddMessage("assistant", fullResponse.String()); err != nil {
+		fmt.Printf("⚠️  保存响应失败: %v\n", err)
+	}
+
+	// 自动保存记忆
+	if err := memoryManager.Save(); err != nil {
+		fmt.Printf("⚠️  自动保存失败: %v\n", err)
+	}
+
+	fmt.Println()
+}
+
+// shortIDLen 命令行中显示的消息ID长度
+const shortIDLen = 8
 
+func shortID(id string) string {
+	if len(id) > shortIDLen {
+		return id[:shortIDLen]
+	}
+	return id
+}
+
+// resolveMessageID 在当前会话中查找以 prefix 开头的消息ID，完全相同的ID优先
+func resolveMessageID(mm *memory.Manager, prefix string) (string, error) {
+	var matches []string
+	for _, msg := range currentThread(mm, mm.GetMemory()).Messages {
+		if msg.ID == prefix {
+			return msg.ID, nil
+		}
+		if prefix != "" && strings.HasPrefix(msg.ID, prefix) {
+			matches = append(matches, msg.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("找不到消息 %q", prefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("消息ID %q 不唯一，请输入更长的前缀", prefix)
+	}
+}
+
+func showHistory(mm *memory.Manager) {
+	branch := mm.Branch()
+	thread := currentThread(mm, mm.GetMemory())
+	fmt.Println()
+	if len(branch) == 0 {
+		fmt.Println("💬 当前会话暂无消息")
 		fmt.Println()
-		fmt.Printf("   (使用 %d tokens)\n", tokens)
+		return
+	}
+
+	// 同一条消息的其他版本（编辑或重新生成产生的兄弟消息）
+	siblings := make(map[string][]string)
+	for _, msg := range thread.Messages {
+		siblings[msg.ParentID] = append(siblings[msg.ParentID], msg.ID)
+	}
 
-		// 添加助手响应到记忆
-		if err := memoryManager.AddMessage("assistant", fullResponse.String()); err != nil {
-			fmt.Printf("⚠️  保存响应失败: %v\n", err)
+	fmt.Printf("💬 当前分支 (共 %d 条消息):\n", len(branch))
+	fmt.Println(strings.Repeat("-", 60))
+	if thread.Archived() > 0 && branch[0].ParentID != "" {
+		fmt.Printf("(更早的 %d 条消息已归档，可以用 search 检索)\n", thread.Archived())
+	}
+	for _, msg := range branch {
+		icon := "👤"
+		if msg.Role == "assistant" {
+			icon = "🤖"
 		}
+		fmt.Printf("[%s] %s %s\n", shortID(msg.ID), icon, msg.Content)
 
-		// 自动保存记忆
-		if err := memoryManager.Save(); err != nil {
-			fmt.Printf("⚠️  自动保存失败: %v\n", err)
+		var others []string
+		for _, id := range siblings[msg.ParentID] {
+			if id != msg.ID {
+				others = append(others, shortID(id))
+			}
 		}
+		if len(others) > 0 {
+			fmt.Printf("           ↳ 其他版本: %s\n", strings.Join(others, ", "))
+		}
+	}
+	fmt.Println(strings.Repeat("-", 60))
+	fmt.Println()
+}
 
-		fmt.Println()
+// editMessage 处理 edit 命令，成功创建新分支时返回 true
+func editMessage(mm *memory.Manager, args string) bool {
+	prefix, content, _ := strings.Cut(strings.TrimSpace(args), " ")
+	content = strings.TrimSpace(content)
+	if content == "" {
+		fmt.Println("❌ 用法: edit <消息ID> <新内容>")
+		return false
+	}
+	id, err := resolveMessageID(mm, prefix)
+	if err == nil {
+		err = mm.EditMessage(id, content)
 	}
+	if err != nil {
+		fmt.Printf("❌ 错误: %v\n", err)
+		return false
+	}
+	fmt.Printf("✏️  已编辑消息 %s，在新的分支上重新生成回复\n", shortID(id))
+	return true
+}
 
-	// 程序结束前保存记忆
-	if err := memoryManager.Save(); err != nil {
-		fmt.Printf("⚠️  保存记忆失败: %v\n", err)
+func checkoutMessage(mm *memory.Manager, prefix string) {
+	id, err := resolveMessageID(mm, prefix)
+	if err == nil {
+		err = mm.Checkout(id)
 	}
+	if err != nil {
+		fmt.Printf("❌ 错误: %v\n", err)
+		return
+	}
+	fmt.Printf("🌿 已切换到包含消息 %s 的分支\n", shortID(id))
+}
+
+// forget 删除满足条件的记忆并显示删除记录
+func forget(mm *memory.Manager, query memory.ForgetQuery) {
+	query.Reason = "cli"
+	record, err := mm.Forget(query)
+	if err != nil {
+		fmt.Printf("❌ 错误: %v\n", err)
+		return
+	}
+	fmt.Printf("🗑️  已删除 %d 条消息，%d 条摘要和 %d 条反思失效，将在后台重新生成\n",
+		len(record.Messages), record.Summaries, record.Reflections)
+	if record.Notes > 0 {
+		fmt.Printf("📌 同时删除了 %d 条相关的置顶笔记\n", record.Notes)
+	}
+}
+
+// currentThread 返回记忆副本中的当前会话，尚未创建时返回空会话
+func currentThread(mm *memory.Manager, mem *types.ConversationMemory) *types.Thread {
+	if t := mem.Thread(mm.Thread()); t != nil {
+		return t
+	}
+	return &types.Thread{ID: mm.Thread()}
 }
 
 func showMemoryStatus(mm *memory.Manager) {
 	mem := mm.GetMemory()
+	thread := currentThread(mm, mem)
 	fmt.Println()
 	fmt.Println("📊 记忆状态:")
 	fmt.Printf("  用户ID: %s\n", mem.UserID)
-	fmt.Printf("  消息数量: %d\n", len(mem.Messages))
+	fmt.Printf("  当前会话: %s (共 %d 个会话)\n", thread.ID, len(mem.Threads))
+	fmt.Printf("  消息数量: %d (当前分支 %d 条)\n", thread.Archived()+len(thread.Messages), len(mm.Branch()))
+	if len(thread.Segments) > 0 {
+		fmt.Printf("  已归档: %d 条消息 (%d 个归档段)\n", thread.Archived(), len(thread.Segments))
+	}
 	fmt.Printf("  反思数量: %d\n", len(mem.Reflections))
-	fmt.Printf("  当前上下文大小: ~%d tokens\n", mem.ContextSize)
-	fmt.Printf("  有摘要: %v\n", mem.Summary != "")
+	fmt.Printf("  置顶笔记: %d\n", len(mem.Notes))
+	fmt.Printf("  当前上下文大小: ~%d tokens\n", thread.ContextSize)
+	fmt.Printf("  摘要数量: %d\n", len(mm.Summaries()))
+	fmt.Println()
+}
+
+func showThreads(mm *memory.Manager) {
+	threads := mm.Threads()
+	current := mm.Thread()
+	fmt.Println()
+	if len(threads) == 0 {
+		fmt.Printf("🧵 暂无会话，当前会话: %s\n", current)
+	} else {
+		fmt.Printf("🧵 会话列表 (共 %d 个):\n", len(threads))
+		for _, t := range threads {
+			marker := "  "
+			if t.ID == current {
+				marker = "* "
+			}
+			fmt.Printf("%s%s  消息: %d | 摘要: %d | 最近活动: %s\n",
+				marker, t.ID, t.Messages, t.Summaries, t.LastActivity.Format(time.RFC3339))
+		}
+	}
 	fmt.Println()
 }
 
+func switchThread(mm *memory.Manager, name string) {
+	if err := mm.SetThread(name); err != nil {
+		fmt.Println("❌ 会话名称只能包含字母、数字、'-' 和 '_'，最长 64 个字符")
+		return
+	}
+	fmt.Printf("🧵 已切换到会话: %s\n", name)
+}
+
 func showSummary(mm *memory.Manager) {
-	mem := mm.GetMemory()
+	summaries := mm.Summaries()
 	fmt.Println()
-	if mem.Summary == "" {
+	if len(summaries) == 0 {
 		fmt.Println("📝 暂无对话摘要")
 	} else {
-		fmt.Println("📝 对话摘要:")
+		fmt.Printf("📝 对话摘要 (共 %d 条):\n", len(summaries))
 		fmt.Println(strings.Repeat("-", 60))
-		fmt.Println(mem.Summary)
+		for _, s := range summaries {
+			fmt.Printf("\n[消息 %d-%d] 层级: %d | 时间: %s\n",
+				s.Start+1, s.End, s.Level, s.CreatedAt.Format(time.RFC3339))
+			fmt.Println(s.Content)
+		}
 		fmt.Println(strings.Repeat("-", 60))
 	}
 	fmt.Println()
@@ -248,6 +786,14 @@ func showReflections(mm *memory.Manager) {
 			fmt.Printf("\n[反思 #%d] 重要性: %d/10 | 时间: %s\n",
 				i+1, r.Importance, r.Timestamp.Format(time.RFC3339))
 			fmt.Println(r.Content)
+			for _, field := range []struct {
+				label string
+				items []string
+			}{{"主题", r.Themes}, {"偏好", r.Preferences}, {"建议", r.Suggestions}} {
+				if len(field.items) > 0 {
+					fmt.Printf("%s: %s\n", field.label, strings.Join(field.items, "；"))
+				}
+			}
 			if i < len(mem.Reflections)-1 {
 				fmt.Println(strings.Repeat("-", 60))
 			}
@@ -256,3 +802,122 @@ func showReflections(mm *memory.Manager) {
 	}
 	fmt.Println()
 }
+
+func showFacts(mm *memory.Manager) {
+	facts := mm.Facts(memory.FactFilter{History: true})
+	fmt.Println()
+	if len(facts) == 0 {
+		fmt.Println("🧾 暂无用户信息")
+		fmt.Println()
+		return
+	}
+	fmt.Println("🧾 已知的用户信息:")
+	fmt.Println(strings.Repeat("-", 60))
+	replaced := 0
+	for _, f := range facts {
+		if !f.Active() {
+			replaced++
+			continue
+		}
+		fmt.Printf("%s的%s: %s (置信度 %.0f%% | 更新于 %s)\n",
+			f.Subject, f.Attribute, f.Value, f.Confidence*100, f.UpdatedAt.Format("2006-01-02 15:04"))
+	}
+	fmt.Println(strings.Repeat("-", 60))
+	if replaced > 0 {
+		fmt.Printf("另有 %d 条已被新信息取代的历史记录\n", replaced)
+	}
+	fmt.Println()
+}
+
+func showNotes(mm *memory.Manager) {
+	notes := mm.Notes()
+	fmt.Println()
+	if len(notes) == 0 {
+		fmt.Println("📌 暂无置顶笔记，输入 'pin <内容>' 添加")
+		fmt.Println()
+		return
+	}
+	fmt.Printf("📌 置顶笔记 (共 %d 条):\n", len(notes))
+	fmt.Println(strings.Repeat("-", 60))
+	for _, n := range notes {
+		source := "手动添加"
+		if n.MessageID != "" {
+			source = "来自消息 " + shortID(n.MessageID)
+		}
+		fmt.Printf("[%s] %s (%s | %s)\n", shortID(n.ID), n.Content, source, n.CreatedAt.Format("2006-01-02 15:04"))
+	}
+	fmt.Println(strings.Repeat("-", 60))
+	fmt.Println()
+}
+
+func pinNote(mm *memory.Manager, content string) {
+	note, err := mm.PinNote(content)
+	if err != nil {
+		fmt.Printf("❌ 错误: %v\n", err)
+		return
+	}
+	if err := mm.Save(); err != nil {
+		fmt.Printf("⚠️  保存记忆失败: %v\n", err)
+	}
+	fmt.Printf("📌 已置顶笔记 [%s]: %s\n", shortID(note.ID), note.Content)
+}
+
+// unpinNote 删除ID以 prefix 开头的笔记，完全相同的ID优先
+func unpinNote(mm *memory.Manager, prefix string) {
+	var matches []string
+	for _, n := range mm.Notes() {
+		if n.ID == prefix {
+			matches = []string{n.ID}
+			break
+		}
+		if prefix != "" && strings.HasPrefix(n.ID, prefix) {
+			matches = append(matches, n.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		fmt.Printf("❌ 错误: 找不到笔记 %q\n", prefix)
+		return
+	case 1:
+	default:
+		fmt.Printf("❌ 错误: 笔记ID %q 不唯一，请输入更长的前缀\n", prefix)
+		return
+	}
+	if err := mm.UnpinNote(matches[0]); err != nil {
+		fmt.Printf("❌ 错误: %v\n", err)
+		return
+	}
+	if err := mm.Save(); err != nil {
+		fmt.Printf("⚠️  保存记忆失败: %v\n", err)
+	}
+	fmt.Printf("🗑️  已删除笔记 %s\n", shortID(matches[0]))
+}
+
+func showSearch(mm *memory.Manager, query string) {
+	results := mm.Search(query, 5)
+	fmt.Println()
+	if len(results) == 0 {
+		fmt.Printf("🔍 没有找到与 \"%s\" 相关的记忆\n", query)
+	} else {
+		fmt.Printf("🔍 检索结果 (共 %d 条):\n", len(results))
+		fmt.Println(strings.Repeat("-", 60))
+		for _, r := range results {
+			label := map[memory.SearchKind]string{
+				memory.SearchMessage:    "消息",
+				memory.SearchSummary:    "摘要",
+				memory.SearchReflection: "反思",
+			}[r.Kind]
+			if r.Role != "" {
+				label += " " + r.Role
+			}
+			if r.Thread != "" {
+				label = r.Thread + " " + label
+			}
+			fmt.Printf("\n[%s #%d] 得分: %.2f | 时间: %s\n",
+				label, r.Index+1, r.Score, r.Timestamp.Format(time.RFC3339))
+			fmt.Println(r.Content)
+		}
+		fmt.Println(strings.Repeat("-", 60))
+	}
+	fmt.Println()
+}
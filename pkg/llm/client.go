@@ -10,15 +10,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
 	"github.com/Heng-Bian/memory-chat/pkg/types"
 )
 
-// Client 定义LLM客户端接口
+// Client 定义LLM客户端接口，lang 为内部提示词使用的语言，见 prompts.Set.Resolve
 type Client interface {
 	Chat(messages []types.Message) (*types.Message, int, error)
 	ChatStream(messages []types.Message, streamFunc func(string) error) (int, error)
-	Summarize(messages []types.Message) (string, error)
-	GenerateReflection(messages []types.Message, summary string) (*types.Reflection, error)
+	Summarize(messages []types.Message, lang string) (string, error)
+	GenerateReflection(messages []types.Message, summary, lang string) (*types.Reflection, error)
+	ExtractFacts(messages []types.Message, known []types.Fact, lang string) ([]types.Fact, error)
 }
 
 // OpenAIClient OpenAI兼容的客户端实现
@@ -27,6 +29,11 @@ type OpenAIClient struct {
 	BaseURL  string
 	Model    string
 	MaxTokens int
+	// ResponseFormat 反思和事实提取使用的结构化输出方式：FormatJSONSchema（默认）、
+	// FormatJSONObject 或 FormatNone（接口不支持 response_format 参数时）
+	ResponseFormat string
+	// Prompts 摘要、反思和事实提取的提示词模板，为空时使用内置模板
+	Prompts *prompts.Set
 }
 
 // NewOpenAIClient 创建新的OpenAI客户端
@@ -47,10 +54,16 @@ func NewOpenAIClient(apiKey, baseURL, model string) *OpenAIClient {
 
 // Chat 发送聊天请求
 func (c *OpenAIClient) Chat(messages []types.Message) (*types.Message, int, error) {
+	return c.chat(messages, nil)
+}
+
+// chat 发送聊天请求，format 不为空时要求模型按指定格式输出
+func (c *OpenAIClient) chat(messages []types.Message, format *types.ResponseFormat) (*types.Message, int, error) {
 	reqBody := types.LLMRequest{
 		Model:    c.Model,
 		Messages: messages,
 		MaxTokens: c.MaxTokens,
+		ResponseFormat: format,
 	}
 
 	jsonData, err := json.Marshal(reqBody)
@@ -79,7 +92,7 @@ func (c *OpenAIClient) Chat(messages []types.Message) (*types.Message, int, erro
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, 0, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+		return nil, 0, &APIError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	var llmResp types.LLMResponse
@@ -167,16 +180,16 @@ func (c *OpenAIClient) ChatStream(messages []types.Message, streamFunc func(stri
 }
 
 // Summarize 生成对话摘要
-func (c *OpenAIClient) Summarize(messages []types.Message) (string, error) {
+func (c *OpenAIClient) Summarize(messages []types.Message, lang string) (string, error) {
 	systemPrompt := types.Message{
 		Role:    "system",
-		Content: "请总结以下对话的关键信息，生成一个简洁的摘要。摘要应该包含重要的背景信息、用户偏好和关键决策。",
+		Content: c.Prompts.Text(lang, prompts.SummarizeSystem, nil),
 	}
 
 	summaryMessages := append([]types.Message{systemPrompt}, messages...)
 	summaryMessages = append(summaryMessages, types.Message{
 		Role:    "user",
-		Content: "请提供上述对话的摘要。",
+		Content: c.Prompts.Text(lang, prompts.SummarizeRequest, nil),
 	})
 
 	response, _, err := c.Chat(summaryMessages)
@@ -187,61 +200,146 @@ func (c *OpenAIClient) Summarize(messages []types.Message) (string, error) {
 	return response.Content, nil
 }
 
+// reflectionSchema 反思的输出格式
+var reflectionSchema = objectSchema(map[string]interface{}{
+	"content":     map[string]interface{}{"type": "string", "description": "反思正文"},
+	"importance":  map[string]interface{}{"type": "integer", "description": "重要性，1-10 的整数"},
+	"themes":      stringArray("对话中的关键主题和模式"),
+	"preferences": stringArray("用户的隐含需求和偏好"),
+	"suggestions": stringArray("对之后对话的建议"),
+})
+
+// reflectionOutput 模型返回的反思
+type reflectionOutput struct {
+	Content     string   `json:"content"`
+	Importance  int      `json:"importance"`
+	Themes      []string `json:"themes"`
+	Preferences []string `json:"preferences"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// validate 检查反思是否完整
+func (r *reflectionOutput) validate() error {
+	r.Content = strings.TrimSpace(r.Content)
+	if r.Content == "" {
+		return fmt.Errorf("content is empty")
+	}
+	if r.Importance < 1 || r.Importance > 10 {
+		return fmt.Errorf("importance %d is not an integer between 1 and 10", r.Importance)
+	}
+	r.Themes, r.Preferences, r.Suggestions = compact(r.Themes), compact(r.Preferences), compact(r.Suggestions)
+	return nil
+}
+
 // GenerateReflection 生成对话反思
-func (c *OpenAIClient) GenerateReflection(messages []types.Message, summary string) (*types.Reflection, error) {
+func (c *OpenAIClient) GenerateReflection(messages []types.Message, summary, lang string) (*types.Reflection, error) {
 	systemPrompt := types.Message{
-		Role: "system",
-		Content: `你是一个善于观察和反思的AI助手。请基于以下对话，生成一个深入的反思。
-反思应该包括：
-1. 对话中的关键主题和模式
-2. 用户的隐含需求和偏好
-3. 对话中的重要洞察
-4. 对未来对话的建议
-
-同时，请评估这个反思的重要性（1-10分）。`,
+		Role:    "system",
+		Content: c.Prompts.Text(lang, prompts.ReflectionSystem, nil),
 	}
 
 	reflectionMessages := []types.Message{systemPrompt}
 	if summary != "" {
 		reflectionMessages = append(reflectionMessages, types.Message{
 			Role:    "user",
-			Content: "之前的对话摘要：" + summary,
+			Content: c.Prompts.Text(lang, prompts.ReflectionSummary, summary),
 		})
 	}
 	reflectionMessages = append(reflectionMessages, messages...)
 	reflectionMessages = append(reflectionMessages, types.Message{
 		Role:    "user",
-		Content: "请基于上述对话生成反思，并在第一行用格式 [重要性:X] 标注重要性分数（1-10）。",
+		Content: c.Prompts.Text(lang, prompts.ReflectionRequest, nil),
 	})
 
-	response, _, err := c.Chat(reflectionMessages)
+	var out reflectionOutput
+	err := c.chatStructured(reflectionMessages, lang, "reflection", reflectionSchema, func(data []byte) error {
+		out = reflectionOutput{}
+		if err := json.Unmarshal(data, &out); err != nil {
+			return err
+		}
+		return out.validate()
+	})
 	if err != nil {
 		return nil, fmt.Errorf("generate reflection: %w", err)
 	}
 
-	importance := 5
-	content := response.Content
-	
-	// 简单解析重要性（如果存在）
-	if len(content) > 10 && content[0] == '[' {
-		var imp int
-		if _, err := fmt.Sscanf(content, "[重要性:%d]", &imp); err == nil {
-			importance = imp
-			// 移除重要性标记
-			if idx := bytes.IndexByte([]byte(content), '\n'); idx > 0 {
-				content = content[idx+1:]
-			}
-		}
-	}
-
 	timestamp := time.Now()
 	if len(messages) > 0 {
 		timestamp = messages[len(messages)-1].Timestamp
 	}
-	
+
 	return &types.Reflection{
-		Content:   content,
-		Timestamp: timestamp,
-		Importance: importance,
+		Content:     out.Content,
+		Timestamp:   timestamp,
+		Importance:  out.Importance,
+		Themes:      out.Themes,
+		Preferences: out.Preferences,
+		Suggestions: out.Suggestions,
 	}, nil
 }
+
+// factsSchema 事实提取的输出格式
+var factsSchema = objectSchema(map[string]interface{}{
+	"facts": map[string]interface{}{
+		"type": "array",
+		"items": objectSchema(map[string]interface{}{
+			"subject":    map[string]interface{}{"type": "string"},
+			"attribute":  map[string]interface{}{"type": "string"},
+			"value":      map[string]interface{}{"type": "string"},
+			"confidence": map[string]interface{}{"type": "number", "description": "0-1 之间的置信度"},
+			"source":     map[string]interface{}{"type": "integer", "description": "陈述该事实的消息编号"},
+		}),
+	},
+})
+
+// extractedFact 模型返回的事实，source 为来源消息的编号（从 1 开始）
+type extractedFact struct {
+	Subject    string  `json:"subject"`
+	Attribute  string  `json:"attribute"`
+	Value      string  `json:"value"`
+	Confidence float64 `json:"confidence"`
+	Source     int     `json:"source"`
+}
+
+// ExtractFacts 从对话中提取关于用户的持久事实，known 为已知的有效事实，
+// 用于让模型沿用相同的主体和属性名，使新值能够取代旧值
+func (c *OpenAIClient) ExtractFacts(messages []types.Message, known []types.Fact, lang string) ([]types.Fact, error) {
+	prompt := c.Prompts.Text(lang, prompts.FactsSystem, known)
+
+	var dialogue strings.Builder
+	for i, msg := range messages {
+		fmt.Fprintf(&dialogue, "[%d] %s: %s\n", i+1, msg.Role, msg.Content)
+	}
+
+	var out struct {
+		Facts []extractedFact `json:"facts"`
+	}
+	err := c.chatStructured([]types.Message{
+		{Role: "system", Content: prompt},
+		{Role: "user", Content: dialogue.String()},
+	}, lang, "facts", factsSchema, func(data []byte) error {
+		out.Facts = nil
+		if err := json.Unmarshal(data, &out); err != nil {
+			return err
+		}
+		for i, e := range out.Facts {
+			if strings.TrimSpace(e.Subject) == "" || strings.TrimSpace(e.Attribute) == "" || strings.TrimSpace(e.Value) == "" {
+				return fmt.Errorf("fact %d: subject, attribute and value are required", i+1)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("extract facts: %w", err)
+	}
+
+	facts := make([]types.Fact, 0, len(out.Facts))
+	for _, e := range out.Facts {
+		fact := types.Fact{Subject: e.Subject, Attribute: e.Attribute, Value: e.Value, Confidence: e.Confidence}
+		if e.Source >= 1 && e.Source <= len(messages) {
+			fact.MessageID = messages[e.Source-1].ID
+		}
+		facts = append(facts, fact)
+	}
+	return facts, nil
+}
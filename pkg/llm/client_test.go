@@ -0,0 +1,157 @@
+package llm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// fakeAPI 依次返回预设回复的 /chat/completions 接口，记录收到的请求
+type fakeAPI struct {
+	replies  []string
+	requests []types.LLMRequest
+	// rejectSchema 为 true 时以 400 拒绝 json_schema 格式
+	rejectSchema bool
+	// rejectFormat 为 true 时以 400 拒绝所有 response_format 参数
+	rejectFormat bool
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req types.LLMRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	f.requests = append(f.requests, req)
+	if req.ResponseFormat != nil && (f.rejectFormat || f.rejectSchema && req.ResponseFormat.Type == FormatJSONSchema) {
+		http.Error(w, `{"error": "response_format json_schema is not supported"}`, http.StatusBadRequest)
+		return
+	}
+
+	reply := f.replies[0]
+	if len(f.replies) > 1 {
+		f.replies = f.replies[1:]
+	}
+	var resp types.LLMResponse
+	resp.Choices = append(resp.Choices, struct {
+		Message types.Message `json:"message"`
+	}{Message: types.Message{Role: "assistant", Content: reply}})
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newFakeClient(t *testing.T, api *fakeAPI) *OpenAIClient {
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return NewOpenAIClient("key", srv.URL, "test-model")
+}
+
+func TestGenerateReflection_RepairsInvalidOutput(t *testing.T) {
+	api := &fakeAPI{replies: []string{
+		"[重要性:8]\n用户喜欢 Go",
+		"```json\n{\"content\": \"用户在学习 Go\", \"importance\": 8, \"themes\": [\"Go\", \" \"], \"preferences\": [\"喜欢示例代码\"], \"suggestions\": []}\n```",
+	}}
+	c := newFakeClient(t, api)
+
+	r, err := c.GenerateReflection([]types.Message{{Role: "user", Content: "教我 Go"}}, "", "")
+	if err != nil {
+		t.Fatalf("GenerateReflection failed: %v", err)
+	}
+	if r.Content != "用户在学习 Go" || r.Importance != 8 || len(r.Themes) != 1 || r.Preferences[0] != "喜欢示例代码" || r.Suggestions != nil {
+		t.Errorf("Unexpected reflection: %+v", r)
+	}
+
+	if len(api.requests) != 2 {
+		t.Fatalf("Expected one retry, got %d requests", len(api.requests))
+	}
+	if f := api.requests[0].ResponseFormat; f == nil || f.Type != FormatJSONSchema || f.JSONSchema.Name != "reflection" {
+		t.Errorf("Expected json_schema response format, got %+v", f)
+	}
+	retry := api.requests[1].Messages
+	if last := retry[len(retry)-1]; last.Role != "user" || !strings.Contains(last.Content, "no JSON object") {
+		t.Errorf("Expected the validation error to be fed back, got %+v", last)
+	}
+}
+
+func TestGenerateReflection_DowngradesResponseFormat(t *testing.T) {
+	api := &fakeAPI{rejectSchema: true, replies: []string{`{"content": "ok", "importance": 3, "themes": [], "preferences": [], "suggestions": []}`}}
+	c := newFakeClient(t, api)
+
+	r, err := c.GenerateReflection([]types.Message{{Role: "user", Content: "hi"}}, "", "")
+	if err != nil || r.Importance != 3 {
+		t.Fatalf("GenerateReflection failed: %v %+v", err, r)
+	}
+	if len(api.requests) != 2 || api.requests[1].ResponseFormat.Type != FormatJSONObject {
+		t.Errorf("Expected a json_object retry, got %+v", api.requests)
+	}
+}
+
+func TestGenerateReflection_DowngradesDoNotCountAsAttempts(t *testing.T) {
+	api := &fakeAPI{rejectFormat: true, replies: []string{
+		"not json",
+		`{"content": "ok", "importance": 3, "themes": [], "preferences": [], "suggestions": []}`,
+	}}
+	c := newFakeClient(t, api)
+
+	r, err := c.GenerateReflection([]types.Message{{Role: "user", Content: "hi"}}, "", "")
+	if err != nil || r.Importance != 3 {
+		t.Fatalf("GenerateReflection failed: %v %+v", err, r)
+	}
+	if len(api.requests) != 4 || api.requests[2].ResponseFormat != nil {
+		t.Errorf("Expected two downgrades and one repair, got %d requests", len(api.requests))
+	}
+}
+
+func TestGenerateReflection_GivesUpAfterMaxAttempts(t *testing.T) {
+	api := &fakeAPI{replies: []string{`{"content": "ok", "importance": 11}`}}
+	c := newFakeClient(t, api)
+	c.ResponseFormat = FormatNone
+
+	if _, err := c.GenerateReflection(nil, "", ""); err == nil || !strings.Contains(err.Error(), "importance 11") {
+		t.Errorf("Expected validation error, got %v", err)
+	}
+	if len(api.requests) != maxStructuredAttempts || api.requests[0].ResponseFormat != nil {
+		t.Errorf("Expected %d requests without response_format, got %d", maxStructuredAttempts, len(api.requests))
+	}
+}
+
+func TestExtractFacts(t *testing.T) {
+	api := &fakeAPI{replies: []string{`{"facts": [{"subject": "用户", "attribute": "饮食", "value": "素食", "confidence": 0.9, "source": 2}]}`}}
+	c := newFakeClient(t, api)
+
+	msgs := []types.Message{{ID: "a", Role: "assistant", Content: "你好"}, {ID: "b", Role: "user", Content: "我吃素"}}
+	facts, err := c.ExtractFacts(msgs, nil, "")
+	if err != nil {
+		t.Fatalf("ExtractFacts failed: %v", err)
+	}
+	if len(facts) != 1 || facts[0].Value != "素食" || facts[0].MessageID != "b" {
+		t.Errorf("Unexpected facts: %+v", facts)
+	}
+	if !strings.Contains(api.requests[0].Messages[1].Content, "[2] user: 我吃素") {
+		t.Errorf("Expected numbered dialogue, got %q", api.requests[0].Messages[1].Content)
+	}
+}
+
+func TestSummarize_UsesLanguageTemplates(t *testing.T) {
+	api := &fakeAPI{replies: []string{"summary"}}
+	c := newFakeClient(t, api)
+
+	if _, err := c.Summarize([]types.Message{{Role: "user", Content: "hi"}}, "en-US"); err != nil {
+		t.Fatalf("Summarize failed: %v", err)
+	}
+	msgs := api.requests[0].Messages
+	if len(msgs) != 3 || !strings.HasPrefix(msgs[0].Content, "Summarize the key information") || msgs[2].Content != "Please provide a summary of the conversation above." {
+		t.Errorf("Expected English prompts, got %+v", msgs)
+	}
+
+	// 结构化输出的修复提示同样使用该语言
+	api = &fakeAPI{replies: []string{"no json", `{"facts": []}`}}
+	c = newFakeClient(t, api)
+	if _, err := c.ExtractFacts(nil, nil, "en"); err != nil {
+		t.Fatalf("ExtractFacts failed: %v", err)
+	}
+	retry := api.requests[1].Messages
+	if last := retry[len(retry)-1]; !strings.HasPrefix(last.Content, "The output above is invalid: no JSON object") {
+		t.Errorf("Expected English repair prompt, got %q", last.Content)
+	}
+}
@@ -0,0 +1,114 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// Embedder 定义文本向量化接口
+type Embedder interface {
+	// Embed 返回与输入一一对应的向量
+	Embed(texts []string) ([][]float32, error)
+	// Model 返回向量模型名称，模型变化时已有向量需要重建
+	Model() string
+}
+
+// DefaultEmbedTimeout 单次向量化请求的默认超时
+const DefaultEmbedTimeout = 30 * time.Second
+
+// OpenAIEmbedder OpenAI兼容的 /embeddings 客户端实现
+type OpenAIEmbedder struct {
+	APIKey    string
+	BaseURL   string
+	ModelName string
+	// Timeout 单次请求的超时，0 表示不限制
+	Timeout time.Duration
+}
+
+// NewOpenAIEmbedder 创建新的向量化客户端
+func NewOpenAIEmbedder(apiKey, baseURL, model string) *OpenAIEmbedder {
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	if model == "" {
+		model = "text-embedding-3-small"
+	}
+	return &OpenAIEmbedder{
+		APIKey:    apiKey,
+		BaseURL:   baseURL,
+		ModelName: model,
+		Timeout:   DefaultEmbedTimeout,
+	}
+}
+
+// Model 返回向量模型名称
+func (e *OpenAIEmbedder) Model() string {
+	return e.ModelName
+}
+
+// Embed 发送向量化请求
+func (e *OpenAIEmbedder) Embed(texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	reqBody := types.EmbeddingRequest{
+		Model: e.ModelName,
+		Input: texts,
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", e.BaseURL+"/embeddings", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+e.APIKey)
+
+	client := &http.Client{Timeout: e.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var embResp types.EmbeddingResponse
+	if err := json.Unmarshal(body, &embResp); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, d := range embResp.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	for i, v := range vectors {
+		if v == nil {
+			return nil, fmt.Errorf("missing embedding for input %d", i)
+		}
+	}
+
+	return vectors, nil
+}
@@ -0,0 +1,147 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// 结构化输出方式，见 OpenAIClient.ResponseFormat
+const (
+	// FormatJSONSchema 要求输出符合 JSON Schema 的对象
+	FormatJSONSchema = "json_schema"
+	// FormatJSONObject 只要求输出 JSON 对象
+	FormatJSONObject = "json_object"
+	// FormatNone 不发送 response_format，只在提示词中要求输出 JSON
+	FormatNone = "none"
+)
+
+// maxStructuredAttempts 结构化输出无效时最多请求的次数（含第一次）
+const maxStructuredAttempts = 3
+
+// APIError 表示接口返回了错误状态
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error (status %d): %s", e.StatusCode, e.Body)
+}
+
+// ParseResponseFormat 检查结构化输出方式，空字符串表示默认的 FormatJSONSchema
+func ParseResponseFormat(name string) (string, error) {
+	switch name = strings.ToLower(strings.TrimSpace(name)); name {
+	case "":
+		return FormatJSONSchema, nil
+	case FormatJSONSchema, FormatJSONObject, FormatNone:
+		return name, nil
+	default:
+		return "", fmt.Errorf("unknown response format %q (supported: json_schema, json_object, none)", name)
+	}
+}
+
+// chatStructured 请求模型输出 JSON 对象并交给 decode 解析和校验。输出无效时用 lang 语言的提示把原因
+// 反馈给模型重新生成，最多请求 maxStructuredAttempts 次；接口以 400 拒绝 response_format 参数时
+// 依次降级为 json_object 和不发送该参数，降级后的重试不计入次数
+func (c *OpenAIClient) chatStructured(messages []types.Message, lang, name string, schema map[string]interface{}, decode func([]byte) error) error {
+	mode, err := ParseResponseFormat(c.ResponseFormat)
+	if err != nil {
+		return err
+	}
+	messages = append([]types.Message(nil), messages...)
+
+	var lastErr error
+	for attempt := 0; attempt < maxStructuredAttempts; {
+		response, _, err := c.chat(messages, responseFormat(mode, name, schema))
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest && mode != FormatNone {
+			lastErr = err
+			if mode == FormatJSONSchema {
+				mode = FormatJSONObject
+			} else {
+				mode = FormatNone
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := jsonObject(response.Content)
+		if err == nil {
+			err = decode(data)
+		}
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		attempt++
+		messages = append(messages,
+			types.Message{Role: "assistant", Content: response.Content},
+			types.Message{Role: "user", Content: c.Prompts.Text(lang, prompts.StructuredRepair, err.Error())},
+		)
+	}
+	return fmt.Errorf("no valid output after %d attempts: %w", maxStructuredAttempts, lastErr)
+}
+
+// responseFormat 返回请求中的 response_format 参数
+func responseFormat(mode, name string, schema map[string]interface{}) *types.ResponseFormat {
+	switch mode {
+	case FormatJSONSchema:
+		return &types.ResponseFormat{Type: FormatJSONSchema, JSONSchema: &types.JSONSchema{Name: name, Strict: true, Schema: schema}}
+	case FormatJSONObject:
+		return &types.ResponseFormat{Type: FormatJSONObject}
+	default:
+		return nil
+	}
+}
+
+// jsonObject 取出回复中的 JSON 对象，模型可能在前后附带说明或代码块标记
+func jsonObject(content string) ([]byte, error) {
+	start, end := strings.Index(content, "{"), strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("no JSON object in response")
+	}
+	return []byte(content[start : end+1]), nil
+}
+
+// objectSchema 返回严格模式的对象 schema：所有属性都必须出现，不允许其他属性
+func objectSchema(properties map[string]interface{}) map[string]interface{} {
+	required := make([]string, 0, len(properties))
+	for name := range properties {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// stringArray 返回字符串数组的 schema
+func stringArray(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "array",
+		"items":       map[string]interface{}{"type": "string"},
+		"description": description,
+	}
+}
+
+// compact 去掉空白的条目，结果为空时返回 nil
+func compact(items []string) []string {
+	var kept []string
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,215 @@
+package memory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// segmentBlobName 返回归档段的附加数据名，由会话和第一条消息的下标确定
+func segmentBlobName(threadID string, first int) string {
+	return fmt.Sprintf("archive-%s-%08d.seg", threadID, first)
+}
+
+// encodeSegment 将消息编码为 gzip 压缩的 JSON 行
+func encodeSegment(msgs []types.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for i := range msgs {
+		if err := enc.Encode(&msgs[i]); err != nil {
+			return nil, fmt.Errorf("encode archived message: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compress segment: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeSegment 解析 encodeSegment 的结果
+func decodeSegment(data []byte) ([]types.Message, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompress segment: %w", err)
+	}
+	defer zr.Close()
+
+	var msgs []types.Message
+	dec := json.NewDecoder(zr)
+	for {
+		var msg types.Message
+		if err := dec.Decode(&msg); err == io.EOF {
+			return msgs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("decode archived message: %w", err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// archivable 返回会话中可以移入归档段的消息数：按添加顺序排在最前、
+// 都位于当前分支上已被摘要覆盖的部分（不含分支的最后一条消息），
+// 并且归档后剩余消息的父消息仍未归档，或者是最后一条归档的消息
+func archivable(b *branch) int {
+	t := b.thread
+	limit := b.coveredEnd() - b.offset
+	if limit > len(b.messages)-1 {
+		limit = len(b.messages) - 1
+	}
+
+	n := 0
+	for n < limit && n < len(t.Messages) {
+		if pos, ok := b.position[n]; !ok || pos != b.offset+n {
+			break
+		}
+		n++
+	}
+
+	// bound[j] 第 j 条消息允许的最大归档数：父消息必须是剩余消息或最后一条归档的消息
+	index := make(map[string]int, len(t.Messages))
+	for i, msg := range t.Messages {
+		index[msg.ID] = i
+	}
+	minBound := make([]int, len(t.Messages)+1)
+	minBound[len(t.Messages)] = len(t.Messages)
+	for j := len(t.Messages) - 1; j >= 0; j-- {
+		bound := len(t.Messages)
+		if parent := t.Messages[j].ParentID; parent != "" {
+			p, ok := index[parent]
+			if !ok {
+				p = -1 // 父消息已归档
+			}
+			bound = p + 1
+		}
+		minBound[j] = min(bound, minBound[j+1])
+	}
+	for n > 0 && minBound[n] < n {
+		n--
+	}
+	return n
+}
+
+// archive 已被摘要覆盖的消息过多时，把会话最早的消息写入压缩的归档段并移出记忆。
+// 归档段在记录日志之前写入，保存失败时消息仍保留在记忆中。由后台任务在未持有锁时调用
+func (m *Manager) archive(threadID string) error {
+	blobs, ok := m.store.(storage.BlobStore)
+	if !ok || m.config.ArchiveAfter <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.memory.Thread(threadID)
+	if t == nil {
+		return nil
+	}
+	n := archivable(branchOf(t))
+	count := n - m.config.ArchiveAfter
+	if count <= 0 || n < m.config.ArchiveAfter+m.config.ArchiveAfter/2 {
+		return nil
+	}
+
+	msgs := t.Messages[:count]
+	seg := types.Segment{
+		Name:      segmentBlobName(t.ID, t.Archived()),
+		First:     t.Archived(),
+		Count:     count,
+		StartID:   msgs[0].ID,
+		EndID:     msgs[count-1].ID,
+		CreatedAt: time.Now(),
+	}
+	data, err := encodeSegment(msgs)
+	if err != nil {
+		return err
+	}
+	if err := blobs.SaveBlob(m.memory.UserID, seg.Name, data); err != nil {
+		return fmt.Errorf("save segment: %w", err)
+	}
+	if err := storage.ArchiveMessages(t, seg); err != nil {
+		return err
+	}
+	m.journal(t, storage.Entry{Kind: storage.EntryArchive, Segment: &seg})
+	fmt.Printf("📦 Archived %d messages of thread %s (%d remain in memory)\n", count, t.ID, len(t.Messages))
+	return nil
+}
+
+// loadSegment 读取归档段的消息，读取过的归档段会被缓存，需持有锁
+func (m *Manager) loadSegment(seg types.Segment) ([]types.Message, error) {
+	if msgs, ok := m.segments[seg.Name]; ok {
+		return msgs, nil
+	}
+	blobs, ok := m.store.(storage.BlobStore)
+	if !ok {
+		return nil, errors.New("store does not support archive segments")
+	}
+	data, err := blobs.LoadBlob(m.memory.UserID, seg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("load segment %s: %w", seg.Name, err)
+	}
+	msgs, err := decodeSegment(data)
+	if err != nil {
+		return nil, fmt.Errorf("load segment %s: %w", seg.Name, err)
+	}
+	if len(msgs) != seg.Count {
+		return nil, fmt.Errorf("load segment %s: expected %d messages, got %d", seg.Name, seg.Count, len(msgs))
+	}
+	if m.segments == nil {
+		m.segments = make(map[string][]types.Message)
+	}
+	m.segments[seg.Name] = msgs
+	return msgs, nil
+}
+
+// messageAt 返回会话全部消息中下标为 idx 的消息，已归档时从归档段读取，需持有锁
+func (m *Manager) messageAt(t *types.Thread, idx int) (types.Message, bool) {
+	if archived := t.Archived(); idx >= archived {
+		if idx-archived >= len(t.Messages) {
+			return types.Message{}, false
+		}
+		return t.Messages[idx-archived], true
+	}
+
+	i := sort.Search(len(t.Segments), func(i int) bool {
+		return t.Segments[i].First+t.Segments[i].Count > idx
+	})
+	if i == len(t.Segments) || idx < t.Segments[i].First {
+		return types.Message{}, false
+	}
+	msgs, err := m.loadSegment(t.Segments[i])
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return types.Message{}, false
+	}
+	return msgs[idx-t.Segments[i].First], true
+}
+
+// AllMessages 返回会话的全部消息（包括归档段中的消息），按添加顺序排列，
+// 归档段按需从存储读取。会话不存在时返回空
+func (m *Manager) AllMessages(threadID string) ([]types.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.memory.Thread(threadID)
+	if t == nil {
+		return nil, nil
+	}
+	msgs := make([]types.Message, 0, t.Archived()+len(t.Messages))
+	for _, seg := range t.Segments {
+		archived, err := m.loadSegment(seg)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, archived...)
+	}
+	return append(msgs, t.Messages...), nil
+}
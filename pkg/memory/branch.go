@@ -0,0 +1,204 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// ErrMessageNotFound 表示当前会话中没有指定ID的消息
+var ErrMessageNotFound = errors.New("message not found")
+
+// branch 会话当前分支（从第一条消息到 Head）的视图。分支接在归档的消息之后时，
+// 归档的消息占据分支开头的 offset 个位置，messages 只包含未归档的部分
+type branch struct {
+	thread    *types.Thread
+	offset    int             // 分支开头已归档的消息数
+	messages  []types.Message // 分支上未归档的消息，按对话顺序排列
+	indices   []int           // 各消息在 thread.Messages 中的下标
+	position  map[int]int     // thread.Messages 下标到分支位置（含归档部分）的映射
+	summaries []types.Summary // 属于该分支的摘要，按覆盖范围排序
+	set       *types.BranchSet
+}
+
+// branchOf 构建会话当前分支的视图
+func branchOf(t *types.Thread) *branch {
+	b := &branch{thread: t, indices: t.Path(t.Head), position: make(map[int]int), set: t.BranchSet(t.Head)}
+	if b.set.FromArchive() {
+		b.offset = t.Archived()
+	}
+	for pos, i := range b.indices {
+		b.messages = append(b.messages, t.Messages[i])
+		b.position[i] = b.offset + pos
+	}
+	// 没有记录消息ID的摘要视为属于所有分支，与 storage.AddSummary 一致
+	for _, s := range t.Summaries {
+		if s.EndID == "" || b.set.Contains(s.EndID) {
+			b.summaries = append(b.summaries, s)
+		}
+	}
+	return b
+}
+
+// length 返回分支上的消息数（含归档部分）
+func (b *branch) length() int {
+	return b.offset + len(b.messages)
+}
+
+// contains 检查消息是否在分支上
+func (b *branch) contains(id string) bool {
+	return b.set.Contains(id)
+}
+
+// coveredEnd 返回摘要覆盖到的分支位置（不含），之后的消息尚未被摘要。
+// 归档的消息总是已被摘要覆盖
+func (b *branch) coveredEnd() int {
+	end := b.offset
+	for _, s := range b.summaries {
+		if s.End > end {
+			end = s.End
+		}
+	}
+	if end > b.length() {
+		end = b.length()
+	}
+	return end
+}
+
+// recent 返回分支上尚未被摘要覆盖的消息
+func (b *branch) recent() []types.Message {
+	return b.messages[b.coveredEnd()-b.offset:]
+}
+
+// summaryText 按时间顺序拼接分支上的所有摘要
+func (b *branch) summaryText() string {
+	parts := make([]string, 0, len(b.summaries))
+	for _, s := range b.summaries {
+		parts = append(parts, s.Content)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// lastUserIndex 返回分支上最新一条用户消息在 messages 中的下标，没有时返回 -1
+func (b *branch) lastUserIndex() int {
+	for i := len(b.messages) - 1; i >= 0; i-- {
+		if b.messages[i].Role == "user" {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastUserMessage 返回分支上最新一条用户消息的内容，作为检索查询
+func (b *branch) lastUserMessage() string {
+	if i := b.lastUserIndex(); i >= 0 {
+		return b.messages[i].Content
+	}
+	return ""
+}
+
+// sees 检查反思是否可用于该分支：其他会话的反思和旧版本的反思总是可用，
+// 同一会话中只使用在该分支上生成的反思
+func (b *branch) sees(r types.Reflection) bool {
+	return r.MessageID == "" || r.Thread != b.thread.ID || b.contains(r.MessageID)
+}
+
+// contextSize 计算分支的上下文大小：摘要 + 尚未被摘要覆盖的消息
+func (m *Manager) contextSize(b *branch) int {
+	size := m.summaryTokens(b.summaries)
+	for _, msg := range b.recent() {
+		size += m.tokens.Count(msg.Content)
+	}
+	return size
+}
+
+// Head 返回当前分支最后一条消息的ID，会话为空时返回空字符串
+func (m *Manager) Head() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current().Head
+}
+
+// Branch 返回当前分支上未归档的消息副本，按对话顺序排列
+func (m *Manager) Branch() []types.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return branchOf(m.current()).messages
+}
+
+// Summaries 返回当前分支上的摘要副本，按覆盖范围排序
+func (m *Manager) Summaries() []types.Summary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return branchOf(m.current()).summaries
+}
+
+// EditMessage 编辑当前分支上的一条消息：以修改后的内容创建它的兄弟消息，
+// 并切换到以新消息结尾的分支。原分支保持不变，可以通过 Checkout 切换回去
+func (m *Manager) EditMessage(id, content string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.current()
+	i := t.Find(id)
+	if i < 0 {
+		return fmt.Errorf("edit message %q: %w", id, ErrMessageNotFound)
+	}
+	orig := t.Messages[i]
+	m.appendMessage(t, orig.ParentID, orig.Role, content)
+	return nil
+}
+
+// Regenerate 准备重新生成最后一条回复：当前分支以助手消息结尾时，
+// 把当前分支切换到它之前的消息，之后添加的回复会成为原回复的兄弟消息
+func (m *Manager) Regenerate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.current()
+	i := t.Find(t.Head)
+	if i < 0 {
+		return errors.New("regenerate: thread is empty")
+	}
+	if t.Messages[i].Role != "assistant" {
+		return nil // 最后一条回复尚未生成，直接生成即可
+	}
+	m.setHead(t, t.Messages[i].ParentID)
+	return nil
+}
+
+// Checkout 切换到包含指定消息的分支：该消息之后还有对话时，沿最近添加的后续消息
+// 切换到最新的一条，之后的上下文和新消息都基于该分支
+func (m *Manager) Checkout(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.current()
+	if t.Find(id) < 0 {
+		return fmt.Errorf("checkout %q: %w", id, ErrMessageNotFound)
+	}
+
+	// 消息按添加顺序排列，后出现的子消息覆盖先出现的
+	latestChild := make(map[string]string)
+	for _, msg := range t.Messages {
+		latestChild[msg.ParentID] = msg.ID
+	}
+	for latestChild[id] != "" {
+		id = latestChild[id]
+	}
+	m.setHead(t, id)
+	return nil
+}
+
+// setHead 切换会话的当前分支并记录日志，需持有锁
+func (m *Manager) setHead(t *types.Thread, id string) {
+	if t.Head == id {
+		return
+	}
+	t.Head = id
+	t.ContextSize = m.contextSize(branchOf(t))
+	m.journal(t, storage.Entry{Kind: storage.EntryHead, Head: id})
+}
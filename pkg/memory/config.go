@@ -0,0 +1,126 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Config 记忆管理参数
+type Config struct {
+	// MaxContextTokens 发送给模型的上下文token预算
+	MaxContextTokens int
+	// SummarizationThreshold 上下文大小超过该值时触发摘要
+	SummarizationThreshold int
+	// SummaryBudget 摘要总token数超过该值时汇总为更高层摘要
+	SummaryBudget int
+	// KeepRecent 生成摘要时保留的最近消息数
+	KeepRecent int
+	// ReflectionInterval 每添加多少条消息生成一次反思，0 表示不生成
+	ReflectionInterval int
+	// RetrievalTopK 每轮注入的相关历史消息数
+	RetrievalTopK int
+	// ArchiveAfter 当前分支上已被摘要覆盖的未归档消息超过该数量的 1.5 倍时，
+	// 把超出该数量的最早消息移入压缩的归档段，0 表示不归档
+	ArchiveAfter int
+	// ExtractFacts 每轮对话后是否从中提取关于用户的结构化事实
+	ExtractFacts bool
+	// DetectNotes 是否把用户明确要求记住的内容（如 "请记住……"）自动加为置顶笔记
+	DetectNotes bool
+	// Language 没有设置语言的用户使用的提示词语言，为空表示 prompts.DefaultLanguage
+	Language string
+	// Reflection 反思的检索排序参数
+	Reflection ReflectionScoring
+}
+
+// DefaultConfig 适合 4k~16k 上下文窗口模型的默认配置
+func DefaultConfig() Config {
+	return scaledConfig(2000, 5)
+}
+
+// modelProfiles 按模型名前缀给出的上下文预算和保留消息数，越具体的前缀越靠前
+var modelProfiles = []struct {
+	prefix     string
+	maxTokens  int
+	keepRecent int
+}{
+	{"gpt-4o", 16000, 20},
+	{"gpt-4.1", 16000, 20},
+	{"gpt-4-turbo", 16000, 20},
+	{"gpt-4-32k", 8000, 12},
+	{"gpt-4", 4000, 8},
+	{"gpt-5", 16000, 20},
+	{"o1", 16000, 20},
+	{"o3", 16000, 20},
+	{"o4", 16000, 20},
+}
+
+// ConfigForModel 根据模型的上下文窗口选择默认配置，未知模型（包括本地小模型）使用 DefaultConfig
+func ConfigForModel(model string) Config {
+	model = strings.ToLower(model)
+	for _, p := range modelProfiles {
+		if strings.HasPrefix(model, p.prefix) {
+			return scaledConfig(p.maxTokens, p.keepRecent)
+		}
+	}
+	return DefaultConfig()
+}
+
+// scaledConfig 按上下文预算等比例推算其他token阈值
+func scaledConfig(maxTokens, keepRecent int) Config {
+	reflection := DefaultReflectionScoring()
+	reflection.TokenBudget = maxTokens * 3 / 20
+
+	return Config{
+		MaxContextTokens:       maxTokens,
+		SummarizationThreshold: maxTokens * 3 / 4,
+		SummaryBudget:          maxTokens / 4,
+		KeepRecent:             keepRecent,
+		ReflectionInterval:     5,
+		RetrievalTopK:          3,
+		ArchiveAfter:           1000,
+		ExtractFacts:           true,
+		DetectNotes:            true,
+		Reflection:             reflection,
+	}
+}
+
+// Validate 检查配置是否合理
+func (c Config) Validate() error {
+	var errs []error
+	if c.MaxContextTokens <= 0 {
+		errs = append(errs, fmt.Errorf("max context tokens %d: must be positive", c.MaxContextTokens))
+	}
+	if c.SummarizationThreshold <= 0 || c.SummarizationThreshold > c.MaxContextTokens {
+		errs = append(errs, fmt.Errorf("summarization threshold %d: must be in (0, %d]", c.SummarizationThreshold, c.MaxContextTokens))
+	}
+	// 摘要本身超过触发阈值时，每条新消息都会触发摘要
+	if c.SummaryBudget <= 0 || c.SummaryBudget >= c.SummarizationThreshold {
+		errs = append(errs, fmt.Errorf("summary budget %d: must be positive and below the summarization threshold", c.SummaryBudget))
+	}
+	if c.KeepRecent < 0 {
+		errs = append(errs, fmt.Errorf("keep recent %d: must not be negative", c.KeepRecent))
+	}
+	if c.ReflectionInterval < 0 {
+		errs = append(errs, fmt.Errorf("reflection interval %d: must not be negative", c.ReflectionInterval))
+	}
+	if c.RetrievalTopK < 0 {
+		errs = append(errs, fmt.Errorf("retrieval top-k %d: must not be negative", c.RetrievalTopK))
+	}
+	if c.ArchiveAfter < 0 {
+		errs = append(errs, fmt.Errorf("archive after %d: must not be negative", c.ArchiveAfter))
+	}
+
+	r := c.Reflection
+	if r.RecencyWeight < 0 || r.ImportanceWeight < 0 || r.RelevanceWeight < 0 {
+		errs = append(errs, errors.New("reflection weights must not be negative"))
+	}
+	if r.DecayPerHour <= 0 || r.DecayPerHour > 1 {
+		errs = append(errs, fmt.Errorf("reflection decay %v: must be in (0, 1]", r.DecayPerHour))
+	}
+	if r.TopK < 0 || r.TokenBudget < 0 {
+		errs = append(errs, errors.New("reflection top-k and token budget must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,247 @@
+package memory
+
+import (
+	"strings"
+
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
+	"github.com/Heng-Bian/memory-chat/pkg/tokenizer"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// SectionKind 上下文片段的类型，按优先级从高到低排列
+type SectionKind string
+
+const (
+	// SectionSystem 系统提示词
+	SectionSystem SectionKind = "system"
+	// SectionNote 用户置顶的笔记，总是放入上下文
+	SectionNote SectionKind = "note"
+	// SectionSummary 历史摘要
+	SectionSummary SectionKind = "summary"
+	// SectionFact 已知的用户事实
+	SectionFact SectionKind = "fact"
+	// SectionReflection 重要反思
+	SectionReflection SectionKind = "reflection"
+	// SectionRetrieved 检索到的历史记忆
+	SectionRetrieved SectionKind = "retrieved"
+	// SectionRecent 最近的对话消息
+	SectionRecent SectionKind = "recent"
+)
+
+// DroppedItem 因超出预算而未放入上下文的内容
+type DroppedItem struct {
+	Section SectionKind `json:"section"`
+	Tokens  int         `json:"tokens"`
+	Preview string      `json:"preview"` // 内容开头，便于排查
+}
+
+// ContextResult 上下文组装结果
+type ContextResult struct {
+	Messages []types.Message `json:"messages"`
+	Tokens   int             `json:"tokens"` // 已使用的token数
+	Budget   int             `json:"budget"`
+	Dropped  []DroppedItem   `json:"dropped,omitempty"`
+	// Overflow 必须放入的内容（系统提示词、置顶笔记和最近一轮对话）超出预算的token数，此时 Tokens 大于 Budget
+	Overflow int `json:"overflow,omitempty"`
+}
+
+// ContextBuilder 在token预算内按优先级组装上下文：
+// 系统提示词、置顶笔记、摘要、用户事实、重要反思、检索到的记忆，最后是放得下的最近消息。
+// 系统提示词、最近一轮对话（最后一条用户消息及之后的消息）和置顶笔记总是全部放入：先为它们预留空间，
+// 预算不足时先丢弃较早的部分，仍然超出预算时记录在 Overflow 中
+type ContextBuilder struct {
+	Budget      int
+	CountTokens func(string) int
+	// Prompts 摘要和各部分标题的模板，为空时使用内置模板
+	Prompts  *prompts.Set
+	Language string
+
+	SystemPrompt string
+	Notes        []types.Note // 按添加顺序排列
+	Summary      string
+	Facts        []types.Fact       // 按优先级排序
+	Reflections  []types.Reflection // 按优先级排序
+	Retrieved    []types.Message    // 按相关性排序
+	Recent       []types.Message    // 按时间顺序排列
+}
+
+// Build 组装上下文
+func (b *ContextBuilder) Build() *ContextResult {
+	res := &ContextResult{Budget: b.Budget}
+	var head []types.Message
+
+	// 模型必须看到正在回答的问题，以及回答时要遵守的系统提示词
+	turn := latestTurn(b.Recent)
+	for _, msg := range b.Recent[turn:] {
+		res.Tokens += b.CountTokens(msg.Content) + tokenizer.MessageOverhead
+	}
+	if b.SystemPrompt != "" {
+		res.Tokens += b.CountTokens(b.SystemPrompt) + tokenizer.MessageOverhead
+		head = append(head, types.Message{Role: "system", Content: b.SystemPrompt})
+	}
+
+	if len(b.Notes) > 0 {
+		head = append(head, b.pinned(res, b.header(prompts.ContextNotes), noteContents(b.Notes)))
+	}
+
+	if b.Summary != "" {
+		if msg, ok := b.fit(res, SectionSummary, b.Prompts.Text(b.Language, prompts.ContextSummary, b.Summary)); ok {
+			head = append(head, msg)
+		}
+	}
+
+	if msg, ok := b.group(res, SectionFact, b.header(prompts.ContextFacts), b.factContents()); ok {
+		head = append(head, msg)
+	}
+
+	if msg, ok := b.group(res, SectionReflection, b.header(prompts.ContextReflections), b.reflectionContents()); ok {
+		head = append(head, msg)
+	}
+
+	if msg, ok := b.group(res, SectionRetrieved, b.header(prompts.ContextRetrieved), retrievedContents(b.Retrieved)); ok {
+		head = append(head, msg)
+	}
+
+	// 从最近一轮之前的消息开始向前填充，保证放入的最近消息是连续的
+	start := turn
+	for start > 0 {
+		cost := b.CountTokens(b.Recent[start-1].Content) + tokenizer.MessageOverhead
+		if res.Tokens+cost > b.Budget {
+			break
+		}
+		res.Tokens += cost
+		start--
+	}
+	for _, msg := range b.Recent[:start] {
+		res.Dropped = append(res.Dropped, dropped(SectionRecent, b.CountTokens(msg.Content)+tokenizer.MessageOverhead, msg.Content))
+	}
+
+	res.Messages = append(head, b.Recent[start:]...)
+	if res.Tokens > res.Budget {
+		res.Overflow = res.Tokens - res.Budget
+	}
+	return res
+}
+
+// latestTurn 返回最近一轮对话在 msgs 中的起点，即最后一条用户消息的下标，没有用户消息时返回 len(msgs)
+func latestTurn(msgs []types.Message) int {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			return i
+		}
+	}
+	return len(msgs)
+}
+
+// fit 在预算允许时把内容作为一条系统消息放入上下文
+func (b *ContextBuilder) fit(res *ContextResult, section SectionKind, content string) (types.Message, bool) {
+	cost := b.CountTokens(content) + tokenizer.MessageOverhead
+	if res.Tokens+cost > b.Budget {
+		res.Dropped = append(res.Dropped, dropped(section, cost, content))
+		return types.Message{}, false
+	}
+	res.Tokens += cost
+	return types.Message{Role: "system", Content: content}, true
+}
+
+// pinned 将必须放入的多条内容合并为一条系统消息，格式与 group 相同，不受预算限制
+func (b *ContextBuilder) pinned(res *ContextResult, header string, items []string) types.Message {
+	var content strings.Builder
+	content.WriteString(header)
+	for _, item := range items {
+		content.WriteString(item)
+		content.WriteString("\n\n")
+	}
+	res.Tokens += b.CountTokens(content.String()) + tokenizer.MessageOverhead
+	return types.Message{Role: "system", Content: content.String()}
+}
+
+// group 将多条内容按顺序合并为一条系统消息，放不下的条目被丢弃
+func (b *ContextBuilder) group(res *ContextResult, section SectionKind, header string, items []string) (types.Message, bool) {
+	if len(items) == 0 {
+		return types.Message{}, false
+	}
+
+	used := b.CountTokens(header) + tokenizer.MessageOverhead
+	if res.Tokens+used > b.Budget {
+		for _, item := range items {
+			res.Dropped = append(res.Dropped, dropped(section, b.CountTokens(item), item))
+		}
+		return types.Message{}, false
+	}
+
+	var content strings.Builder
+	content.WriteString(header)
+	kept := 0
+	for _, item := range items {
+		cost := b.CountTokens(item + "\n\n")
+		if res.Tokens+used+cost > b.Budget {
+			res.Dropped = append(res.Dropped, dropped(section, cost, item))
+			continue
+		}
+		used += cost
+		content.WriteString(item)
+		content.WriteString("\n\n")
+		kept++
+	}
+	if kept == 0 {
+		return types.Message{}, false
+	}
+
+	res.Tokens += used
+	return types.Message{Role: "system", Content: content.String()}, true
+}
+
+// dropped 创建被丢弃内容的记录
+func dropped(section SectionKind, tokens int, content string) DroppedItem {
+	preview := []rune(content)
+	if len(preview) > 40 {
+		preview = append(preview[:40], '…')
+	}
+	return DroppedItem{Section: section, Tokens: tokens, Preview: string(preview)}
+}
+
+// header 返回部分标题，标题与第一条内容之间换行
+func (b *ContextBuilder) header(name string) string {
+	return b.Prompts.Text(b.Language, name, nil) + "\n"
+}
+
+// reflectionContents 提取反思内容，附上其中记录的用户偏好
+func (b *ContextBuilder) reflectionContents() []string {
+	items := make([]string, 0, len(b.Reflections))
+	for _, r := range b.Reflections {
+		item := r.Content
+		if len(r.Preferences) > 0 {
+			item += "\n" + b.Prompts.Text(b.Language, prompts.ContextPreferences, r.Preferences)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// factContents 按模板格式化事实，如中文的 "主体的属性：值"
+func (b *ContextBuilder) factContents() []string {
+	items := make([]string, 0, len(b.Facts))
+	for _, f := range b.Facts {
+		items = append(items, b.Prompts.Text(b.Language, prompts.ContextFact, f))
+	}
+	return items
+}
+
+// noteContents 提取笔记内容
+func noteContents(notes []types.Note) []string {
+	items := make([]string, 0, len(notes))
+	for _, n := range notes {
+		items = append(items, n.Content)
+	}
+	return items
+}
+
+// retrievedContents 将检索到的消息格式化为带角色的文本
+func retrievedContents(msgs []types.Message) []string {
+	items := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		items = append(items, msg.Role+": "+msg.Content)
+	}
+	return items
+}
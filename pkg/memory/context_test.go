@@ -0,0 +1,166 @@
+package memory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Heng-Bian/memory-chat/pkg/tokenizer"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// wordCount 以空格分词计数，便于在测试中精确控制预算
+func wordCount(s string) int {
+	return len(strings.Fields(s))
+}
+
+func TestContextBuilder_FillsInPriorityOrder(t *testing.T) {
+	builder := &ContextBuilder{
+		Budget:       40,
+		CountTokens:  wordCount,
+		SystemPrompt: "be helpful",
+		Summary:      "user likes go",
+		Reflections: []types.Reflection{
+			{Content: "prefers short answers"},
+		},
+		Recent: []types.Message{
+			{Role: "user", Content: "one two three four five six seven eight"},
+			{Role: "assistant", Content: "nine ten"},
+			{Role: "user", Content: "latest question"},
+		},
+	}
+
+	res := builder.Build()
+
+	if res.Tokens > res.Budget {
+		t.Fatalf("Used %d tokens, over budget %d", res.Tokens, res.Budget)
+	}
+	if len(res.Messages) != 5 {
+		t.Fatalf("Expected system, summary, reflection and 2 recent messages, got %+v", res.Messages)
+	}
+	if res.Messages[0].Content != "be helpful" {
+		t.Errorf("System prompt should come first, got %q", res.Messages[0].Content)
+	}
+	if !strings.Contains(res.Messages[1].Content, "user likes go") {
+		t.Errorf("Summary should come second, got %q", res.Messages[1].Content)
+	}
+	if res.Messages[4].Content != "latest question" {
+		t.Errorf("Latest message should be last, got %q", res.Messages[4].Content)
+	}
+
+	if len(res.Dropped) != 1 || res.Dropped[0].Section != SectionRecent {
+		t.Errorf("Expected the oldest message to be reported as dropped, got %+v", res.Dropped)
+	}
+}
+
+func TestContextBuilder_DropsLowPrioritySectionsFirst(t *testing.T) {
+	builder := &ContextBuilder{
+		Budget:      12,
+		CountTokens: wordCount,
+		Summary:     "a b c",
+		Retrieved: []types.Message{
+			{Role: "user", Content: "an old message that is far too long to fit"},
+		},
+		Recent: []types.Message{
+			{Role: "user", Content: "hi"},
+		},
+	}
+
+	res := builder.Build()
+
+	for _, msg := range res.Messages {
+		if strings.Contains(msg.Content, "far too long") {
+			t.Errorf("Retrieved memory should have been dropped")
+		}
+	}
+	found := false
+	for _, d := range res.Dropped {
+		if d.Section == SectionRetrieved {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected retrieved memory in dropped list, got %+v", res.Dropped)
+	}
+}
+
+func TestContextBuilder_AlwaysKeepsNotes(t *testing.T) {
+	builder := &ContextBuilder{
+		Budget:      20,
+		CountTokens: wordCount,
+		Notes: []types.Note{
+			{Content: "allergic to peanuts"},
+			{Content: "call me Al and always answer in metric units please"},
+		},
+		Summary:     "a b c",
+		Facts:       []types.Fact{{Subject: "user", Attribute: "diet", Value: "vegetarian"}},
+		Reflections: []types.Reflection{{Content: "prefers short answers"}},
+		Retrieved:   []types.Message{{Role: "user", Content: "old message"}},
+	}
+
+	res := builder.Build()
+
+	if len(res.Messages) != 1 || !strings.Contains(res.Messages[0].Content, "allergic to peanuts\n\ncall me Al") {
+		t.Fatalf("Expected only the notes, got %+v", res.Messages)
+	}
+	dropped := map[SectionKind]bool{}
+	for _, d := range res.Dropped {
+		dropped[d.Section] = true
+	}
+	for _, section := range []SectionKind{SectionSummary, SectionFact, SectionReflection, SectionRetrieved} {
+		if !dropped[section] {
+			t.Errorf("Expected %s to be dropped, got %+v", section, res.Dropped)
+		}
+	}
+	if dropped[SectionNote] {
+		t.Errorf("Notes should never be dropped, got %+v", res.Dropped)
+	}
+
+	// 笔记本身超出预算时仍然放入，并报告超出的部分
+	builder.Budget = 5
+	res = builder.Build()
+	if len(res.Messages) != 1 || res.Overflow != res.Tokens-5 || res.Overflow <= 0 {
+		t.Errorf("Expected notes kept with overflow reported, got %+v", res)
+	}
+}
+
+func TestContextBuilder_ReservesLatestUserTurn(t *testing.T) {
+	builder := &ContextBuilder{
+		Budget:       16,
+		CountTokens:  wordCount,
+		SystemPrompt: "be helpful",
+		Summary:      "a long summary of everything that was said before",
+		Reflections:  []types.Reflection{{Content: "prefers short answers"}},
+		Recent: []types.Message{
+			{Role: "user", Content: "old question"},
+			{Role: "assistant", Content: "old answer"},
+			{Role: "user", Content: "what should I cook tonight"},
+		},
+	}
+
+	res := builder.Build()
+
+	if res.Tokens > res.Budget {
+		t.Fatalf("Used %d tokens, over budget %d", res.Tokens, res.Budget)
+	}
+	if len(res.Messages) < 2 || res.Messages[0].Content != "be helpful" || res.Messages[len(res.Messages)-1].Content != "what should I cook tonight" {
+		t.Fatalf("Expected the system prompt and the latest question, got %+v", res.Messages)
+	}
+	dropped := map[SectionKind]bool{}
+	for _, d := range res.Dropped {
+		dropped[d.Section] = true
+	}
+	if !dropped[SectionSummary] || !dropped[SectionReflection] {
+		t.Errorf("Expected older sections to be dropped first, got %+v", res.Dropped)
+	}
+
+	// 最近一轮本身超出预算时仍然和系统提示词一起放入
+	builder.Budget = 3
+	res = builder.Build()
+	if len(res.Messages) != 2 || res.Messages[0].Content != "be helpful" || res.Messages[1].Content != "what should I cook tonight" {
+		t.Fatalf("Expected the system prompt and the latest question, got %+v", res.Messages)
+	}
+	want := wordCount("be helpful") + wordCount("what should I cook tonight") + 2*tokenizer.MessageOverhead
+	if res.Tokens != want || res.Overflow != want-3 {
+		t.Errorf("Expected the system prompt counted in overflow, got %d tokens, overflow %d", res.Tokens, res.Overflow)
+	}
+}
@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// EventKind 记忆事件类型
+type EventKind string
+
+const (
+	// EventMessageAdded 新增消息（包括编辑消息产生的新分支）
+	EventMessageAdded EventKind = "message_added"
+	// EventSummaryCreated 生成摘要，包括汇总得到的高层摘要
+	EventSummaryCreated EventKind = "summary_created"
+	// EventReflectionCreated 生成反思
+	EventReflectionCreated EventKind = "reflection_created"
+	// EventFactExtracted 提取到事实，值相同的事实只更新已有事实的确认时间
+	EventFactExtracted EventKind = "fact_extracted"
+	// EventNotePinned 新增置顶笔记，包括从用户消息中识别出的
+	EventNotePinned EventKind = "note_pinned"
+	// EventNoteUnpinned 删除置顶笔记
+	EventNoteUnpinned EventKind = "note_unpinned"
+	// EventSaved 记忆写入存储
+	EventSaved EventKind = "memory_saved"
+	// EventForgotten 按删除条件删除了记忆
+	EventForgotten EventKind = "memory_forgotten"
+	// EventLoadFailed 从存储加载记忆失败（存储中尚无记忆不算失败）
+	EventLoadFailed EventKind = "load_failed"
+)
+
+// Event 记忆事件，只有与类型对应的字段有值
+type Event struct {
+	Kind   EventKind
+	UserID string
+	Thread string // 消息和摘要所属的会话
+	Time   time.Time
+
+	Message    *types.Message    // EventMessageAdded 的消息
+	Summary    *types.Summary    // EventSummaryCreated 的摘要
+	Reflection *types.Reflection // EventReflectionCreated 的反思
+	Fact       *types.Fact       // EventFactExtracted 的事实
+	Note       *types.Note       // EventNotePinned 和 EventNoteUnpinned 的笔记
+	Forget     *ForgetRecord     // EventForgotten 的删除记录
+	Snapshot   bool              // EventSaved 是否写入了完整快照，否则只追加了日志
+	Entries    int               // EventSaved 追加的日志条目数
+	Err        error             // EventLoadFailed 的错误
+}
+
+// subscriber 事件订阅者
+type subscriber struct {
+	id int
+	fn func(Event)
+}
+
+// Subscribe 订阅记忆事件，返回取消订阅的函数。事件按发生顺序在单独的 goroutine 中
+// 依次交给订阅者，订阅者可以调用管理器的方法，但不应调用 Wait 或 Close；
+// 处理较慢时之后的事件会排队等待，不会丢失
+func (m *Manager) Subscribe(fn func(Event)) (unsubscribe func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextSubscriber++
+	id := m.nextSubscriber
+	m.subscribers = append(m.subscribers, subscriber{id: id, fn: fn})
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i, s := range m.subscribers {
+			if s.id == id {
+				m.subscribers = append(m.subscribers[:i:i], m.subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// emit 记录事件，没有订阅者时忽略，需持有锁
+func (m *Manager) emit(e Event) {
+	if len(m.subscribers) == 0 {
+		return
+	}
+	e.UserID = m.memory.UserID
+	e.Time = time.Now()
+	m.events = append(m.events, e)
+	if !m.dispatching {
+		m.dispatching = true
+		go m.dispatch()
+	}
+}
+
+// dispatch 在未持有锁时把排队的事件依次交给订阅者，队列为空时退出
+func (m *Manager) dispatch() {
+	for {
+		m.mu.Lock()
+		events, subscribers := m.events, append([]subscriber(nil), m.subscribers...)
+		m.events = nil
+		if len(events) == 0 {
+			m.dispatching = false
+			m.idle.Broadcast()
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+
+		for _, e := range events {
+			for _, s := range subscribers {
+				deliver(s.fn, e)
+			}
+		}
+	}
+}
+
+// deliver 调用订阅者，订阅者 panic 时只打印警告，不影响其他订阅者
+func deliver(fn func(Event), e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Warning: memory event subscriber panicked on %s: %v\n", e.Kind, r)
+		}
+	}()
+	fn(e)
+}
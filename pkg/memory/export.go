@@ -0,0 +1,580 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// ExportFormat 记忆导出格式
+type ExportFormat string
+
+const (
+	// ExportJSON 完整的记忆（包括所有分支、摘要、反思和归档的消息），可以再导入
+	ExportJSON ExportFormat = "json"
+	// ExportMarkdown 各会话当前分支的对话记录，便于阅读
+	ExportMarkdown ExportFormat = "markdown"
+	// ExportJSONL OpenAI 微调格式，每个会话的当前分支为一行训练样本
+	ExportJSONL ExportFormat = "jsonl"
+)
+
+// ParseExportFormat 解析导出格式名，"md" 是 markdown 的简写
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return ExportJSON, nil
+	case "markdown", "md":
+		return ExportMarkdown, nil
+	case "jsonl":
+		return ExportJSONL, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q (supported: json, markdown, jsonl)", name)
+	}
+}
+
+// ContentType 返回导出格式的 MIME 类型
+func (f ExportFormat) ContentType() string {
+	switch f {
+	case ExportMarkdown:
+		return "text/markdown; charset=utf-8"
+	case ExportJSONL:
+		return "application/jsonl"
+	default:
+		return "application/json"
+	}
+}
+
+// Extension 返回导出文件的扩展名
+func (f ExportFormat) Extension() string {
+	if f == ExportMarkdown {
+		return ".md"
+	}
+	return "." + string(f)
+}
+
+// ErrInvalidImport 表示导入的数据不是合法的 JSON 格式记忆
+var ErrInvalidImport = errors.New("invalid import")
+
+// ImportResult 导入的统计信息
+type ImportResult struct {
+	Threads     int `json:"threads"`     // 有新内容的会话数
+	Messages    int `json:"messages"`    // 新增的消息数
+	Duplicates  int `json:"duplicates"`  // 已存在而跳过的消息数
+	Summaries   int `json:"summaries"`   // 新增的摘要数
+	Reflections int `json:"reflections"` // 新增的反思数
+	Facts       int `json:"facts"`       // 新增的事实数
+	Notes       int `json:"notes"`       // 新增的置顶笔记数
+
+	// Branches 导入的当前分支不在本地当前分支上的会话：会话ID → 导入分支的最后一条消息ID。
+	// 这些分支作为另一个分支保留，不会自动切换，可以用 Checkout 切换过去
+	Branches map[string]string `json:"branches,omitempty"`
+}
+
+// Export 按指定格式导出用户的全部记忆，归档的消息会一并导出
+func (m *Manager) Export(w io.Writer, format ExportFormat) error {
+	m.mu.Lock()
+	mem, err := m.exportMemory()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(mem)
+	case ExportMarkdown:
+		return writeMarkdown(w, mem)
+	case ExportJSONL:
+		return writeJSONL(w, mem)
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// exportMemory 返回记忆的副本，归档段中的消息放回各会话，需持有锁
+func (m *Manager) exportMemory() (*types.ConversationMemory, error) {
+	mem := &types.ConversationMemory{
+		SchemaVersion: storage.CurrentSchemaVersion,
+		UserID:        m.memory.UserID,
+		Threads:       make([]*types.Thread, 0, len(m.memory.Threads)),
+		Reflections:   append([]types.Reflection{}, m.memory.Reflections...),
+		Facts:         append([]types.Fact{}, m.memory.Facts...),
+		Notes:         append([]types.Note{}, m.memory.Notes...),
+	}
+	for _, t := range m.memory.Threads {
+		full, err := m.fullThread(t)
+		if err != nil {
+			return nil, err
+		}
+		mem.Threads = append(mem.Threads, full)
+	}
+	return mem, nil
+}
+
+// fullThread 返回会话的副本，归档的消息放回 Messages 开头，需持有锁
+func (m *Manager) fullThread(t *types.Thread) (*types.Thread, error) {
+	full := *t
+	full.Segments = nil
+	full.Messages = make([]types.Message, 0, t.Archived()+len(t.Messages))
+	for _, seg := range t.Segments {
+		msgs, err := m.loadSegment(seg)
+		if err != nil {
+			return nil, err
+		}
+		full.Messages = append(full.Messages, msgs...)
+	}
+	full.Messages = append(full.Messages, t.Messages...)
+	full.Summaries = append([]types.Summary{}, t.Summaries...)
+	return &full, nil
+}
+
+// roleLabels 对话记录中的角色名
+var roleLabels = map[string]string{
+	"user":      "用户",
+	"assistant": "助手",
+	"system":    "系统",
+}
+
+// writeMarkdown 把各会话当前分支的消息写为 Markdown 对话记录
+func writeMarkdown(w io.Writer, mem *types.ConversationMemory) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# 记忆导出：%s\n\n", mem.UserID)
+	fmt.Fprintf(bw, "导出时间：%s\n", time.Now().Format("2006-01-02 15:04"))
+
+	for _, t := range mem.Threads {
+		branch := t.Branch()
+		fmt.Fprintf(bw, "\n## 会话 %s\n", t.ID)
+		if other := len(t.Messages) - len(branch); other > 0 {
+			fmt.Fprintf(bw, "\n> 另有 %d 条消息位于其他分支，完整记录请导出为 JSON。\n", other)
+		}
+		for _, msg := range branch {
+			role := roleLabels[msg.Role]
+			if role == "" {
+				role = msg.Role
+			}
+			fmt.Fprintf(bw, "\n**%s** · %s\n\n%s\n", role, msg.Timestamp.Format("2006-01-02 15:04"), msg.Content)
+		}
+	}
+
+	if len(mem.Notes) > 0 {
+		fmt.Fprintf(bw, "\n## 置顶笔记\n\n")
+		for _, n := range mem.Notes {
+			fmt.Fprintf(bw, "- %s\n", strings.ReplaceAll(n.Content, "\n", " "))
+		}
+	}
+
+	if len(mem.Reflections) > 0 {
+		fmt.Fprintf(bw, "\n## 反思\n\n")
+		for _, r := range mem.Reflections {
+			fmt.Fprintf(bw, "- [%d/10] %s\n", r.Importance, strings.ReplaceAll(strings.TrimSpace(r.Content), "\n", " "))
+		}
+	}
+	return bw.Flush()
+}
+
+// fineTuneMessage OpenAI 微调样本中的消息
+type fineTuneMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// writeJSONL 把各会话的当前分支写为 OpenAI 微调样本。样本必须以助手回复结尾，
+// 最后一条回复之后的消息不导出，没有回复的会话被跳过
+func writeJSONL(w io.Writer, mem *types.ConversationMemory) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, t := range mem.Threads {
+		branch := t.Branch()
+		end := len(branch)
+		for end > 0 && branch[end-1].Role != "assistant" {
+			end--
+		}
+		if end == 0 {
+			continue
+		}
+
+		msgs := make([]fineTuneMessage, end)
+		for i, msg := range branch[:end] {
+			msgs[i] = fineTuneMessage{Role: msg.Role, Content: msg.Content}
+		}
+		if err := enc.Encode(map[string][]fineTuneMessage{"messages": msgs}); err != nil {
+			return fmt.Errorf("encode sample: %w", err)
+		}
+	}
+	return bw.Flush()
+}
+
+// Import 把 JSON 格式导出的记忆合并到当前记忆：角色、内容和时间戳都相同的消息视为已有，
+// ID 与本地消息相同但内容不同的消息换成新的ID导入，合并后按时间戳排序。导入的当前分支不是本地当前分支的延续时
+// 作为另一个分支保留，记录在 ImportResult.Branches 中；摘要和反思按内容去重；事实按ID去重，笔记按ID或内容去重，与已有事实冲突时确认时间较新的有效。导入的记忆属于哪个用户不影响结果。
+// 合并结果立即写入完整快照，有新内容的会话中归档的消息会放回记忆，之后重新归档
+func (m *Manager) Import(r io.Reader) (*ImportResult, error) {
+	src, err := decodeExport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result *ImportResult
+	err = m.rewrite(func() ([]string, error) {
+		r, changed, err := m.merge(src)
+		if err != nil {
+			return nil, err
+		}
+		result = r
+		if r.Threads == 0 && r.Reflections == 0 && r.Facts == 0 && r.Notes == 0 {
+			return nil, nil
+		}
+		return append([]string{}, changed...), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decodeExport 解析并校验 JSON 格式导出的记忆，较早版本导出的记忆会先升级到当前格式
+func decodeExport(r io.Reader) (*types.ConversationMemory, error) {
+	var mem types.ConversationMemory
+	if err := json.NewDecoder(r).Decode(&mem); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImport, err)
+	}
+	if _, err := storage.Migrate(&mem); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImport, err)
+	}
+
+	for _, t := range mem.Threads {
+		if !ValidThreadID(t.ID) {
+			return nil, fmt.Errorf("%w: invalid thread id %q", ErrInvalidImport, t.ID)
+		}
+		if len(t.Segments) > 0 {
+			return nil, fmt.Errorf("%w: thread %s refers to archive segments", ErrInvalidImport, t.ID)
+		}
+		ids := make(map[string]bool, len(t.Messages))
+		for _, msg := range t.Messages {
+			if msg.ID == "" || ids[msg.ID] {
+				return nil, fmt.Errorf("%w: thread %s has missing or duplicate message id %q", ErrInvalidImport, t.ID, msg.ID)
+			}
+			ids[msg.ID] = true
+		}
+		for _, msg := range t.Messages {
+			if msg.ParentID != "" && !ids[msg.ParentID] {
+				return nil, fmt.Errorf("%w: message %s has unknown parent %q", ErrInvalidImport, msg.ID, msg.ParentID)
+			}
+		}
+	}
+	return &mem, nil
+}
+
+// merge 把 src 合并到记忆中，返回统计信息和有新内容或切换了当前分支的会话。
+// 所有会话合并成功后才修改记忆，需持有锁
+func (m *Manager) merge(src *types.ConversationMemory) (*ImportResult, []string, error) {
+	result := &ImportResult{}
+	var changed []string
+	merged := make(map[string]*types.Thread)
+	idMaps := make(map[string]map[string]string)
+
+	for _, st := range src.Threads {
+		var dst *types.Thread
+		if t := m.memory.Thread(st.ID); t != nil {
+			full, err := m.fullThread(t)
+			if err != nil {
+				return nil, nil, err
+			}
+			dst = full
+		}
+		t, ids, stats := mergeThread(dst, st)
+		idMaps[st.ID] = ids
+		result.Duplicates += stats.Duplicates
+		if head := ids[st.Head]; head != "" && !t.BranchSet(t.Head).Contains(head) {
+			if result.Branches == nil {
+				result.Branches = make(map[string]string)
+			}
+			result.Branches[st.ID] = head
+		}
+		if stats.Messages == 0 && stats.Summaries == 0 && (dst == nil || t.Head == dst.Head) {
+			continue
+		}
+		t.ContextSize = m.contextSize(branchOf(t))
+		result.Threads++
+		result.Messages += stats.Messages
+		result.Summaries += stats.Summaries
+		merged[st.ID] = t
+		changed = append(changed, st.ID)
+	}
+
+	// 反思按时间和内容去重，生成时的消息ID换成合并后的ID
+	seen := make(map[string]bool, len(m.memory.Reflections))
+	for _, r := range m.memory.Reflections {
+		seen[reflectionKey(r)] = true
+	}
+	var reflections []types.Reflection
+	for _, r := range src.Reflections {
+		if id, ok := idMaps[r.Thread][r.MessageID]; ok {
+			r.MessageID = id
+		}
+		if key := reflectionKey(r); !seen[key] {
+			seen[key] = true
+			reflections = append(reflections, r)
+		}
+	}
+	for _, id := range changed {
+		if i := threadIndex(m.memory, id); i >= 0 {
+			m.memory.Threads[i] = merged[id]
+		} else {
+			m.memory.Threads = append(m.memory.Threads, merged[id])
+		}
+	}
+	if len(reflections) > 0 {
+		result.Reflections = len(reflections)
+		m.memory.Reflections = append(m.memory.Reflections, reflections...)
+		sort.SliceStable(m.memory.Reflections, func(i, j int) bool {
+			return m.memory.Reflections[i].Timestamp.Before(m.memory.Reflections[j].Timestamp)
+		})
+	}
+	result.Facts = mergeFacts(m.memory, src.Facts, idMaps)
+	result.Notes = mergeNotes(m.memory, src.Notes, idMaps)
+	return result, changed, nil
+}
+
+// mergeNotes 把导入的笔记加在已有笔记之后，返回新增的笔记数。ID相同或内容相同（不区分大小写）的笔记视为已有
+func mergeNotes(mem *types.ConversationMemory, notes []types.Note, idMaps map[string]map[string]string) int {
+	before := len(mem.Notes)
+	for _, n := range notes {
+		if n.ID == "" || strings.TrimSpace(n.Content) == "" || hasNote(mem.Notes, n) {
+			continue
+		}
+		if id, ok := idMaps[n.Thread][n.MessageID]; ok {
+			n.MessageID = id
+		}
+		mem.Notes = append(mem.Notes, n)
+	}
+	return len(mem.Notes) - before
+}
+
+// hasNote 检查是否已有ID或内容相同的笔记
+func hasNote(notes []types.Note, note types.Note) bool {
+	for _, n := range notes {
+		if n.ID == note.ID || strings.EqualFold(strings.TrimSpace(n.Content), strings.TrimSpace(note.Content)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFacts 把导入的事实加入记忆，返回新增的事实数。有效的事实按确认时间依次用 storage.AddFact 加入，
+// 值与已有事实相同时合并为一条；已被取代的事实作为历史直接加入
+func mergeFacts(mem *types.ConversationMemory, facts []types.Fact, idMaps map[string]map[string]string) int {
+	local := make(map[string]bool, len(mem.Facts))
+	for _, f := range mem.Facts {
+		local[f.ID] = true
+	}
+	var active, history []types.Fact
+	for _, f := range facts {
+		if f.ID == "" || local[f.ID] {
+			continue
+		}
+		if id, ok := idMaps[f.Thread][f.MessageID]; ok {
+			f.MessageID = id
+		}
+		if f.Active() {
+			active = append(active, f)
+		} else {
+			history = append(history, f)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].UpdatedAt.Before(active[j].UpdatedAt)
+	})
+
+	before := len(mem.Facts)
+	ids := make(map[string]string, len(active))
+	for _, f := range active {
+		ids[f.ID] = storage.AddFact(mem, f)
+	}
+	for _, f := range history {
+		if id, ok := ids[f.SupersededBy]; ok {
+			f.SupersededBy = id
+		}
+		mem.Facts = append(mem.Facts, f)
+	}
+	return len(mem.Facts) - before
+}
+
+// threadIndex 返回会话在记忆中的下标，不存在时返回 -1
+func threadIndex(mem *types.ConversationMemory, id string) int {
+	for i, t := range mem.Threads {
+		if t.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// reflectionKey 反思的去重键
+func reflectionKey(r types.Reflection) string {
+	return r.Timestamp.UTC().Format(time.RFC3339Nano) + "\x00" + r.Content
+}
+
+// messageKey 消息的去重键：ID不同但角色、内容和时间戳相同的消息视为同一条
+func messageKey(msg types.Message) string {
+	return msg.Role + "\x00" + msg.Timestamp.UTC().Format(time.RFC3339Nano) + "\x00" + msg.Content
+}
+
+// mergeStats 单个会话的合并统计
+type mergeStats struct {
+	Messages   int
+	Duplicates int
+	Summaries  int
+}
+
+// mergeThread 合并两个没有归档段的会话，返回合并结果和 src 消息ID到合并后消息ID的映射。
+// dst 为 nil 时相当于新建会话。dst 的当前分支是 src 当前分支的前缀时快进到 src 的分支，
+// 否则保留 dst 的当前分支
+func mergeThread(dst, src *types.Thread) (*types.Thread, map[string]string, mergeStats) {
+	var stats mergeStats
+	t := &types.Thread{ID: src.ID, CreatedAt: src.CreatedAt}
+	if dst != nil {
+		t.Messages = append(t.Messages, dst.Messages...)
+		t.Head = dst.Head
+		t.Summaries = append(t.Summaries, dst.Summaries...)
+		if dst.CreatedAt.Before(t.CreatedAt) || t.CreatedAt.IsZero() {
+			t.CreatedAt = dst.CreatedAt
+		}
+	}
+
+	byID := make(map[string]string, len(t.Messages))
+	byKey := make(map[string]string, len(t.Messages))
+	for _, msg := range t.Messages {
+		byID[msg.ID] = messageKey(msg)
+		byKey[messageKey(msg)] = msg.ID
+	}
+	ids := make(map[string]string, len(src.Messages))
+	var added []types.Message
+	for _, msg := range src.Messages {
+		key := messageKey(msg)
+		if byID[msg.ID] == key {
+			ids[msg.ID] = msg.ID
+			stats.Duplicates++
+			continue
+		}
+		if id, ok := byKey[key]; ok {
+			ids[msg.ID] = id
+			stats.Duplicates++
+			continue
+		}
+		// 旧版本的消息ID按位置编号（m0、m1…），不同部署中相同的ID可能是不同的消息
+		id := msg.ID
+		if _, taken := byID[id]; taken {
+			msg.ID = types.NewMessageID()
+		}
+		ids[id] = msg.ID
+		byID[msg.ID] = key
+		added = append(added, msg)
+	}
+	// 文件中的父消息不一定排在子消息之前，所有ID确定后再换成合并后的父消息ID
+	for _, msg := range added {
+		if msg.ParentID != "" {
+			msg.ParentID = ids[msg.ParentID]
+		}
+		t.Messages = append(t.Messages, msg)
+		stats.Messages++
+	}
+	t.Messages = orderMessages(t.Messages)
+
+	head := ids[src.Head]
+	if t.Head == "" || (head != "" && t.BranchSet(head).Contains(t.Head)) {
+		t.Head = head
+	}
+
+	for _, s := range src.Summaries {
+		if s.StartID, s.EndID = ids[s.StartID], ids[s.EndID]; s.StartID == "" || s.EndID == "" {
+			continue
+		}
+		if hasSummary(t.Summaries, s) {
+			continue
+		}
+		// 覆盖范围按合并后的分支重新计算
+		path := t.Path(s.EndID)
+		start := -1
+		for pos, i := range path {
+			if t.Messages[i].ID == s.StartID {
+				start = pos
+			}
+		}
+		if start < 0 {
+			continue
+		}
+		s.Start, s.End = start, len(path)
+		storage.AddSummary(t, s)
+		stats.Summaries++
+	}
+	if t.Summaries == nil {
+		t.Summaries = []types.Summary{}
+	}
+	return t, ids, stats
+}
+
+// hasSummary 检查是否已有覆盖相同消息的同层摘要
+func hasSummary(summaries []types.Summary, s types.Summary) bool {
+	for _, existing := range summaries {
+		if existing.StartID == s.StartID && existing.EndID == s.EndID && existing.Level == s.Level {
+			return true
+		}
+	}
+	return false
+}
+
+// orderMessages 按时间戳稳定排序消息，并保证父消息排在子消息之前
+func orderMessages(msgs []types.Message) []types.Message {
+	sorted := append([]types.Message(nil), msgs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	present := make(map[string]bool, len(sorted))
+	for _, msg := range sorted {
+		present[msg.ID] = true
+	}
+	ordered := make([]types.Message, 0, len(sorted))
+	emitted := make(map[string]bool, len(sorted))
+	waiting := make(map[string][]types.Message)
+	var emit func(msg types.Message)
+	emit = func(msg types.Message) {
+		ordered = append(ordered, msg)
+		emitted[msg.ID] = true
+		children := waiting[msg.ID]
+		delete(waiting, msg.ID)
+		for _, child := range children {
+			emit(child)
+		}
+	}
+	for _, msg := range sorted {
+		if msg.ParentID != "" && present[msg.ParentID] && !emitted[msg.ParentID] {
+			// 时间戳早于父消息（时钟不一致），等父消息之后再排
+			waiting[msg.ParentID] = append(waiting[msg.ParentID], msg)
+			continue
+		}
+		emit(msg)
+	}
+	// 父消息形成环时无法排序，按时间顺序放在最后
+	for _, msg := range sorted {
+		if !emitted[msg.ID] {
+			ordered = append(ordered, msg)
+			emitted[msg.ID] = true
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,159 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// FactFilter 事实查询条件，为空的条件不作限制
+type FactFilter struct {
+	Subject   string // 主体，不区分大小写
+	Attribute string // 属性，不区分大小写
+	History   bool   // 是否包含已被取代的事实
+}
+
+// matches 检查事实是否满足查询条件
+func (f *FactFilter) matches(fact types.Fact) bool {
+	if !f.History && !fact.Active() {
+		return false
+	}
+	if f.Subject != "" && !strings.EqualFold(strings.TrimSpace(fact.Subject), strings.TrimSpace(f.Subject)) {
+		return false
+	}
+	return f.Attribute == "" || strings.EqualFold(strings.TrimSpace(fact.Attribute), strings.TrimSpace(f.Attribute))
+}
+
+// Facts 返回满足条件的事实副本，按提取顺序排列
+func (m *Manager) Facts(filter FactFilter) []types.Fact {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var facts []types.Fact
+	for _, f := range m.memory.Facts {
+		if filter.matches(f) {
+			facts = append(facts, f)
+		}
+	}
+	return facts
+}
+
+// contextFacts 返回放入上下文的有效事实，置信度高的在前，相同时最近确认的在前，需持有锁
+func (m *Manager) contextFacts() []types.Fact {
+	var facts []types.Fact
+	for _, f := range m.memory.Facts {
+		if f.Active() {
+			facts = append(facts, f)
+		}
+	}
+	sort.SliceStable(facts, func(i, j int) bool {
+		if facts[i].Confidence != facts[j].Confidence {
+			return facts[i].Confidence > facts[j].Confidence
+		}
+		return facts[i].UpdatedAt.After(facts[j].UpdatedAt)
+	})
+	return facts
+}
+
+// extractFacts 从会话当前分支上 fromID 及之后的消息中提取事实，fromID 已不在分支上时
+// 只使用最近一轮对话（最后一条用户消息及之后的回复）。与已有事实冲突的新事实会取代旧事实。
+// 由后台任务在未持有锁时调用，生成期间记忆被整体替换时丢弃结果
+func (m *Manager) extractFacts(threadID, fromID string) error {
+	m.mu.Lock()
+	t := m.memory.Thread(threadID)
+	if t == nil {
+		m.mu.Unlock()
+		return nil
+	}
+	b := branchOf(t)
+	i := b.lastUserIndex()
+	for j, msg := range b.messages {
+		if msg.ID == fromID {
+			i = j
+		}
+	}
+	if i < 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	msgs := b.messages[i:]
+	known := m.contextFacts()
+	lang := m.language()
+	gen := m.generation
+	m.mu.Unlock()
+
+	facts, err := m.llmClient.ExtractFacts(msgs, known, lang)
+	if err != nil {
+		return fmt.Errorf("extract facts: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.generation != gen {
+		return nil
+	}
+	sources := make(map[string]bool, len(msgs))
+	for _, msg := range msgs {
+		sources[msg.ID] = true
+	}
+	now := time.Now()
+	added := 0
+	for _, f := range facts {
+		fact := f
+		fact.Subject, fact.Attribute, fact.Value = strings.TrimSpace(fact.Subject), strings.TrimSpace(fact.Attribute), strings.TrimSpace(fact.Value)
+		if fact.Subject == "" || fact.Attribute == "" || fact.Value == "" {
+			continue
+		}
+		if !sources[fact.MessageID] {
+			fact.MessageID = msgs[0].ID
+		}
+		id := types.NewFactID()
+		fact.ID, fact.Thread, fact.SupersededBy = id, threadID, ""
+		fact.Confidence = min(max(fact.Confidence, 0), 1)
+		fact.CreatedAt, fact.UpdatedAt = now, now
+
+		// 值与已有事实相同时只更新已有事实，日志和事件都使用已有事实的ID
+		fact.ID = storage.AddFact(m.memory, fact)
+		m.journal(nil, storage.Entry{Kind: storage.EntryFact, Fact: &fact})
+		for i := range m.memory.Facts {
+			if m.memory.Facts[i].ID == fact.ID {
+				stored := m.memory.Facts[i]
+				m.emit(Event{Kind: EventFactExtracted, Thread: threadID, Fact: &stored})
+				break
+			}
+		}
+		if fact.ID == id {
+			added++
+		}
+	}
+	if added > 0 {
+		fmt.Printf("🧾 Extracted %d facts (%d known)\n", added, len(m.contextFacts()))
+	}
+	return nil
+}
+
+// pruneFacts 删除事实后修复取代关系：被删除的事实取代的旧事实改为由取代它的事实取代，
+// 被删除的事实仍然有效时，旧事实恢复有效
+func pruneFacts(facts []types.Fact, gone map[string]bool) []types.Fact {
+	next := make(map[string]string, len(gone))
+	for _, f := range facts {
+		if gone[f.ID] {
+			next[f.ID] = f.SupersededBy
+		}
+	}
+	kept := make([]types.Fact, 0, len(facts)-len(gone))
+	for _, f := range facts {
+		if gone[f.ID] {
+			continue
+		}
+		for steps := 0; gone[f.SupersededBy] && steps <= len(gone); steps++ {
+			f.SupersededBy = next[f.SupersededBy]
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
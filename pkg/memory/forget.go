@@ -0,0 +1,345 @@
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// forgetAuditBlob 删除记录在存储中的附加数据名，每行一条 JSON 记录
+const forgetAuditBlob = "forget-audit.jsonl"
+
+// ErrEmptyQuery 表示删除条件为空，会匹配全部消息
+var ErrEmptyQuery = errors.New("forget query needs message ids, a time range or a topic")
+
+// ForgetQuery 删除条件。设置的条件需同时满足，至少要设置消息ID、时间范围或关键词之一
+type ForgetQuery struct {
+	Thread     string    `json:"thread,omitempty"`      // 只在该会话中查找，为空表示所有会话
+	MessageIDs []string  `json:"message_ids,omitempty"` // 指定的消息
+	From       time.Time `json:"from,omitempty"`        // 时间范围的起点（含），零值表示不限
+	To         time.Time `json:"to,omitempty"`          // 时间范围的终点（不含），零值表示不限
+	Topic      string    `json:"topic,omitempty"`       // 内容包含该关键词（不区分大小写）的消息，以及提到它的摘要、反思、事实和笔记
+	Reason     string    `json:"reason,omitempty"`      // 删除原因，写入删除记录
+}
+
+// ForgottenMessage 删除记录中的消息，不包含消息内容
+type ForgottenMessage struct {
+	Thread    string    `json:"thread"`
+	ID        string    `json:"id"`
+	Role      string    `json:"role"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ForgetRecord 一次删除的审计记录。为避免保留被删除的内容，只记录消息ID和时间，
+// 按关键词删除时也不记录关键词本身
+type ForgetRecord struct {
+	Time        time.Time          `json:"time"`
+	Reason      string             `json:"reason,omitempty"`
+	Thread      string             `json:"thread,omitempty"` // 查找范围，为空表示所有会话
+	From        time.Time          `json:"from"`             // 时间范围条件，零值表示不限
+	To          time.Time          `json:"to"`
+	ByTopic     bool               `json:"by_topic,omitempty"` // 是否按关键词删除
+	Messages    []ForgottenMessage `json:"messages"`           // 删除的消息
+	Summaries   int                `json:"summaries"`          // 失效并删除的摘要数
+	Reflections int                `json:"reflections"`        // 失效并删除的反思数
+	Facts       int                `json:"facts"`              // 来自被删除消息或提到关键词的事实数
+	Notes       int                `json:"notes"`              // 从被删除消息中识别出或提到关键词的置顶笔记数
+}
+
+// matches 检查消息是否满足删除条件
+func (q *ForgetQuery) matches(msg types.Message, ids map[string]bool) bool {
+	if len(ids) > 0 && !ids[msg.ID] {
+		return false
+	}
+	if !q.From.IsZero() && msg.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !msg.Timestamp.Before(q.To) {
+		return false
+	}
+	return q.mentions(msg.Content)
+}
+
+// mentions 检查文本是否包含关键词，没有关键词条件时总是返回 true
+func (q *ForgetQuery) mentions(text string) bool {
+	return q.Topic == "" || strings.Contains(strings.ToLower(text), strings.ToLower(q.Topic))
+}
+
+// Forget 删除满足条件的消息，并删除由它们派生的数据：覆盖范围包含（或位于其后、位置因此变化的）
+// 被删除消息的摘要、生成时分支上有被删除消息的反思、来自被删除消息的事实和笔记、提到关键词的摘要、反思、事实和笔记，
+// 以及相关会话的向量索引。被删除的事实曾取代的旧事实重新生效。
+// 被删除消息的子消息接到其最近的未删除祖先上。结果立即写入完整快照（同时清空仍包含原内容的日志），
+// 受影响会话的归档段放回记忆后删除；失效的摘要和反思由后台任务重新生成。
+// 删除记录（不含被删除的内容）追加到存储的审计日志中，见 ForgetLog
+func (m *Manager) Forget(q ForgetQuery) (*ForgetRecord, error) {
+	if len(q.MessageIDs) == 0 && q.From.IsZero() && q.To.IsZero() && q.Topic == "" {
+		return nil, ErrEmptyQuery
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var record *ForgetRecord
+	var stale []string
+	var regenerate map[string]bool
+	err := m.rewrite(func() ([]string, error) {
+		record = &ForgetRecord{
+			Time:     time.Now(),
+			Reason:   q.Reason,
+			Thread:   q.Thread,
+			From:     q.From,
+			To:       q.To,
+			ByTopic:  q.Topic != "",
+			Messages: []ForgottenMessage{},
+		}
+		stale, regenerate = nil, make(map[string]bool)
+		return m.forget(&q, record, &stale, regenerate)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 快照已不再引用旧的归档段
+	if blobs, ok := m.store.(storage.BlobStore); ok {
+		for _, name := range stale {
+			if err := blobs.DeleteBlob(m.memory.UserID, name); err != nil {
+				fmt.Printf("Warning: failed to delete archive segment %s: %v\n", name, err)
+			}
+		}
+	}
+	for threadID, reflect := range regenerate {
+		if t := m.memory.Thread(threadID); t != nil {
+			m.schedule(threadID, t.ContextSize > m.config.SummarizationThreshold, reflect && len(t.Messages) > 0)
+		}
+	}
+
+	forgotten := *record
+	m.emit(Event{Kind: EventForgotten, Thread: q.Thread, Forget: &forgotten})
+
+	if err := m.appendForgetLog(record); err != nil {
+		return record, fmt.Errorf("write forget audit: %w", err)
+	}
+	return record, nil
+}
+
+// forget 在记忆中执行删除并填写删除记录，返回内容变化的会话；stale 收集不再使用的归档段，
+// regenerate 收集需要重新生成摘要的会话（值为 true 时还需要重新生成反思）。
+// 所有会话处理完成后才修改记忆，需持有锁
+func (m *Manager) forget(q *ForgetQuery, record *ForgetRecord, stale *[]string, regenerate map[string]bool) ([]string, error) {
+	ids := make(map[string]bool, len(q.MessageIDs))
+	for _, id := range q.MessageIDs {
+		ids[id] = true
+	}
+	found := make(map[string]bool, len(ids))
+
+	replaced := make(map[string]*types.Thread)
+	before := make(map[string]*types.Thread) // 删除前的完整会话，用于判断反思是否受影响
+	removed := make(map[string]bool)         // 被删除的消息，"会话\x00消息ID"
+	var earliest time.Time
+	var changed []string
+
+	for _, t := range m.memory.Threads {
+		if q.Thread != "" && t.ID != q.Thread {
+			continue
+		}
+		full, err := m.fullThread(t)
+		if err != nil {
+			return nil, err
+		}
+
+		gone := make(map[string]bool)
+		for _, msg := range full.Messages {
+			if ids[msg.ID] {
+				found[msg.ID] = true
+			}
+			if q.matches(msg, ids) {
+				gone[msg.ID] = true
+				removed[t.ID+"\x00"+msg.ID] = true
+				record.Messages = append(record.Messages, ForgottenMessage{Thread: t.ID, ID: msg.ID, Role: msg.Role, Timestamp: msg.Timestamp})
+				if earliest.IsZero() || msg.Timestamp.Before(earliest) {
+					earliest = msg.Timestamp
+				}
+			}
+		}
+
+		// 摘要的位置在被删除的消息之后时也会变化，一并删除后重新生成
+		kept := make([]types.Summary, 0, len(full.Summaries))
+		for _, s := range full.Summaries {
+			if (q.Topic != "" && q.mentions(s.Content)) || prefixHas(full, s, gone) {
+				record.Summaries++
+				continue
+			}
+			kept = append(kept, s)
+		}
+		if len(gone) == 0 && len(kept) == len(full.Summaries) {
+			continue
+		}
+
+		before[t.ID] = full
+		replaced[t.ID] = pruneThread(full, gone, kept)
+		regenerate[t.ID] = false
+		changed = append(changed, t.ID)
+		for _, seg := range t.Segments {
+			*stale = append(*stale, seg.Name)
+		}
+	}
+	for id := range ids {
+		if !found[id] {
+			return nil, fmt.Errorf("forget message %q: %w", id, ErrMessageNotFound)
+		}
+	}
+
+	// 反思由生成时分支上的消息得出；没有记录分支的旧反思可能用到生成之前的任何消息
+	reflections := make([]types.Reflection, 0, len(m.memory.Reflections))
+	for _, r := range m.memory.Reflections {
+		affected := q.Topic != "" && q.mentions(r.Content)
+		if full := before[r.Thread]; full != nil && r.MessageID != "" && full.Find(r.MessageID) >= 0 {
+			for _, i := range full.Path(r.MessageID) {
+				affected = affected || removed[r.Thread+"\x00"+full.Messages[i].ID]
+			}
+		} else if r.MessageID == "" && !earliest.IsZero() && !r.Timestamp.Before(earliest) {
+			affected = true
+		}
+		if !affected {
+			reflections = append(reflections, r)
+			continue
+		}
+		record.Reflections++
+		if m.memory.Thread(r.Thread) != nil {
+			regenerate[r.Thread] = true
+		}
+	}
+
+	gone := make(map[string]bool)
+	for _, f := range m.memory.Facts {
+		if removed[f.Thread+"\x00"+f.MessageID] || (q.Topic != "" && q.mentions(f.Subject+" "+f.Attribute+" "+f.Value)) {
+			gone[f.ID] = true
+		}
+	}
+	record.Facts = len(gone)
+
+	notes := make([]types.Note, 0, len(m.memory.Notes))
+	for _, n := range m.memory.Notes {
+		if (n.MessageID != "" && removed[n.Thread+"\x00"+n.MessageID]) || (q.Topic != "" && q.mentions(n.Content)) {
+			record.Notes++
+			continue
+		}
+		notes = append(notes, n)
+	}
+	if len(changed) == 0 && record.Reflections == 0 && record.Facts == 0 && record.Notes == 0 {
+		return nil, nil
+	}
+
+	for _, id := range changed {
+		t := replaced[id]
+		t.ContextSize = m.contextSize(branchOf(t))
+		m.memory.Threads[threadIndex(m.memory, id)] = t
+	}
+	m.memory.Reflections = reflections
+	if len(gone) > 0 {
+		m.memory.Facts = pruneFacts(m.memory.Facts, gone)
+	}
+	if record.Notes > 0 {
+		m.memory.Notes = notes
+	}
+	return append([]string{}, changed...), nil
+}
+
+// prefixHas 检查摘要所在分支从开头到覆盖范围结束的消息中是否有被删除的消息
+func prefixHas(t *types.Thread, s types.Summary, gone map[string]bool) bool {
+	if len(gone) == 0 {
+		return false
+	}
+	if s.EndID == "" {
+		return true // 无法确定覆盖范围
+	}
+	path := t.Path(s.EndID)
+	if s.End < len(path) {
+		path = path[:s.End]
+	}
+	for _, i := range path {
+		if gone[t.Messages[i].ID] {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneThread 返回删除指定消息后的会话：子消息接到最近的未删除祖先上，
+// 当前分支的最后一条消息被删除时同样移到其最近的未删除祖先
+func pruneThread(full *types.Thread, gone map[string]bool, summaries []types.Summary) *types.Thread {
+	parent := make(map[string]string, len(full.Messages))
+	for _, msg := range full.Messages {
+		parent[msg.ID] = msg.ParentID
+	}
+	survivor := func(id string) string {
+		for steps := 0; gone[id] && steps <= len(full.Messages); steps++ {
+			id = parent[id]
+		}
+		return id
+	}
+
+	t := *full
+	t.Messages = make([]types.Message, 0, len(full.Messages)-len(gone))
+	for _, msg := range full.Messages {
+		if gone[msg.ID] {
+			continue
+		}
+		msg.ParentID = survivor(msg.ParentID)
+		t.Messages = append(t.Messages, msg)
+	}
+	t.Head = survivor(full.Head)
+	t.Summaries = summaries
+	return &t
+}
+
+// appendForgetLog 把删除记录追加到审计日志，存储不支持附加数据时不记录，需持有锁
+func (m *Manager) appendForgetLog(record *ForgetRecord) error {
+	blobs, ok := m.store.(storage.BlobStore)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return blobs.AppendBlob(m.memory.UserID, forgetAuditBlob, append(data, '\n'))
+}
+
+// ForgetLog 返回用户的全部删除记录，按时间顺序排列
+func (m *Manager) ForgetLog() ([]ForgetRecord, error) {
+	blobs, ok := m.store.(storage.BlobStore)
+	if !ok {
+		return nil, nil
+	}
+	m.mu.Lock()
+	userID := m.memory.UserID
+	m.mu.Unlock()
+
+	data, err := blobs.LoadBlob(userID, forgetAuditBlob)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load forget audit: %w", err)
+	}
+
+	var records []ForgetRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var r ForgetRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("parse forget audit: %w", err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
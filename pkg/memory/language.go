@@ -0,0 +1,51 @@
+package memory
+
+import (
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+)
+
+// SetPrompts 设置摘要、反思、事实提取和上下文使用的提示词模板，默认使用内置模板
+func (m *Manager) SetPrompts(set *prompts.Set) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prompts = set
+}
+
+// Language 返回用户的提示词语言：用户设置的语言，未设置时为配置的默认语言
+func (m *Manager) Language() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lang, _ := m.prompts.Resolve(m.language())
+	return lang
+}
+
+// SetLanguage 设置用户的提示词语言并随记忆保存，之后的上下文、摘要、反思和事实提取都使用该语言。
+// 区域标签使用对应的主语言（如 "en-US" 使用 "en"），空字符串恢复为配置的默认语言；
+// 没有该语言的模板时返回 prompts.ErrUnsupportedLanguage
+func (m *Manager) SetLanguage(lang string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if lang != "" {
+		resolved, err := m.prompts.Resolve(lang)
+		if err != nil {
+			return err
+		}
+		lang = resolved
+	}
+	if lang == m.memory.Language {
+		return nil
+	}
+	m.memory.Language = lang
+	m.journal(nil, storage.Entry{Kind: storage.EntryLanguage, Language: lang})
+	return nil
+}
+
+// language 返回用户设置的语言，未设置时为配置的默认语言，需持有锁
+func (m *Manager) language() string {
+	if m.memory.Language != "" {
+		return m.memory.Language
+	}
+	return m.config.Language
+}
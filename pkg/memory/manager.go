@@ -1,209 +1,497 @@
 package memory
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"sync"
 	"time"
 
-	"gopkg.in/yaml.v3"
 	"github.com/Heng-Bian/memory-chat/pkg/types"
 	"github.com/Heng-Bian/memory-chat/pkg/llm"
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/tokenizer"
 )
 
-const (
-	// MaxContextTokens 最大上下文token数
-	MaxContextTokens = 2000
-	// SummarizationThreshold 触发摘要的阈值
-	SummarizationThreshold = 1500
-	// ReflectionInterval 反思间隔（消息数）
-	ReflectionInterval = 5
-)
-
-// MemoryManager 管理对话记忆
+// MemoryManager 管理对话记忆。摘要、反思和事实由后台任务生成，
+// 所有公开方法都可以并发调用
 type Manager struct {
+	// turnMu 串行化同一用户的对话轮次，见 BeginTurn
+	turnMu sync.Mutex
+	// mu 保护以下所有字段，调用大模型和向量模型期间不持有
+	mu sync.Mutex
+
 	memory    *types.ConversationMemory
 	llmClient llm.Client
-	storePath string
+	store     storage.Store
+	tokens    tokenizer.Counter
+	embedder  llm.Embedder
+	config    Config
+
+	// prompts 内部提示词模板，见 SetPrompts
+	prompts *prompts.Set
+
+	// thread 当前会话ID，见 SetThread
+	thread string
+
+	// vectors 各会话的消息向量索引，启用 embedder 后按需加载
+	vectors map[string]*VectorIndex
+	// unsavedVectors 各会话尚未持久化的向量下标
+	unsavedVectors map[string][]int
+	// vectorsRewrite 需要整体重写向量索引的会话
+	vectorsRewrite map[string]bool
+
+	// lexical 关键词索引，按需构建
+	lexical *lexicalIndex
+	// segments 已读取的归档段消息，按附加数据名缓存
+	segments map[string][]types.Message
+
+	// pending 尚未写入存储的日志条目
+	pending []storage.Entry
+	// persisted 存储中是否已有快照
+	persisted bool
+	// generation 记忆被整体替换（加载、合并冲突）时递增，用于丢弃过期的后台任务结果
+	generation uint64
+
+	// 后台维护任务状态，见 worker.go
+	wake          chan struct{}
+	workerDone    chan struct{}
+	idle          *sync.Cond
+	needSummary   map[string]bool   // 需要生成摘要的会话
+	needReflect   string            // 需要据以生成反思的会话，为空表示不需要
+	needFacts     map[string]string // 需要提取事实的会话，值为尚未提取的第一条消息
+	needVectors   map[string]bool   // 有消息需要向量化的会话
+	working       bool
+	closed        bool
+
+	// 事件订阅，见 events.go
+	subscribers    []subscriber
+	nextSubscriber int
+	events         []Event // 尚未分发的事件
+	dispatching    bool
 }
 
-// NewManager 创建新的记忆管理器
-func NewManager(userID string, llmClient llm.Client, storePath string) *Manager {
-	return &Manager{
+// NewManager 创建新的记忆管理器，config 应已通过 Validate 检查
+func NewManager(userID string, llmClient llm.Client, store storage.Store, config Config) *Manager {
+	m := &Manager{
 		memory: &types.ConversationMemory{
 			UserID:      userID,
-			Messages:    []types.Message{},
-			Summary:     "",
 			Reflections: []types.Reflection{},
-			ContextSize: 0,
 		},
-		llmClient: llmClient,
-		storePath: storePath,
+		llmClient:   llmClient,
+		store:       store,
+		tokens:      tokenizer.Estimator{},
+		config:      config,
+		prompts:     prompts.Default(),
+		thread:      types.DefaultThread,
+		needSummary: make(map[string]bool),
+		needFacts:   make(map[string]string),
+		needVectors: make(map[string]bool),
 	}
+	m.idle = sync.NewCond(&m.mu)
+	return m
 }
 
-// Load 从YAML文件加载记忆
+// SetEmbedder 启用基于向量的历史消息检索
+func (m *Manager) SetEmbedder(embedder llm.Embedder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.embedder = embedder
+	m.resetVectors()
+}
+
+// SetTokenCounter 设置token计数器，默认使用 tokenizer.Estimator 估算
+func (m *Manager) SetTokenCounter(counter tokenizer.Counter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens = counter
+}
+
+// Load 从存储后端加载记忆
 func (m *Manager) Load() error {
-	data, err := os.ReadFile(m.storePath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mem, err := m.store.Load(m.memory.UserID)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // 文件不存在，使用默认空记忆
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil // 尚无记忆，使用默认空记忆
 		}
-		return fmt.Errorf("read memory file: %w", err)
+		m.emit(Event{Kind: EventLoadFailed, Err: err})
+		return fmt.Errorf("load memory: %w", err)
 	}
 
-	if err := yaml.Unmarshal(data, m.memory); err != nil {
-		return fmt.Errorf("unmarshal memory: %w", err)
+	m.memory = mem
+	m.pending = nil
+	m.persisted = true
+	m.generation++
+	m.resetVectors()
+	m.lexical = nil
+	m.segments = nil
+	return nil
+}
+
+// Save 保存记忆到存储后端：首次保存写入完整快照，
+// 之后只追加自上次保存以来的日志条目。
+// 如果存储中的记忆已被其他进程修改，会重新加载并在其基础上重放本地变更
+func (m *Manager) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.save()
+}
+
+// save 在已持有锁时保存记忆
+func (m *Manager) save() error {
+	err := m.persist()
+	if errors.Is(err, storage.ErrConflict) {
+		if err := m.rebase(); err != nil {
+			return fmt.Errorf("resolve conflict: %w", err)
+		}
+		err = m.persist()
+	}
+	if err != nil {
+		return err
 	}
 
+	if err := m.saveVectors(); err != nil {
+		return fmt.Errorf("save vector index: %w", err)
+	}
 	return nil
 }
 
-// Save 保存记忆到YAML文件
-func (m *Manager) Save() error {
-	// 确保目录存在
-	dir := filepath.Dir(m.storePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("create directory: %w", err)
+// persist 将待写入的日志条目写入存储
+func (m *Manager) persist() error {
+	if !m.persisted {
+		if err := m.store.Save(m.memory); err != nil {
+			return fmt.Errorf("save memory: %w", err)
+		}
+		m.pending = nil
+		m.persisted = true
+		m.emit(Event{Kind: EventSaved, Snapshot: true})
+		return nil
 	}
 
-	data, err := yaml.Marshal(m.memory)
+	if len(m.pending) == 0 {
+		return nil
+	}
+	if err := m.store.Append(m.memory, m.pending...); err != nil {
+		return fmt.Errorf("append journal: %w", err)
+	}
+	m.emit(Event{Kind: EventSaved, Entries: len(m.pending)})
+	m.pending = nil
+	return nil
+}
+
+// rebase 重新加载存储中的最新记忆，并将尚未保存的日志条目重新编号后应用其上
+func (m *Manager) rebase() error {
+	mem, err := m.store.Load(m.memory.UserID)
+	if errors.Is(err, storage.ErrNotFound) {
+		m.persisted = false
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("marshal memory: %w", err)
+		return err
 	}
 
-	if err := os.WriteFile(m.storePath, data, 0644); err != nil {
-		return fmt.Errorf("write memory file: %w", err)
+	for i := range m.pending {
+		m.pending[i].Seq = mem.JournalSeq + 1
+		if err := m.pending[i].Apply(mem); err != nil {
+			return err
+		}
 	}
 
+	m.memory = mem
+	m.persisted = true
+	m.generation++
+
+	// 合并后消息下标可能变化，丢弃尚未保存的向量，之后按需重建
+	m.resetVectors()
+	m.lexical = nil
+	m.segments = nil
 	return nil
 }
 
-// AddMessage 添加消息到记忆
+// rewrite 修改记忆并立即写入完整快照（同时清空日志），用于导入、删除等无法用日志条目表示的修改。
+// change 修改记忆并返回内容变化的会话，返回 nil 表示没有修改；写入时发现记忆已被其他进程修改，
+// 会重新加载并再执行一次 change。需持有锁
+func (m *Manager) rewrite(change func() ([]string, error)) error {
+	// 先写入尚未保存的变更，使存储与记忆一致
+	if err := m.save(); err != nil {
+		return err
+	}
+	for retried := false; ; retried = true {
+		changed, err := change()
+		if err != nil || changed == nil {
+			return err
+		}
+
+		err = m.store.Save(m.memory)
+		if err == nil {
+			m.afterRewrite(changed)
+			m.emit(Event{Kind: EventSaved, Snapshot: true})
+			return m.saveVectors()
+		}
+		// 已修改的记忆尚未写入，之后只能写入完整快照
+		m.persisted = false
+		if !errors.Is(err, storage.ErrConflict) || retried {
+			return fmt.Errorf("save memory: %w", err)
+		}
+
+		mem, err := m.store.Load(m.memory.UserID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("resolve conflict: %w", err)
+		}
+		if mem == nil {
+			mem = &types.ConversationMemory{UserID: m.memory.UserID, Reflections: []types.Reflection{}}
+		}
+		m.memory = mem
+		m.persisted = err == nil
+		m.generation++
+		m.resetVectors()
+		m.segments = nil
+	}
+}
+
+// afterRewrite 写入快照后重置派生状态：内容变化的会话中消息下标已变化，
+// 其向量索引整体重写为空索引，之后按需重建，需持有锁
+func (m *Manager) afterRewrite(changed []string) {
+	m.pending = nil
+	m.persisted = true
+	m.generation++
+	m.lexical = nil
+	m.segments = nil
+
+	if m.vectors == nil {
+		m.resetVectors()
+	}
+	model := ""
+	if m.embedder != nil {
+		model = m.embedder.Model()
+	}
+	for _, threadID := range changed {
+		m.vectors[threadID] = newVectorIndex(model)
+		m.vectorsRewrite[threadID] = true
+		delete(m.unsavedVectors, threadID)
+	}
+}
+
+// journal 记录一条待持久化的日志条目，t 为条目所属的会话（反思不属于任何会话）
+func (m *Manager) journal(t *types.Thread, entry storage.Entry) {
+	m.memory.JournalSeq++
+	entry.Seq = m.memory.JournalSeq
+	if t != nil {
+		entry.Thread = t.ID
+		entry.ContextSize = t.ContextSize
+	}
+	m.pending = append(m.pending, entry)
+}
+
+// AddMessage 在当前会话的当前分支末尾添加消息，需要时在后台生成摘要和反思
 func (m *Manager) AddMessage(role, content string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.memory.EnsureThread(m.thread)
+	m.appendMessage(t, t.Head, role, content)
+	return nil
+}
+
+// appendMessage 在会话中添加 parentID 的子消息并切换到以它结尾的分支，需持有锁
+func (m *Manager) appendMessage(t *types.Thread, parentID, role, content string) {
 	msg := types.Message{
+		ID:        types.NewMessageID(),
+		ParentID:  parentID,
 		Role:      role,
 		Content:   content,
 		Timestamp: time.Now(),
 	}
 
-	m.memory.Messages = append(m.memory.Messages, msg)
+	extends := parentID == t.Head
+	t.Messages = append(t.Messages, msg)
+	t.Head = msg.ID
 	
-	// 估算token数（简单估算：1个token约4个字符）
-	m.memory.ContextSize += len(content) / 4
-
-	// 检查是否需要摘要
-	if m.memory.ContextSize > SummarizationThreshold {
-		if err := m.summarize(); err != nil {
-			return fmt.Errorf("summarize: %w", err)
+	if extends {
+		t.ContextSize += m.tokens.Count(content)
+	} else {
+		t.ContextSize = m.contextSize(branchOf(t))
+	}
+	m.journal(t, storage.Entry{Kind: storage.EntryMessage, Message: &msg})
+	added := msg
+	m.emit(Event{Kind: EventMessageAdded, Thread: t.ID, Message: &added})
+	if role == "user" && m.config.DetectNotes {
+		if content, ok := detectNote(content); ok {
+			if _, err := m.pinNote(content, t.ID, msg.ID); err != nil {
+				fmt.Printf("Warning: failed to pin note: %v\n", err)
+			}
 		}
 	}
+	if m.lexical != nil {
+		m.lexical.addMessage(t.ID, t.Archived()+len(t.Messages)-1, msg)
+	}
 
-	// 检查是否需要生成反思
-	if len(m.memory.Messages)%ReflectionInterval == 0 {
-		if err := m.reflect(); err != nil {
-			// 反思失败不应该阻止对话继续
-			fmt.Printf("Warning: failed to generate reflection: %v\n", err)
-		}
+	if m.embedder != nil {
+		m.scheduleVectors(t.ID)
 	}
 
-	return nil
+	// 检查是否需要摘要和反思，交给后台任务处理
+	summarize := t.ContextSize > m.config.SummarizationThreshold
+	reflect := m.config.ReflectionInterval > 0 && (t.Archived()+len(t.Messages))%m.config.ReflectionInterval == 0
+	m.schedule(t.ID, summarize, reflect)
+	if role == "assistant" {
+		m.scheduleFacts(t.ID, parentID)
+	}
 }
 
-// summarize 对历史对话进行摘要
-func (m *Manager) summarize() error {
-	if len(m.memory.Messages) == 0 {
+// summarize 对会话当前分支上尚未被摘要覆盖的历史消息生成摘要，并在摘要总量超出预算时向上汇总。
+// 由后台任务在未持有锁时调用，生成期间记忆被整体替换时丢弃结果
+func (m *Manager) summarize(threadID string) error {
+	m.mu.Lock()
+	t := m.memory.Thread(threadID)
+	if t == nil {
+		m.mu.Unlock()
 		return nil
 	}
-
-	fmt.Println("📝 Context window approaching limit, generating summary...")
-
-	// 计算需要摘要的消息数量（保留最近的一部分消息用于上下文）
-	keepRecent := 5 // 保留最近5条消息用于上下文
-	if len(m.memory.Messages) <= keepRecent {
+	// 保留最近的一部分消息用于上下文
+	b := branchOf(t)
+	start := b.coveredEnd()
+	end := b.length() - m.config.KeepRecent
+	if end <= start {
+		m.mu.Unlock()
 		return nil
 	}
+	msgs := b.messages[start-b.offset : end-b.offset]
+	lang := m.language()
+	gen := m.generation
+	m.mu.Unlock()
+
+	fmt.Println("📝 Context window approaching limit, generating summary...")
 
 	// 将旧消息进行摘要，但不删除它们
-	messagesToSummarize := m.memory.Messages[:len(m.memory.Messages)-keepRecent]
-	summary, err := m.llmClient.Summarize(messagesToSummarize)
+	content, err := m.llmClient.Summarize(msgs, lang)
 	if err != nil {
 		return fmt.Errorf("generate summary: %w", err)
 	}
 
-	// 更新摘要（保留所有消息）
-	if m.memory.Summary != "" {
-		m.memory.Summary = m.memory.Summary + "\n\n" + summary
-	} else {
-		m.memory.Summary = summary
+	m.mu.Lock()
+	if m.generation != gen {
+		m.mu.Unlock()
+		return nil
 	}
-
-	// 重新估算总的上下文大小（包含所有消息，用于统计）
-	totalContextSize := len(m.memory.Summary) / 4
-	for _, msg := range m.memory.Messages {
-		totalContextSize += len(msg.Content) / 4
+	m.addSummary(t, types.Summary{
+		Content:   content,
+		Start:     start,
+		End:       end,
+		StartID:   msgs[0].ID,
+		EndID:     msgs[len(msgs)-1].ID,
+		Level:     0,
+		CreatedAt: time.Now(),
+	})
+	m.mu.Unlock()
+
+	if err := m.rollupSummaries(threadID); err != nil {
+		return fmt.Errorf("roll up summaries: %w", err)
 	}
-	m.memory.ContextSize = totalContextSize
 
-	fmt.Printf("✅ Summary generated. Messages preserved: %d, Total context: ~%d tokens (sent to LLM: summary + recent %d messages)\n", 
-		len(m.memory.Messages), totalContextSize, keepRecent)
+	m.mu.Lock()
+	b = branchOf(t)
+	fmt.Printf("✅ Summary generated. Messages preserved: %d, Context: ~%d tokens (%d summaries + %d recent messages)\n",
+		b.length(), t.ContextSize, len(b.summaries), len(b.recent()))
+	m.mu.Unlock()
 	return nil
 }
 
-// reflect 生成对话反思
-func (m *Manager) reflect() error {
-	if len(m.memory.Messages) == 0 {
+// reflect 根据会话当前分支的内容生成反思。反思在用户的所有会话间共享，
+// 在同一会话中只用于生成它的分支。由后台任务在未持有锁时调用
+func (m *Manager) reflect(threadID string) error {
+	m.mu.Lock()
+	t := m.memory.Thread(threadID)
+	if t == nil || len(t.Messages) == 0 {
+		m.mu.Unlock()
 		return nil
 	}
+	b := branchOf(t)
+	msgs := b.messages
+	summary := b.summaryText()
+	head := t.Head
+	lang := m.language()
+	gen := m.generation
+	m.mu.Unlock()
 
 	fmt.Println("🤔 Generating reflection on conversation...")
 
-	reflection, err := m.llmClient.GenerateReflection(m.memory.Messages, m.memory.Summary)
+	reflection, err := m.llmClient.GenerateReflection(msgs, summary, lang)
 	if err != nil {
 		return fmt.Errorf("generate reflection: %w", err)
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.generation != gen {
+		return nil
+	}
+	reflection.Thread, reflection.MessageID = threadID, head
 	m.memory.Reflections = append(m.memory.Reflections, *reflection)
+	m.journal(nil, storage.Entry{Kind: storage.EntryReflection, Reflection: reflection})
+	created := *reflection
+	m.emit(Event{Kind: EventReflectionCreated, Thread: threadID, Reflection: &created})
+	m.lexical = nil
 	fmt.Printf("✅ Reflection generated (importance: %d/10)\n", reflection.Importance)
-	
+
 	return nil
 }
 
-// GetContextMessages 获取用于发送给LLM的上下文消息
+// GetContextMessages 获取当前会话当前分支用于发送给LLM的上下文消息
 func (m *Manager) GetContextMessages() []types.Message {
-	messages := []types.Message{}
-
-	// 如果有摘要，将其作为系统消息添加
-	if m.memory.Summary != "" {
-		messages = append(messages, types.Message{
-			Role:    "system",
-			Content: "以下是之前对话的摘要：\n" + m.memory.Summary,
-		})
-	}
-
-	// 如果有重要的反思，也添加进来
-	if len(m.memory.Reflections) > 0 {
-		var importantReflections string
-		for _, r := range m.memory.Reflections {
-			if r.Importance >= 7 { // 只包含重要性>=7的反思
-				importantReflections += r.Content + "\n\n"
-			}
-		}
-		if importantReflections != "" {
-			messages = append(messages, types.Message{
-				Role:    "system",
-				Content: "重要反思和观察：\n" + importantReflections,
-			})
-		}
-	}
-
-	// 添加当前对话消息
-	messages = append(messages, m.memory.Messages...)
+	return m.BuildContext("").Messages
+}
 
-	return messages
+// BuildContext 在配置的上下文预算内组装当前会话当前分支的上下文，
+// 返回结果中包含因超出预算而被丢弃的内容
+func (m *Manager) BuildContext(systemPrompt string) *ContextResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.embedQuery()
+	b := branchOf(m.current())
+	builder := &ContextBuilder{
+		Budget:       m.config.MaxContextTokens,
+		CountTokens:  m.tokens.Count,
+		Prompts:      m.prompts,
+		Language:     m.language(),
+		SystemPrompt: systemPrompt,
+		Notes:        m.memory.Notes,
+		Summary:      b.summaryText(),
+		Facts:        m.contextFacts(),
+		Reflections:  m.rankReflections(b.lastUserMessage(), time.Now(), b.sees),
+		Retrieved:    m.retrieve(b),
+		Recent:       b.recent(),
+	}
+	return builder.Build()
 }
 
-// GetMemory 获取完整的记忆信息
+// GetMemory 获取完整记忆信息的副本，修改副本不会影响管理器
 func (m *Manager) GetMemory() *types.ConversationMemory {
-	return m.memory
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mem := *m.memory
+	mem.Threads = make([]*types.Thread, len(m.memory.Threads))
+	for i, t := range m.memory.Threads {
+		thread := *t
+		thread.Segments = append([]types.Segment(nil), t.Segments...)
+		thread.Messages = append([]types.Message(nil), t.Messages...)
+		thread.Summaries = append([]types.Summary(nil), t.Summaries...)
+		mem.Threads[i] = &thread
+	}
+	mem.Reflections = append([]types.Reflection(nil), m.memory.Reflections...)
+	mem.Facts = append([]types.Fact(nil), m.memory.Facts...)
+	mem.Notes = append([]types.Note(nil), m.memory.Notes...)
+	return &mem
+}
+
+// BeginTurn 开始一轮对话（添加用户消息、组装上下文、添加回复），返回结束函数。
+// 同一用户的多轮对话依次进行，避免并发请求的消息相互交错
+func (m *Manager) BeginTurn() (end func()) {
+	m.turnMu.Lock()
+	return m.turnMu.Unlock
 }
@@ -1,11 +1,20 @@
 package memory
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
 	"github.com/Heng-Bian/memory-chat/pkg/types"
 )
 
@@ -15,6 +24,8 @@ type MockLLMClient struct {
 	summarizeResponse    string
 	reflectionResponse   string
 	reflectionImportance int
+	facts                []types.Fact
+	language             string // 最近一次摘要、反思或事实提取使用的语言
 }
 
 func (m *MockLLMClient) Chat(messages []types.Message) (*types.Message, int, error) {
@@ -32,11 +43,13 @@ func (m *MockLLMClient) ChatStream(messages []types.Message, streamFunc func(str
 	return 100, nil
 }
 
-func (m *MockLLMClient) Summarize(messages []types.Message) (string, error) {
+func (m *MockLLMClient) Summarize(messages []types.Message, lang string) (string, error) {
+	m.language = lang
 	return m.summarizeResponse, nil
 }
 
-func (m *MockLLMClient) GenerateReflection(messages []types.Message, summary string) (*types.Reflection, error) {
+func (m *MockLLMClient) GenerateReflection(messages []types.Message, summary, lang string) (*types.Reflection, error) {
+	m.language = lang
 	return &types.Reflection{
 		Content:    m.reflectionResponse,
 		Timestamp:  time.Now(),
@@ -44,9 +57,18 @@ func (m *MockLLMClient) GenerateReflection(messages []types.Message, summary str
 	}, nil
 }
 
+func (m *MockLLMClient) ExtractFacts(messages []types.Message, known []types.Fact, lang string) ([]types.Fact, error) {
+	m.language = lang
+	return m.facts, nil
+}
+
+// defaultThread 返回默认会话，尚不存在时创建
+func defaultThread(mm *Manager) *types.Thread {
+	return mm.memory.EnsureThread(types.DefaultThread)
+}
+
 func TestMemoryManager_AddMessage(t *testing.T) {
 	tmpDir := t.TempDir()
-	storePath := filepath.Join(tmpDir, "test_user.yaml")
 
 	mockClient := &MockLLMClient{
 		chatResponse:       "Test response",
@@ -55,7 +77,8 @@ func TestMemoryManager_AddMessage(t *testing.T) {
 		reflectionImportance: 5,
 	}
 
-	mm := NewManager("test_user", mockClient, storePath)
+	mm := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm.Close()
 
 	// 添加消息
 	err := mm.AddMessage("user", "Hello")
@@ -63,11 +86,11 @@ func TestMemoryManager_AddMessage(t *testing.T) {
 		t.Fatalf("AddMessage failed: %v", err)
 	}
 
-	if len(mm.memory.Messages) != 1 {
-		t.Errorf("Expected 1 message, got %d", len(mm.memory.Messages))
+	if len(defaultThread(mm).Messages) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(defaultThread(mm).Messages))
 	}
 
-	msg := mm.memory.Messages[0]
+	msg := defaultThread(mm).Messages[0]
 	if msg.Role != "user" || msg.Content != "Hello" {
 		t.Errorf("Message not stored correctly: %+v", msg)
 	}
@@ -82,7 +105,8 @@ func TestMemoryManager_SaveAndLoad(t *testing.T) {
 	}
 
 	// 创建并保存记忆
-	mm1 := NewManager("test_user", mockClient, storePath)
+	mm1 := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm1.Close()
 	mm1.AddMessage("user", "Hello")
 	mm1.AddMessage("assistant", "Hi there")
 
@@ -97,14 +121,15 @@ func TestMemoryManager_SaveAndLoad(t *testing.T) {
 	}
 
 	// 加载记忆
-	mm2 := NewManager("test_user", mockClient, storePath)
+	mm2 := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm2.Close()
 	err = mm2.Load()
 	if err != nil {
 		t.Fatalf("Load failed: %v", err)
 	}
 
-	if len(mm2.memory.Messages) != 2 {
-		t.Errorf("Expected 2 messages after load, got %d", len(mm2.memory.Messages))
+	if len(defaultThread(mm2).Messages) != 2 {
+		t.Errorf("Expected 2 messages after load, got %d", len(defaultThread(mm2).Messages))
 	}
 
 	if mm2.memory.UserID != "test_user" {
@@ -114,10 +139,10 @@ func TestMemoryManager_SaveAndLoad(t *testing.T) {
 
 func TestMemoryManager_GetContextMessages(t *testing.T) {
 	tmpDir := t.TempDir()
-	storePath := filepath.Join(tmpDir, "test_user.yaml")
 
 	mockClient := &MockLLMClient{}
-	mm := NewManager("test_user", mockClient, storePath)
+	mm := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm.Close()
 
 	// 添加一些消息
 	mm.AddMessage("user", "Message 1")
@@ -130,7 +155,7 @@ func TestMemoryManager_GetContextMessages(t *testing.T) {
 	}
 
 	// 添加摘要
-	mm.memory.Summary = "This is a summary"
+	defaultThread(mm).Summaries = []types.Summary{{Content: "This is a summary"}}
 	messages = mm.GetContextMessages()
 
 	// 应该包含摘要（作为system消息）+ 2条消息
@@ -145,54 +170,57 @@ func TestMemoryManager_GetContextMessages(t *testing.T) {
 
 func TestMemoryManager_Summarize(t *testing.T) {
 	tmpDir := t.TempDir()
-	storePath := filepath.Join(tmpDir, "test_user.yaml")
 
 	mockClient := &MockLLMClient{
 		summarizeResponse: "Summarized content",
 	}
 
-	mm := NewManager("test_user", mockClient, storePath)
+	mm := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
 
 	// 添加足够多的消息以触发摘要
 	for i := 0; i < 10; i++ {
 		mm.AddMessage("user", "Message with lots of content to increase token count "+string(make([]byte, 200)))
 	}
 
-	// 手动触发摘要
-	initialMsgCount := len(mm.memory.Messages)
-	err := mm.summarize()
+	// 等待第5、10条消息触发的后台反思完成，再手动触发摘要
+	mm.Wait()
+	initialMsgCount := len(defaultThread(mm).Messages)
+	err := mm.summarize(types.DefaultThread)
 	if err != nil {
 		t.Fatalf("Summarize failed: %v", err)
 	}
 
-	// 验证摘要被生成
-	if mm.memory.Summary == "" {
-		t.Error("Summary should not be empty after summarization")
+	// 验证摘要被生成，并且覆盖除最近5条之外的消息
+	if len(defaultThread(mm).Summaries) != 1 {
+		t.Fatalf("Expected 1 summary after summarization, got %d", len(defaultThread(mm).Summaries))
+	}
+	if s := defaultThread(mm).Summaries[0]; s.Start != 0 || s.End != initialMsgCount-5 {
+		t.Errorf("Unexpected summary coverage [%d, %d)", s.Start, s.End)
 	}
 
 	// 验证所有消息都被保留（不应该删除）
-	if len(mm.memory.Messages) != initialMsgCount {
-		t.Errorf("All messages should be preserved after summarization, expected %d, got %d", initialMsgCount, len(mm.memory.Messages))
+	if len(defaultThread(mm).Messages) != initialMsgCount {
+		t.Errorf("All messages should be preserved after summarization, expected %d, got %d", initialMsgCount, len(defaultThread(mm).Messages))
 	}
 }
 
 func TestMemoryManager_Reflection(t *testing.T) {
 	tmpDir := t.TempDir()
-	storePath := filepath.Join(tmpDir, "test_user.yaml")
 
 	mockClient := &MockLLMClient{
 		reflectionResponse:   "This is a reflection",
 		reflectionImportance: 8,
 	}
 
-	mm := NewManager("test_user", mockClient, storePath)
+	mm := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm.Close()
 
 	// 添加一些消息
 	mm.AddMessage("user", "Test message 1")
 	mm.AddMessage("assistant", "Response 1")
 
 	// 手动触发反思
-	err := mm.reflect()
+	err := mm.reflect(types.DefaultThread)
 	if err != nil {
 		t.Fatalf("Reflect failed: %v", err)
 	}
@@ -214,10 +242,10 @@ func TestMemoryManager_Reflection(t *testing.T) {
 
 func TestMemoryManager_HighImportanceReflections(t *testing.T) {
 	tmpDir := t.TempDir()
-	storePath := filepath.Join(tmpDir, "test_user.yaml")
 
 	mockClient := &MockLLMClient{}
-	mm := NewManager("test_user", mockClient, storePath)
+	mm := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm.Close()
 
 	// 添加低重要性反思
 	mm.memory.Reflections = append(mm.memory.Reflections, types.Reflection{
@@ -257,3 +285,1398 @@ func TestMemoryManager_HighImportanceReflections(t *testing.T) {
 		// 测试通过
 	}
 }
+
+func TestMemoryManager_SaveAppendsJournal(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := storage.NewYAMLStore(tmpDir)
+
+	mockClient := &MockLLMClient{}
+	mm1 := NewManager("test_user", mockClient, store, DefaultConfig())
+	defer mm1.Close()
+	mm1.AddMessage("user", "Hello")
+	if err := mm1.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// 首次保存之后只追加日志
+	mm1.AddMessage("assistant", "Hi there")
+	if err := mm1.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if _, err := os.Stat(store.JournalPath("test_user")); err != nil {
+		t.Fatalf("Expected journal file after second save: %v", err)
+	}
+
+	mm2 := NewManager("test_user", mockClient, store, DefaultConfig())
+	defer mm2.Close()
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(defaultThread(mm2).Messages) != 2 || defaultThread(mm2).Messages[1].Content != "Hi there" {
+		t.Errorf("Expected journal to be replayed, got %+v", defaultThread(mm2).Messages)
+	}
+}
+
+func TestMemoryManager_SaveReencryptsAfterLoad(t *testing.T) {
+	tmpDir := t.TempDir()
+	plain := storage.NewYAMLStore(tmpDir)
+	mm1 := NewManager("test_user", &MockLLMClient{}, plain, DefaultConfig())
+	defer mm1.Close()
+	mm1.AddMessage("user", "my secret plan")
+	if err := mm1.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := plain.SaveBlob("test_user", "extra.bin", []byte("secret blob")); err != nil {
+		t.Fatalf("SaveBlob failed: %v", err)
+	}
+
+	// 启用加密后加载，之后的第一次保存就要把明文快照和附加数据重写为密文
+	key := bytes.Repeat([]byte{1}, 32)
+	keys, err := storage.NewKeyring(key)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	store := storage.NewYAMLStore(tmpDir)
+	store.Keys = keys
+	mm2 := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	defer mm2.Close()
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	mm2.AddMessage("assistant", "noted")
+	if err := mm2.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	id := sha256.Sum256(key)
+	header := append([]byte("\x89MCE\x01"), id[:8]...)
+	for _, path := range []string{store.Path("test_user"), filepath.Join(tmpDir, "test_user.blobs", "extra.bin")} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if !bytes.HasPrefix(data, header) || bytes.Contains(data, []byte("secret")) {
+			t.Errorf("Expected %s encrypted with the current key, got %q", filepath.Base(path), data[:min(len(data), 16)])
+		}
+	}
+}
+
+func TestMemoryManager_SaveMergesConcurrentWriter(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockLLMClient{}
+
+	// 两个独立的存储实例模拟两个进程（CLI 和 server）共用同一目录
+	mm1 := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm1.Close()
+	mm2 := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm2.Close()
+	if err := mm1.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	mm1.AddMessage("user", "From CLI")
+	if err := mm1.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	mm2.AddMessage("user", "From server")
+	if err := mm2.Save(); err != nil {
+		t.Fatalf("Save with conflict failed: %v", err)
+	}
+
+	mm3 := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm3.Close()
+	if err := mm3.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(defaultThread(mm3).Messages) != 2 {
+		t.Fatalf("Expected both writers' messages, got %+v", defaultThread(mm3).Messages)
+	}
+	if defaultThread(mm3).Messages[0].Content != "From CLI" || defaultThread(mm3).Messages[1].Content != "From server" {
+		t.Errorf("Unexpected merged order: %+v", defaultThread(mm3).Messages)
+	}
+}
+
+func TestMemoryManager_RollupSummaries(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockLLMClient{summarizeResponse: "Rolled up"}
+	mm := NewManager("test_user", mockClient, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm.Close()
+
+	long := strings.Repeat("word ", 800)
+	for i := 0; i < 4; i++ {
+		content := long
+		if i == 3 {
+			content = "newest"
+		}
+		defaultThread(mm).Summaries = append(defaultThread(mm).Summaries, types.Summary{
+			Content: content, Start: i * 10, End: (i + 1) * 10,
+		})
+	}
+
+	if err := mm.rollupSummaries(types.DefaultThread); err != nil {
+		t.Fatalf("rollupSummaries failed: %v", err)
+	}
+
+	if len(defaultThread(mm).Summaries) != 2 {
+		t.Fatalf("Expected rolled-up summary plus newest summary, got %+v", defaultThread(mm).Summaries)
+	}
+	top := defaultThread(mm).Summaries[0]
+	if top.Level != 1 || top.Start != 0 || top.End != 30 || top.Content != "Rolled up" {
+		t.Errorf("Unexpected rolled-up summary: %+v", top)
+	}
+	if newest := defaultThread(mm).Summaries[1]; newest.Level != 0 || newest.Start != 30 {
+		t.Errorf("Newest summary should be kept as is: %+v", newest)
+	}
+
+	// 只有两条摘要仍然超出预算时两条一起汇总
+	pair := mm.memory.EnsureThread("pair")
+	pair.Summaries = []types.Summary{{Content: long, Start: 0, End: 10}, {Content: long, Start: 10, End: 20}}
+	if err := mm.rollupSummaries("pair"); err != nil {
+		t.Fatalf("rollupSummaries failed: %v", err)
+	}
+	if s := pair.Summaries; len(s) != 1 || s[0].Level != 1 || s[0].Start != 0 || s[0].End != 20 {
+		t.Errorf("Expected both summaries rolled up, got %+v", s)
+	}
+}
+
+func TestMemoryManager_LoadUpgradesLegacySummary(t *testing.T) {
+	tmpDir := t.TempDir()
+	legacy := "user_id: test_user\nsummary: old summary\nmessages:\n" +
+		strings.Repeat("  - role: user\n    content: hi\n", 7)
+	if err := os.WriteFile(filepath.Join(tmpDir, "test_user.yaml"), []byte(legacy), 0644); err != nil {
+		t.Fatalf("write legacy file: %v", err)
+	}
+
+	mm := NewManager("test_user", &MockLLMClient{}, storage.NewYAMLStore(tmpDir), DefaultConfig())
+	defer mm.Close()
+	if err := mm.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if len(defaultThread(mm).Summaries) != 1 || defaultThread(mm).Summaries[0].End != 2 {
+		t.Fatalf("Expected legacy summary covering first 2 messages, got %+v", defaultThread(mm).Summaries)
+	}
+
+	// 已被摘要覆盖的消息不再作为最近消息出现在上下文中（检索到的相关历史除外）
+	var messages []types.Message
+	for _, msg := range mm.GetContextMessages() {
+		if !strings.HasPrefix(msg.Content, "相关的历史对话") {
+			messages = append(messages, msg)
+		}
+	}
+	if len(messages) != 6 {
+		t.Errorf("Expected summary + 5 recent messages, got %d", len(messages))
+	}
+}
+
+// keywordEmbedder 按关键词出现与否生成向量的模拟向量化客户端
+type keywordEmbedder struct {
+	keywords []string
+	calls    int
+}
+
+func (e *keywordEmbedder) Model() string { return "keyword" }
+
+func (e *keywordEmbedder) Embed(texts []string) ([][]float32, error) {
+	e.calls++
+	vecs := make([][]float32, len(texts))
+	for i, text := range texts {
+		vec := make([]float32, len(e.keywords)+1)
+		vec[len(e.keywords)] = 0.1
+		for j, kw := range e.keywords {
+			if strings.Contains(text, kw) {
+				vec[j] = 1
+			}
+		}
+		vecs[i] = vec
+	}
+	return vecs, nil
+}
+
+func TestMemoryManager_RetrievesRelevantPastMessages(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := storage.NewYAMLStore(tmpDir)
+	embedder := &keywordEmbedder{keywords: []string{"deploy", "cat"}}
+
+	mm := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	defer mm.Close()
+	mm.SetEmbedder(embedder)
+	mm.AddMessage("user", "my cat is called Tom")
+	mm.AddMessage("user", "we deploy on Fridays")
+	mm.AddMessage("user", "unrelated chatter")
+	mm.Wait() // 历史消息由后台任务向量化
+	defaultThread(mm).Summaries = []types.Summary{{Content: "older talk", Start: 0, End: 3}}
+	mm.AddMessage("user", "when do we deploy?")
+
+	messages := mm.GetContextMessages()
+	var retrieved string
+	for _, msg := range messages {
+		if strings.HasPrefix(msg.Content, "相关的历史对话") {
+			retrieved = msg.Content
+		}
+	}
+	if !strings.Contains(retrieved, "we deploy on Fridays") {
+		t.Fatalf("Expected deploy message to be retrieved, got %q", retrieved)
+	}
+	if strings.Index(retrieved, "deploy on Fridays") > strings.Index(retrieved, "cat is called") &&
+		strings.Contains(retrieved, "cat is called") {
+		t.Errorf("Most relevant message should come first: %q", retrieved)
+	}
+
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// 重新加载后应复用已保存的向量，不再重新向量化历史消息
+	mm2 := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	defer mm2.Close()
+	reloaded := &keywordEmbedder{keywords: embedder.keywords}
+	mm2.SetEmbedder(reloaded)
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	mm2.AddMessage("assistant", "Fridays")
+	mm2.Wait()
+	if reloaded.calls != 1 {
+		t.Errorf("Expected only the new message to be embedded, got %d calls", reloaded.calls)
+	}
+	if len(mm2.vectors[types.DefaultThread].vectors) != 5 {
+		t.Errorf("Expected 5 indexed messages, got %d", len(mm2.vectors[types.DefaultThread].vectors))
+	}
+}
+
+// blockingEmbedder 在 release 关闭前不返回的 embedder，模拟无响应的向量服务
+type blockingEmbedder struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (e *blockingEmbedder) Model() string { return "blocking" }
+
+func (e *blockingEmbedder) Embed(texts []string) ([][]float32, error) {
+	e.once.Do(func() { close(e.started) })
+	<-e.release
+	vecs := make([][]float32, len(texts))
+	for i := range vecs {
+		vecs[i] = []float32{1}
+	}
+	return vecs, nil
+}
+
+func TestMemoryManager_EmbeddingDoesNotBlock(t *testing.T) {
+	mm := NewManager("test_user", &MockLLMClient{}, storage.NewYAMLStore(t.TempDir()), DefaultConfig())
+	defer mm.Close()
+	embedder := &blockingEmbedder{started: make(chan struct{}), release: make(chan struct{})}
+	mm.SetEmbedder(embedder)
+	mm.AddMessage("user", "hello")
+	<-embedder.started
+
+	// 向量化期间其他调用不应等待向量服务
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mm.BuildContext("system")
+		mm.Notes()
+		mm.AddMessage("assistant", "hi")
+		if err := mm.Save(); err != nil {
+			t.Errorf("Save failed: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(embedder.release)
+		t.Fatal("Manager calls blocked while the embedder was running")
+	}
+
+	close(embedder.release)
+	mm.Wait()
+	mm.mu.Lock()
+	n := len(mm.vectors[types.DefaultThread].vectors)
+	mm.mu.Unlock()
+	if n != 2 {
+		t.Errorf("Expected both messages embedded in the background, got %d", n)
+	}
+}
+
+// reloadingEmbedder 每次调用时模拟记忆在向量化期间被重新加载
+type reloadingEmbedder struct {
+	mm    *Manager
+	calls int
+}
+
+func (e *reloadingEmbedder) Model() string { return "reloading" }
+
+func (e *reloadingEmbedder) Embed(texts []string) ([][]float32, error) {
+	e.calls++
+	e.mm.mu.Lock()
+	e.mm.generation++
+	e.mm.mu.Unlock()
+	vecs := make([][]float32, len(texts))
+	for i := range vecs {
+		vecs[i] = []float32{1}
+	}
+	return vecs, nil
+}
+
+func TestMemoryManager_IndexStopsAfterReload(t *testing.T) {
+	mm := NewManager("test_user", &MockLLMClient{}, storage.NewYAMLStore(t.TempDir()), DefaultConfig())
+	mm.Close()
+	for i := 0; i < embedBatchSize+1; i++ {
+		mm.AddMessage("user", fmt.Sprintf("message %d", i))
+	}
+	embedder := &reloadingEmbedder{mm: mm}
+	mm.SetEmbedder(embedder)
+
+	if err := mm.indexMessages(types.DefaultThread); err != nil {
+		t.Fatalf("indexMessages failed: %v", err)
+	}
+	if embedder.calls != 1 {
+		t.Errorf("Expected the remaining batches skipped after a reload, got %d calls", embedder.calls)
+	}
+}
+
+func TestMemoryManager_SearchAndLexicalRetrieval(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := storage.NewYAMLStore(tmpDir)
+
+	mm := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	defer mm.Close()
+	mm.AddMessage("user", "我上个月开始做一个记忆管理的项目")
+	mm.AddMessage("assistant", "听起来很有意思")
+	mm.AddMessage("user", "今天天气不错")
+	defaultThread(mm).Summaries = []types.Summary{{Content: "用户聊了天气", Start: 0, End: 3}}
+	mm.memory.Reflections = append(mm.memory.Reflections, types.Reflection{Content: "用户关心自己的项目进展", Importance: 5})
+	mm.lexical = nil
+
+	results := mm.Search("项目", 5)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %+v", results)
+	}
+	kinds := map[SearchKind]bool{}
+	for _, r := range results {
+		kinds[r.Kind] = true
+	}
+	if !kinds[SearchMessage] || !kinds[SearchReflection] {
+		t.Errorf("Expected message and reflection hits, got %+v", results)
+	}
+
+	// 未配置 embedder 时，按关键词检索被摘要覆盖的消息
+	mm.AddMessage("user", "那个记忆项目现在怎么样了？")
+	var retrieved string
+	for _, msg := range mm.GetContextMessages() {
+		if strings.HasPrefix(msg.Content, "相关的历史对话") {
+			retrieved = msg.Content
+		}
+	}
+	if !strings.Contains(retrieved, "记忆管理的项目") {
+		t.Errorf("Expected project message to be retrieved, got %q", retrieved)
+	}
+	if strings.Contains(retrieved, "那个记忆项目") {
+		t.Errorf("Uncovered message should not be retrieved: %q", retrieved)
+	}
+}
+
+func TestMemoryManager_RankReflections(t *testing.T) {
+	mm := NewManager("test_user", &MockLLMClient{}, storage.NewYAMLStore(t.TempDir()), DefaultConfig())
+	defer mm.Close()
+	now := time.Now()
+	mm.memory.Reflections = []types.Reflection{
+		{Content: "用户很在意代码风格", Importance: 9, Timestamp: now.Add(-30 * 24 * time.Hour)},
+		{Content: "用户正在准备去日本旅行", Importance: 4, Timestamp: now.Add(-time.Hour)},
+		{Content: "用户喜欢喝咖啡", Importance: 6, Timestamp: now},
+	}
+
+	// 没有相关性时，旧的高重要性反思已经衰减，较新的反思排在前面
+	got := mm.rankReflections("", now, nil)
+	if len(got) != 3 || got[0].Content != "用户喜欢喝咖啡" || got[2].Content != "用户很在意代码风格" {
+		t.Errorf("Unexpected ranking without query: %+v", got)
+	}
+
+	// 与查询相关的反思排在最前面
+	got = mm.rankReflections("日本旅行有什么推荐", now, nil)
+	if got[0].Content != "用户正在准备去日本旅行" {
+		t.Errorf("Expected relevant reflection first, got %+v", got)
+	}
+
+	// 只看重要性时忽略时间
+	mm.config.Reflection = ReflectionScoring{ImportanceWeight: 1, DecayPerHour: 0.995, TopK: 1}
+	got = mm.rankReflections("日本旅行", now, nil)
+	if len(got) != 1 || got[0].Content != "用户很在意代码风格" {
+		t.Errorf("Expected only the most important reflection, got %+v", got)
+	}
+}
+
+func TestConfig_ForModelAndValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("Default config should be valid: %v", err)
+	}
+
+	small := ConfigForModel("qwen2:7b")
+	large := ConfigForModel("gpt-4o-mini")
+	if small.MaxContextTokens != DefaultConfig().MaxContextTokens {
+		t.Errorf("Unknown model should use default config, got %+v", small)
+	}
+	if large.MaxContextTokens <= small.MaxContextTokens || large.KeepRecent <= small.KeepRecent {
+		t.Errorf("Large-context model should get a bigger budget: %+v", large)
+	}
+	if err := large.Validate(); err != nil {
+		t.Errorf("Model config should be valid: %v", err)
+	}
+
+	bad := DefaultConfig()
+	bad.SummarizationThreshold = bad.MaxContextTokens + 1
+	bad.Reflection.DecayPerHour = 0
+	err := bad.Validate()
+	if err == nil || !strings.Contains(err.Error(), "summarization threshold") || !strings.Contains(err.Error(), "reflection decay") {
+		t.Errorf("Expected both problems reported, got %v", err)
+	}
+}
+
+func TestMemoryManager_ConfigControlsSummarization(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxContextTokens = 100
+	cfg.SummarizationThreshold = 20
+	cfg.SummaryBudget = 10
+	cfg.KeepRecent = 2
+	cfg.ReflectionInterval = 0
+
+	mockClient := &MockLLMClient{summarizeResponse: "short"}
+	mm := NewManager("test_user", mockClient, storage.NewYAMLStore(t.TempDir()), cfg)
+	for i := 0; i < 6; i++ {
+		mm.AddMessage("user", strings.Repeat("word ", 5))
+	}
+	mm.Wait()
+
+	if len(mm.memory.Reflections) != 0 {
+		t.Errorf("Reflection interval 0 should disable reflections, got %d", len(mm.memory.Reflections))
+	}
+	if len(defaultThread(mm).Summaries) == 0 {
+		t.Fatal("Expected a summary with the lowered threshold")
+	}
+	if covered := branchOf(defaultThread(mm)).coveredEnd(); covered != len(defaultThread(mm).Messages)-cfg.KeepRecent {
+		t.Errorf("Expected all but %d messages covered, got %d", cfg.KeepRecent, covered)
+	}
+}
+
+// blockingLLMClient 在 release 关闭前阻塞摘要和反思的模拟客户端
+type blockingLLMClient struct {
+	MockLLMClient
+	release        chan struct{}
+	mu             sync.Mutex
+	reflectCalls   int
+	summarizeCalls int
+}
+
+func (b *blockingLLMClient) Summarize(messages []types.Message, lang string) (string, error) {
+	<-b.release
+	b.mu.Lock()
+	b.summarizeCalls++
+	b.mu.Unlock()
+	return "background summary", nil
+}
+
+func (b *blockingLLMClient) GenerateReflection(messages []types.Message, summary, lang string) (*types.Reflection, error) {
+	<-b.release
+	b.mu.Lock()
+	b.reflectCalls++
+	b.mu.Unlock()
+	return &types.Reflection{Content: "background reflection", Importance: 8, Timestamp: time.Now()}, nil
+}
+
+func TestMemoryManager_BackgroundMaintenance(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := storage.NewYAMLStore(tmpDir)
+	client := &blockingLLMClient{release: make(chan struct{})}
+
+	cfg := DefaultConfig()
+	cfg.SummarizationThreshold = 20
+	cfg.SummaryBudget = 10
+	cfg.KeepRecent = 2
+	cfg.ReflectionInterval = 2
+	mm := NewManager("test_user", client, store, cfg)
+
+	// 模型调用被阻塞时添加消息和组装上下文也不会等待
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 6; i++ {
+			mm.AddMessage("user", strings.Repeat("word ", 5))
+			mm.GetContextMessages()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddMessage blocked on background work")
+	}
+
+	close(client.release)
+	mm.Close()
+
+	// 模型阻塞期间的重复触发被合并：6 条消息触发 3 次反思请求，实际生成次数更少
+	if client.reflectCalls == 0 || client.reflectCalls >= 3 {
+		t.Errorf("Expected coalesced reflections, got %d calls", client.reflectCalls)
+	}
+
+	// 后台任务完成后结果已经保存
+	mm2 := NewManager("test_user", &MockLLMClient{}, store, cfg)
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(defaultThread(mm2).Summaries) == 0 || len(mm2.memory.Reflections) != client.reflectCalls {
+		t.Errorf("Expected background results to be saved, got %d summaries, %d reflections",
+			len(defaultThread(mm2).Summaries), len(mm2.memory.Reflections))
+	}
+	if len(defaultThread(mm2).Messages) != 6 {
+		t.Errorf("Expected 6 messages saved, got %d", len(defaultThread(mm2).Messages))
+	}
+}
+
+func TestMemoryManager_ConcurrentTurns(t *testing.T) {
+	store := storage.NewYAMLStore(t.TempDir())
+	mm := NewManager("test_user", &MockLLMClient{summarizeResponse: "summary"}, store, DefaultConfig())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				endTurn := mm.BeginTurn()
+				mm.AddMessage("user", strings.Repeat("question ", 20))
+				mm.BuildContext("")
+				mm.Search("question", 3)
+				mm.AddMessage("assistant", strings.Repeat("answer ", 20))
+				if err := mm.Save(); err != nil {
+					t.Errorf("Save failed: %v", err)
+				}
+				endTurn()
+			}
+		}(i)
+	}
+	wg.Wait()
+	mm.Close()
+
+	mem := mm.GetMemory().Thread(types.DefaultThread)
+	if len(mem.Messages) != 80 {
+		t.Fatalf("Expected 80 messages, got %d", len(mem.Messages))
+	}
+	// 每轮的用户消息和回复相邻，不会与其他请求交错
+	for i := 0; i < len(mem.Messages); i += 2 {
+		if mem.Messages[i].Role != "user" || mem.Messages[i+1].Role != "assistant" {
+			t.Fatalf("Turns interleaved at message %d", i)
+		}
+	}
+
+	// GetMemory 返回副本
+	mem.Messages[0].Content = "changed"
+	if mm.GetMemory().Thread(types.DefaultThread).Messages[0].Content == "changed" {
+		t.Error("GetMemory should return a copy")
+	}
+}
+
+func TestMemoryManager_Threads(t *testing.T) {
+	store := storage.NewYAMLStore(t.TempDir())
+	mm := NewManager("test_user", &MockLLMClient{reflectionResponse: "用户喜欢简洁的回答", reflectionImportance: 8}, store, DefaultConfig())
+
+	mm.AddMessage("user", "let's plan the trip to Kyoto")
+	mm.Close()
+	mm.memory.Reflections = append(mm.memory.Reflections, types.Reflection{Content: "用户喜欢简洁的回答", Importance: 8, Timestamp: time.Now()})
+	defaultThread(mm).Summaries = []types.Summary{{Content: "trip planning", Start: 0, End: 1}}
+
+	if err := mm.SetThread("../etc"); err == nil {
+		t.Error("Expected invalid thread id to be rejected")
+	}
+	if err := mm.SetThread("work"); err != nil {
+		t.Fatalf("SetThread failed: %v", err)
+	}
+	mm.AddMessage("user", "review the quarterly report")
+
+	// 新会话只包含自己的消息，不包含其他会话的摘要，但共享反思
+	var contents []string
+	for _, msg := range mm.GetContextMessages() {
+		contents = append(contents, msg.Content)
+	}
+	joined := strings.Join(contents, "\n")
+	if strings.Contains(joined, "Kyoto") || strings.Contains(joined, "trip planning") {
+		t.Errorf("Context leaked another thread: %q", joined)
+	}
+	if !strings.Contains(joined, "quarterly report") || !strings.Contains(joined, "简洁") {
+		t.Errorf("Expected own message and shared reflection in context: %q", joined)
+	}
+
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	mm2 := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	threads := mm2.Threads()
+	if len(threads) != 2 || threads[0].ID != "work" || threads[0].Messages != 1 || threads[1].Summaries != 1 {
+		t.Fatalf("Unexpected threads after reload: %+v", threads)
+	}
+	if len(mm2.memory.Reflections) != 1 {
+		t.Errorf("Expected shared reflection to be persisted, got %d", len(mm2.memory.Reflections))
+	}
+}
+
+// contextText 拼接当前上下文中所有消息的内容
+func contextText(mm *Manager) string {
+	var parts []string
+	for _, msg := range mm.GetContextMessages() {
+		parts = append(parts, msg.Content)
+	}
+	return strings.Join(parts, "\n")
+}
+
+func TestMemoryManager_Branching(t *testing.T) {
+	store := storage.NewYAMLStore(t.TempDir())
+	mm := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	mm.Close() // 不在后台生成摘要和反思
+	mm.AddMessage("user", "I like cats")
+	mm.AddMessage("assistant", "Cats are great")
+	mm.AddMessage("user", "tell me about Kyoto")
+	mm.AddMessage("assistant", "Kyoto has temples")
+	original := mm.Branch()
+	oldHead := mm.Head()
+
+	// 只属于原分支的摘要和反思
+	defaultThread(mm).Summaries = []types.Summary{{
+		Content: "talked about Kyoto", Start: 0, End: 3, StartID: original[0].ID, EndID: original[2].ID,
+	}}
+	mm.memory.Reflections = []types.Reflection{{
+		Content: "用户计划去京都", Importance: 9, Timestamp: time.Now(), Thread: types.DefaultThread, MessageID: oldHead,
+	}}
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if err := mm.EditMessage(original[2].ID, "tell me about Osaka"); err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+	mm.AddMessage("assistant", "Osaka has street food")
+
+	text := contextText(mm)
+	if !strings.Contains(text, "Osaka has street food") || !strings.Contains(text, "I like cats") {
+		t.Errorf("Expected edited branch in context: %q", text)
+	}
+	if strings.Contains(text, "Kyoto") || strings.Contains(text, "京都") {
+		t.Errorf("Context leaked the original branch: %q", text)
+	}
+
+	if err := mm.Regenerate(); err != nil {
+		t.Fatalf("Regenerate failed: %v", err)
+	}
+	mm.AddMessage("assistant", "Osaka has a castle")
+	branch := mm.Branch()
+	if len(branch) != 4 || branch[2].Content != "tell me about Osaka" || branch[3].Content != "Osaka has a castle" {
+		t.Fatalf("Unexpected branch after regenerate: %+v", branch)
+	}
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// 重新加载后保留所有分支和当前分支
+	mm2 := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if mm2.Head() != mm.Head() || len(defaultThread(mm2).Messages) != 7 {
+		t.Fatalf("Expected head %s and 7 messages, got %s and %d", mm.Head(), mm2.Head(), len(defaultThread(mm2).Messages))
+	}
+	if err := mm2.Checkout(oldHead); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	if text := contextText(mm2); !strings.Contains(text, "talked about Kyoto") || !strings.Contains(text, "京都") {
+		t.Errorf("Expected original branch summary and reflection after checkout: %q", text)
+	}
+	if err := mm2.Checkout("missing"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound, got %v", err)
+	}
+}
+
+func TestMemoryManager_ArchivesCoveredMessages(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := storage.NewYAMLStore(tmpDir)
+	config := DefaultConfig()
+	config.ArchiveAfter = 4
+	embedder := &keywordEmbedder{keywords: []string{"deploy"}}
+
+	mm := NewManager("test_user", &MockLLMClient{}, store, config)
+	mm.Close() // 手动触发归档
+	mm.SetEmbedder(embedder)
+	for i := 0; i < 12; i++ {
+		content := fmt.Sprintf("message %d", i)
+		if i == 1 {
+			content = "we deploy on Fridays"
+		}
+		mm.AddMessage("user", content)
+	}
+	if err := mm.indexMessages(types.DefaultThread); err != nil {
+		t.Fatalf("indexMessages failed: %v", err)
+	}
+	branch := mm.Branch()
+	thread := defaultThread(mm)
+	thread.Summaries = []types.Summary{
+		{Content: "early talk", Start: 0, End: 4, StartID: branch[0].ID, EndID: branch[3].ID},
+		{Content: "later talk", Start: 4, End: 10, StartID: branch[4].ID, EndID: branch[9].ID},
+	}
+	thread.ContextSize = mm.contextSize(branchOf(thread))
+	before := contextText(mm)
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if err := mm.archive(types.DefaultThread); err != nil {
+		t.Fatalf("archive failed: %v", err)
+	}
+	if len(thread.Messages) != 6 || thread.Archived() != 6 || len(thread.Segments) != 1 {
+		t.Fatalf("Expected 6 messages archived, got %d hot and segments %+v", len(thread.Messages), thread.Segments)
+	}
+	if after := contextText(mm); after != before {
+		t.Errorf("Archiving covered messages should not change the context:\nbefore %q\nafter  %q", before, after)
+	}
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// 重放归档日志后按需读取归档段
+	mm2 := NewManager("test_user", &MockLLMClient{}, store, config)
+	defer mm2.Close()
+	mm2.SetEmbedder(embedder)
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if n := len(defaultThread(mm2).Messages); n != 6 {
+		t.Errorf("Expected 6 hot messages after reload, got %d", n)
+	}
+	if s := mm2.Summaries(); len(s) != 2 {
+		t.Errorf("Summaries of archived messages should stay on the branch, got %+v", s)
+	}
+	all, err := mm2.AllMessages(types.DefaultThread)
+	if err != nil || len(all) != 12 || all[1].Content != "we deploy on Fridays" || all[11].Content != "message 11" {
+		t.Fatalf("Expected all 12 messages in order, got %d, %v", len(all), err)
+	}
+
+	results := mm2.Search("Fridays", 3)
+	if len(results) != 1 || results[0].Index != 1 || results[0].Thread != types.DefaultThread {
+		t.Errorf("Expected archived message in search results, got %+v", results)
+	}
+	var exported bytes.Buffer
+	if err := mm2.Export(&exported, ExportJSON); err != nil || !strings.Contains(exported.String(), "Fridays") {
+		t.Errorf("Expected archived messages in the export, got %v", err)
+	}
+	mm2.AddMessage("user", "when do we deploy?")
+	if text := contextText(mm2); !strings.Contains(text, "we deploy on Fridays") {
+		t.Errorf("Expected archived message retrieved by vector: %q", text)
+	}
+
+	// 把日志写入快照后，快照不再包含归档的消息
+	store.CompactEvery = 1
+	if err := mm2.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	data, err := os.ReadFile(store.Path("test_user"))
+	if err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	if strings.Contains(string(data), "Fridays") || !strings.Contains(string(data), "segments:") {
+		t.Errorf("Archived message should not stay in the snapshot:\n%s", data)
+	}
+
+	// 删除归档的消息时归档段放回记忆，旧的归档段被删除
+	if _, err := mm2.Forget(ForgetQuery{Topic: "Fridays"}); err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	if all, _ := mm2.AllMessages(types.DefaultThread); len(all) != 12 || defaultThread(mm2).Archived() != 0 {
+		t.Errorf("Expected archive restored without the forgotten message, got %d messages", len(all))
+	}
+	if _, err := store.LoadBlob("test_user", segmentBlobName(types.DefaultThread, 0)); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Expected stale segment deleted, got %v", err)
+	}
+}
+
+func TestMemoryManager_ArchiveKeepsForkedBranches(t *testing.T) {
+	config := DefaultConfig()
+	config.ArchiveAfter = 2
+	mm := NewManager("test_user", &MockLLMClient{}, storage.NewYAMLStore(t.TempDir()), config)
+	mm.Close()
+	for i := 0; i < 10; i++ {
+		mm.AddMessage("user", fmt.Sprintf("message %d", i))
+	}
+	branch := mm.Branch()
+	head := mm.Head()
+	defaultThread(mm).Summaries = []types.Summary{{Content: "talk", Start: 0, End: 8, StartID: branch[0].ID, EndID: branch[7].ID}}
+
+	// 从第 2 条消息分出的分支要求第 1 条消息之后的消息都保留在记忆中
+	if err := mm.EditMessage(branch[1].ID, "edited"); err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+	if err := mm.Checkout(head); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	if err := mm.archive(types.DefaultThread); err != nil {
+		t.Fatalf("archive failed: %v", err)
+	}
+	if archived := defaultThread(mm).Archived(); archived != 0 {
+		t.Fatalf("Expected nothing archived while a fork needs it, got %d", archived)
+	}
+}
+
+func TestMemoryManager_ExportImport(t *testing.T) {
+	src := NewManager("alice", &MockLLMClient{}, storage.NewYAMLStore(t.TempDir()), DefaultConfig())
+	src.Close()
+	src.AddMessage("user", "My name is Alice")
+	src.AddMessage("assistant", "Nice to meet you")
+	first := src.Head()
+	src.AddMessage("user", "What's my name?")
+	src.AddMessage("assistant", "Alice")
+	src.EditMessage(src.Branch()[2].ID, "Where do I live?")
+	src.memory.Reflections = append(src.memory.Reflections, types.Reflection{Content: "User is Alice", Importance: 7, Timestamp: time.Now(), Thread: types.DefaultThread, MessageID: first})
+
+	var md, jsonl, exported bytes.Buffer
+	if err := src.Export(&md, ExportMarkdown); err != nil {
+		t.Fatalf("Export markdown failed: %v", err)
+	}
+	if text := md.String(); !strings.Contains(text, "## 会话 default") || !strings.Contains(text, "**用户**") ||
+		!strings.Contains(text, "Where do I live?") || strings.Contains(text, "What's my name?") {
+		t.Errorf("Unexpected markdown transcript:\n%s", text)
+	}
+	if err := src.Export(&jsonl, ExportJSONL); err != nil {
+		t.Fatalf("Export jsonl failed: %v", err)
+	}
+	var sample struct {
+		Messages []map[string]string `json:"messages"`
+	}
+	if err := json.Unmarshal(jsonl.Bytes(), &sample); err != nil || len(sample.Messages) != 2 || sample.Messages[1]["role"] != "assistant" {
+		t.Errorf("Expected one sample ending with the assistant reply, got %q (%v)", jsonl.String(), err)
+	}
+	if err := src.Export(&exported, ExportJSON); err != nil {
+		t.Fatalf("Export json failed: %v", err)
+	}
+
+	store := storage.NewYAMLStore(t.TempDir())
+	dst := NewManager("bob", &MockLLMClient{}, store, DefaultConfig())
+	dst.Close()
+	result, err := dst.Import(bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Threads != 1 || result.Messages != 5 || result.Reflections != 1 {
+		t.Errorf("Unexpected import result: %+v", result)
+	}
+	if dst.Head() != src.Head() || len(dst.Branch()) != 3 {
+		t.Errorf("Expected imported thread to keep the current branch")
+	}
+
+	// 重复导入不会产生重复的消息
+	result, err = dst.Import(bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Threads != 0 || result.Messages != 0 || result.Duplicates != 5 || result.Reflections != 0 {
+		t.Errorf("Expected everything skipped on re-import, got %+v", result)
+	}
+
+	// 两边各自继续对话后再合并：消息按时间排序，本地的当前分支保持不变
+	dst.AddMessage("assistant", "You live in Paris")
+	local := dst.Head()
+	src.AddMessage("assistant", "In Berlin")
+	exported.Reset()
+	src.Export(&exported, ExportJSON)
+	if result, err = dst.Import(&exported); err != nil || result.Messages != 1 || result.Duplicates != 5 {
+		t.Fatalf("Expected one new message, got %+v, %v", result, err)
+	}
+	if dst.Head() != local {
+		t.Errorf("Diverged import should not move the current branch")
+	}
+	if result.Branches[types.DefaultThread] != src.Head() {
+		t.Errorf("Expected the diverged branch reported for checkout, got %+v", result.Branches)
+	}
+
+	reloaded := NewManager("bob", &MockLLMClient{}, store, DefaultConfig())
+	defer reloaded.Close()
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	msgs := defaultThread(reloaded).Messages
+	if len(msgs) != 7 || msgs[6].Content != "In Berlin" || reloaded.Head() != local {
+		t.Fatalf("Expected merged messages persisted in timestamp order, got %+v", msgs)
+	}
+
+	if _, err := dst.Import(strings.NewReader("# not json")); !errors.Is(err, ErrInvalidImport) {
+		t.Errorf("Expected ErrInvalidImport, got %v", err)
+	}
+
+	// 手工编辑过的文件中子消息可能排在父消息之前
+	now := time.Now()
+	reordered, _ := json.Marshal(types.ConversationMemory{
+		SchemaVersion: storage.CurrentSchemaVersion,
+		Threads: []*types.Thread{{ID: "edited", Head: "c", Messages: []types.Message{
+			{ID: "c", ParentID: "p", Role: "assistant", Content: "answer", Timestamp: now.Add(time.Second)},
+			{ID: "p", Role: "user", Content: "question", Timestamp: now},
+		}}},
+	})
+	if _, err := dst.Import(bytes.NewReader(reordered)); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if branch := dst.GetMemory().Thread("edited").Branch(); len(branch) != 2 || branch[1].ParentID != "p" {
+		t.Errorf("Expected the child to keep its parent, got %+v", branch)
+	}
+}
+
+func TestMemoryManager_ImportLegacyIDCollision(t *testing.T) {
+	mm := NewManager("test_user", &MockLLMClient{}, storage.NewYAMLStore(t.TempDir()), DefaultConfig())
+	mm.Close()
+
+	// 旧版本按位置编号的消息ID在不同部署中指向不同的消息
+	legacy := func(question, answer string, at time.Time) []byte {
+		data, _ := json.Marshal(types.ConversationMemory{
+			SchemaVersion: storage.CurrentSchemaVersion,
+			Threads: []*types.Thread{{ID: "legacy", Head: "m1", Messages: []types.Message{
+				{ID: "m0", Role: "user", Content: question, Timestamp: at},
+				{ID: "m1", ParentID: "m0", Role: "assistant", Content: answer, Timestamp: at.Add(time.Second)},
+			}}},
+		})
+		return data
+	}
+	now := time.Now()
+	if _, err := mm.Import(bytes.NewReader(legacy("my cat is Tom", "nice cat", now))); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	result, err := mm.Import(bytes.NewReader(legacy("my dog is Rex", "nice dog", now.Add(time.Minute))))
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Messages != 2 || result.Duplicates != 0 {
+		t.Fatalf("Expected colliding ids imported as new messages, got %+v", result)
+	}
+
+	head := result.Branches["legacy"]
+	if head == "" || head == "m1" {
+		t.Fatalf("Expected the imported branch reported under a new id, got %+v", result.Branches)
+	}
+	mm.SetThread("legacy")
+	if b := mm.Branch(); len(b) != 2 || b[0].Content != "my cat is Tom" {
+		t.Errorf("Expected the local branch kept, got %+v", b)
+	}
+	if err := mm.Checkout(head); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	if b := mm.Branch(); len(b) != 2 || b[0].Content != "my dog is Rex" || b[0].ID == "m0" || b[1].ParentID != b[0].ID {
+		t.Errorf("Expected the imported branch with remapped ids, got %+v", b)
+	}
+}
+
+func TestMemoryManager_Forget(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := storage.NewYAMLStore(tmpDir)
+	mm := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	mm.Close()
+
+	mm.AddMessage("user", "hi")
+	mm.AddMessage("assistant", "hello")
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	// 之后的消息只写入日志
+	mm.AddMessage("user", "my password is hunter2")
+	mm.AddMessage("assistant", "noted")
+	mm.AddMessage("user", "what's the weather")
+	mm.AddMessage("assistant", "sunny")
+	branch := mm.Branch()
+	thread := defaultThread(mm)
+	thread.Summaries = []types.Summary{{Content: "greetings", Start: 0, End: 2, StartID: branch[0].ID, EndID: branch[1].ID}}
+	mm.addSummary(thread, types.Summary{Content: "user shared a password", Start: 2, End: 4, StartID: branch[2].ID, EndID: branch[3].ID})
+	now := time.Now()
+	mm.memory.Reflections = []types.Reflection{
+		{Content: "friendly user", Timestamp: now, Thread: types.DefaultThread, MessageID: branch[1].ID},
+		{Content: "user trusts the assistant", Timestamp: now, Thread: types.DefaultThread, MessageID: branch[3].ID},
+	}
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if _, err := mm.Forget(ForgetQuery{}); !errors.Is(err, ErrEmptyQuery) {
+		t.Errorf("Expected ErrEmptyQuery, got %v", err)
+	}
+	if _, err := mm.Forget(ForgetQuery{MessageIDs: []string{"missing"}}); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound, got %v", err)
+	}
+
+	record, err := mm.Forget(ForgetQuery{Topic: "HUNTER2", Reason: "user request"})
+	if err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	if len(record.Messages) != 1 || record.Messages[0].ID != branch[2].ID || record.Summaries != 1 || record.Reflections != 1 {
+		t.Errorf("Unexpected forget record: %+v", record)
+	}
+	after := mm.Branch()
+	if len(after) != 5 || after[2].Content != "noted" || after[2].ParentID != branch[1].ID {
+		t.Errorf("Expected the reply re-attached to the previous message, got %+v", after)
+	}
+	if s := mm.Summaries(); len(s) != 1 || s[0].Content != "greetings" {
+		t.Errorf("Expected only the unaffected summary kept, got %+v", s)
+	}
+	if r := mm.GetMemory().Reflections; len(r) != 1 || r[0].Content != "friendly user" {
+		t.Errorf("Expected only the unaffected reflection kept, got %+v", r)
+	}
+
+	// 快照、日志和审计记录中都不再有被删除的内容
+	filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			if data, _ := os.ReadFile(path); strings.Contains(strings.ToLower(string(data)), "hunter2") {
+				t.Errorf("Forgotten content left in %s", path)
+			}
+		}
+		return nil
+	})
+	log, err := mm.ForgetLog()
+	if err != nil || len(log) != 1 || !log[0].ByTopic || log[0].Reason != "user request" || len(log[0].Messages) != 1 {
+		t.Errorf("Unexpected forget log: %+v, %v", log, err)
+	}
+
+	// 按时间范围删除当前分支末尾的消息，当前分支退回到保留的消息
+	record, err = mm.Forget(ForgetQuery{From: after[3].Timestamp})
+	if err != nil || len(record.Messages) != 2 {
+		t.Fatalf("Expected 2 messages forgotten, got %+v, %v", record, err)
+	}
+	if mm.Head() != after[2].ID {
+		t.Errorf("Expected head moved back to the last kept message")
+	}
+
+	reloaded := NewManager("test_user", &MockLLMClient{}, store, DefaultConfig())
+	defer reloaded.Close()
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if b := reloaded.Branch(); len(b) != 3 || reloaded.Head() != after[2].ID {
+		t.Errorf("Expected forgotten messages gone after reload, got %+v", b)
+	}
+	if log, _ := reloaded.ForgetLog(); len(log) != 2 {
+		t.Errorf("Expected 2 forget records, got %d", len(log))
+	}
+}
+
+func TestMemoryManager_Facts(t *testing.T) {
+	store := storage.NewYAMLStore(t.TempDir())
+	client := &MockLLMClient{chatResponse: "ok"}
+	mm := NewManager("test_user", client, store, DefaultConfig())
+	defer mm.Close()
+
+	turn := func(user string, facts ...types.Fact) {
+		client.facts = facts
+		mm.AddMessage("user", user)
+		mm.AddMessage("assistant", "ok")
+		mm.Wait()
+	}
+	turn("I'm vegetarian", types.Fact{Subject: "用户", Attribute: "饮食", Value: "素食", Confidence: 0.8})
+	turn("hello")
+	facts := mm.Facts(FactFilter{})
+	if len(facts) != 1 || facts[0].Value != "素食" || facts[0].MessageID != mm.Branch()[0].ID {
+		t.Fatalf("Expected one fact from the first message, got %+v", facts)
+	}
+	if ctx := mm.GetContextMessages(); !strings.Contains(ctx[0].Content, "用户的饮食：素食") {
+		t.Errorf("Expected fact in context, got %+v", ctx)
+	}
+
+	// 再次提取到相同的值只更新已有事实，事件中是记忆里的那条事实
+	extracted := make(chan types.Fact, 1)
+	unsubscribe := mm.Subscribe(func(e Event) {
+		if e.Kind == EventFactExtracted {
+			extracted <- *e.Fact
+		}
+	})
+	turn("still vegetarian", types.Fact{Subject: "用户", Attribute: "饮食", Value: "素食", Confidence: 0.9})
+	unsubscribe()
+	select {
+	case got := <-extracted:
+		if got.ID != facts[0].ID || got.Confidence != 0.9 {
+			t.Errorf("Expected the event to carry the stored fact %s, got %+v", facts[0].ID, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a fact event")
+	}
+	if got := mm.Facts(FactFilter{History: true}); len(got) != 1 || got[0].ID != facts[0].ID {
+		t.Fatalf("Expected the repeated value merged into the existing fact, got %+v", got)
+	}
+
+	// 冲突的新值取代旧值，不产生重复的有效事实
+	turn("I eat fish now", types.Fact{Subject: "用户", Attribute: "饮食", Value: "吃鱼的素食者", Confidence: 2})
+	facts = mm.Facts(FactFilter{Subject: "用户", Attribute: "饮食"})
+	if len(facts) != 1 || facts[0].Value != "吃鱼的素食者" || facts[0].Confidence != 1 {
+		t.Fatalf("Expected the new fact to supersede the old one, got %+v", facts)
+	}
+	history := mm.Facts(FactFilter{History: true})
+	if len(history) != 2 || history[0].SupersededBy != facts[0].ID {
+		t.Fatalf("Expected superseded fact in history, got %+v", history)
+	}
+
+	// 日志重放得到相同的事实
+	mm2 := NewManager("test_user", client, store, DefaultConfig())
+	defer mm2.Close()
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := mm2.Facts(FactFilter{History: true}); len(got) != 2 || got[0].SupersededBy != got[1].ID {
+		t.Errorf("Unexpected facts after reload: %+v", got)
+	}
+
+	// 删除来源消息后新事实被删除，旧事实重新生效
+	record, err := mm.Forget(ForgetQuery{MessageIDs: []string{facts[0].MessageID}})
+	if err != nil || record.Facts != 1 {
+		t.Fatalf("Forget failed: %v %+v", err, record)
+	}
+	if got := mm.Facts(FactFilter{}); len(got) != 1 || got[0].Value != "素食" {
+		t.Errorf("Expected the old fact to be active again, got %+v", got)
+	}
+
+	// 导入时与已有事实相同的值合并为一条
+	var buf bytes.Buffer
+	if err := mm.Export(&buf, ExportJSON); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	other := NewManager("other_user", &MockLLMClient{}, storage.NewYAMLStore(t.TempDir()), DefaultConfig())
+	defer other.Close()
+	other.memory.Facts = []types.Fact{{ID: "x", Subject: "用户", Attribute: "饮食", Value: "素食", UpdatedAt: time.Now()}}
+	result, err := other.Import(&buf)
+	if err != nil || result.Facts != 0 || len(other.Facts(FactFilter{})) != 1 {
+		t.Errorf("Expected imported fact to merge with the existing one, got %v %+v %+v", err, result, other.Facts(FactFilter{History: true}))
+	}
+}
+
+func TestMemoryManager_Language(t *testing.T) {
+	store := storage.NewYAMLStore(t.TempDir())
+	client := &MockLLMClient{chatResponse: "ok", facts: []types.Fact{{Subject: "user", Attribute: "diet", Value: "vegetarian", Confidence: 1}}}
+	config := DefaultConfig()
+	config.Language = "en"
+	mm := NewManager("test_user", client, store, config)
+	defer mm.Close()
+
+	if lang := mm.Language(); lang != "en" {
+		t.Fatalf("Expected configured default language, got %q", lang)
+	}
+	mm.AddMessage("user", "I'm vegetarian")
+	mm.AddMessage("assistant", "ok")
+	mm.Wait()
+	if client.language != "en" {
+		t.Errorf("Expected fact extraction in en, got %q", client.language)
+	}
+	if ctx := mm.GetContextMessages(); !strings.Contains(ctx[0].Content, "What is known about the user:\nuser / diet: vegetarian") {
+		t.Errorf("Expected English context, got %+v", ctx)
+	}
+
+	// 用户设置的语言覆盖默认语言并随记忆保存
+	if err := mm.SetLanguage("zh-CN"); err != nil || mm.Language() != "zh" {
+		t.Fatalf("SetLanguage failed: %v, language %q", err, mm.Language())
+	}
+	if err := mm.SetLanguage("fr"); !errors.Is(err, prompts.ErrUnsupportedLanguage) || mm.Language() != "zh" {
+		t.Errorf("Expected unsupported language to be rejected, got %v", err)
+	}
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	mm2 := NewManager("test_user", client, store, config)
+	defer mm2.Close()
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if ctx := mm2.GetContextMessages(); mm2.Language() != "zh" || !strings.Contains(ctx[0].Content, "user的diet：vegetarian") {
+		t.Errorf("Expected saved language zh, got %q %+v", mm2.Language(), ctx)
+	}
+
+	if err := mm2.SetLanguage(""); err != nil || mm2.Language() != "en" {
+		t.Errorf("Expected empty language to restore the default, got %v %q", err, mm2.Language())
+	}
+}
+
+func TestMemoryManager_Events(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.MaxContextTokens = 100
+	cfg.SummarizationThreshold = 20
+	cfg.SummaryBudget = 10
+	cfg.KeepRecent = 2
+	cfg.ReflectionInterval = 4
+	client := &MockLLMClient{chatResponse: "ok", summarizeResponse: "summary", facts: []types.Fact{{Subject: "user", Attribute: "name", Value: "Ann"}}}
+	mm := NewManager("test_user", client, storage.NewYAMLStore(dir), cfg)
+	defer mm.Close()
+
+	var mu sync.Mutex
+	var events []Event
+	unsubscribe := mm.Subscribe(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	// 出错的订阅者不影响其他订阅者
+	mm.Subscribe(func(e Event) {
+		if e.Kind == EventForgotten {
+			panic("subscriber bug")
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		mm.AddMessage("user", "this message is long enough to need a summary soon")
+		mm.AddMessage("assistant", "ok")
+	}
+	mm.Wait()
+	if _, err := mm.Forget(ForgetQuery{Topic: "long enough"}); err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	mm.Wait()
+
+	counts := make(map[EventKind]int)
+	mu.Lock()
+	for _, e := range events {
+		counts[e.Kind]++
+		if e.UserID != "test_user" || e.Time.IsZero() {
+			t.Errorf("Event without user or time: %+v", e)
+		}
+	}
+	first := events[0]
+	mu.Unlock()
+	if first.Kind != EventMessageAdded || first.Thread != types.DefaultThread || first.Message.Content != "this message is long enough to need a summary soon" {
+		t.Errorf("Expected the first message event, got %+v", first)
+	}
+	if counts[EventMessageAdded] != 4 || counts[EventSummaryCreated] == 0 || counts[EventReflectionCreated] == 0 ||
+		counts[EventFactExtracted] == 0 || counts[EventSaved] == 0 || counts[EventForgotten] != 1 {
+		t.Errorf("Unexpected event counts: %v", counts)
+	}
+
+	// 取消订阅后不再收到事件
+	unsubscribe()
+	mu.Lock()
+	n := len(events)
+	mu.Unlock()
+	mm.AddMessage("user", "hi")
+	mm.Wait()
+	mu.Lock()
+	if len(events) != n {
+		t.Errorf("Expected no events after unsubscribe, got %+v", events[n:])
+	}
+	mu.Unlock()
+
+	// 加载失败
+	os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("threads: [oops"), 0o644)
+	broken := NewManager("broken", client, storage.NewYAMLStore(dir), cfg)
+	defer broken.Close()
+	failed := make(chan Event, 1)
+	broken.Subscribe(func(e Event) { failed <- e })
+	if err := broken.Load(); err == nil {
+		t.Fatal("Expected load error")
+	}
+	if e := <-failed; e.Kind != EventLoadFailed || e.Err == nil || e.UserID != "broken" {
+		t.Errorf("Expected load failure event, got %+v", e)
+	}
+}
+
+func TestDetectNote(t *testing.T) {
+	for content, want := range map[string]string{
+		"请记住我对花生过敏。":                             "我对花生过敏",
+		"记住：周五下午不开会":                             "周五下午不开会",
+		"别忘了我女儿叫小雨":                              "我女儿叫小雨",
+		"Please remember that I use Vim!":        "I use Vim",
+		"don't forget: my deadline is March 3rd": "my deadline is March 3rd",
+		"你记住我的生日了吗？":                             "",
+		"Do you remember that trip?":             "",
+		"I remember that movie":                  "",
+		"请记住":                                    "",
+	} {
+		if got, ok := detectNote(content); got != want || ok != (want != "") {
+			t.Errorf("detectNote(%q) = %q, %v; want %q", content, got, ok, want)
+		}
+	}
+}
+
+func TestMemoryManager_Notes(t *testing.T) {
+	store := storage.NewYAMLStore(t.TempDir())
+	cfg := DefaultConfig()
+	cfg.MaxContextTokens = 200
+	cfg.SummarizationThreshold = 40
+	cfg.SummaryBudget = 20
+	cfg.KeepRecent = 2
+	client := &MockLLMClient{chatResponse: "ok", summarizeResponse: "summary"}
+	mm := NewManager("test_user", client, store, cfg)
+	defer mm.Close()
+
+	manual, err := mm.PinNote("  回答尽量简短  ")
+	if err != nil || manual.Content != "回答尽量简短" || manual.MessageID != "" {
+		t.Fatalf("PinNote failed: %+v %v", manual, err)
+	}
+	if again, err := mm.PinNote("回答尽量简短"); err != nil || again.ID != manual.ID {
+		t.Errorf("Expected duplicate note to return the existing one, got %+v %v", again, err)
+	}
+	if _, err := mm.PinNote(" "); !errors.Is(err, ErrInvalidNote) {
+		t.Errorf("Expected ErrInvalidNote for empty note, got %v", err)
+	}
+	if _, err := mm.PinNote(strings.Repeat("长", MaxNoteLength+1)); !errors.Is(err, ErrInvalidNote) {
+		t.Errorf("Expected ErrInvalidNote for long note, got %v", err)
+	}
+
+	mm.AddMessage("user", "请记住我对花生过敏。")
+	mm.AddMessage("assistant", "好的")
+	notes := mm.Notes()
+	if len(notes) != 2 || notes[1].Content != "我对花生过敏" || notes[1].MessageID == "" {
+		t.Fatalf("Expected a note detected from the user message, got %+v", notes)
+	}
+
+	// 对话被摘要后笔记仍然紧跟在系统提示词之后
+	for i := 0; i < 10; i++ {
+		mm.AddMessage("user", fmt.Sprintf("question %d with some extra words", i))
+		mm.AddMessage("assistant", fmt.Sprintf("answer %d with some extra words", i))
+	}
+	mm.Wait()
+	if len(mm.Summaries()) == 0 {
+		t.Fatal("Expected the conversation to be summarized")
+	}
+	result := mm.BuildContext("system")
+	if len(result.Messages) < 2 || result.Messages[1].Content != "用户要求你记住的内容：\n回答尽量简短\n\n我对花生过敏\n\n" {
+		t.Errorf("Expected notes right after the system prompt, got %+v", result.Messages)
+	}
+
+	// 笔记的增删通过日志保存
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := mm.UnpinNote(manual.ID); err != nil {
+		t.Fatalf("UnpinNote failed: %v", err)
+	}
+	if err := mm.UnpinNote(manual.ID); !errors.Is(err, ErrNoteNotFound) {
+		t.Errorf("Expected ErrNoteNotFound, got %v", err)
+	}
+	if err := mm.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	mm2 := NewManager("test_user", client, store, cfg)
+	defer mm2.Close()
+	if err := mm2.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	notes = mm2.Notes()
+	if len(notes) != 1 || notes[0].Content != "我对花生过敏" {
+		t.Fatalf("Expected the detected note after reload, got %+v", notes)
+	}
+
+	// 删除来源消息时一并删除识别出的笔记
+	record, err := mm2.Forget(ForgetQuery{MessageIDs: []string{notes[0].MessageID}})
+	if err != nil || record.Notes != 1 || len(mm2.Notes()) != 0 {
+		t.Errorf("Expected the note to be forgotten with its message, got %+v %v", record, err)
+	}
+
+	cfg.DetectNotes = false
+	mm3 := NewManager("other_user", client, store, cfg)
+	defer mm3.Close()
+	mm3.AddMessage("user", "请记住我对花生过敏")
+	if notes := mm3.Notes(); len(notes) != 0 {
+		t.Errorf("Expected no detected notes when disabled, got %+v", notes)
+	}
+}
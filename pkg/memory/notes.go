@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// MaxNoteLength 置顶笔记的最大字符数，笔记每轮都会放入上下文，不宜过长
+const MaxNoteLength = 500
+
+var (
+	// ErrInvalidNote 表示笔记内容为空或过长
+	ErrInvalidNote = errors.New("invalid note")
+	// ErrNoteNotFound 表示没有该ID的笔记
+	ErrNoteNotFound = errors.New("note not found")
+)
+
+// notePatterns 用户明确要求记住某件事的说法，第一个分组为要记住的内容
+var notePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^(?:请|麻烦)?(?:你)?(?:帮我)?(?:一定要|务必)?记住[：:，,\s]*(.+)$`),
+	regexp.MustCompile(`^(?:请)?(?:你)?(?:不要|别|千万别)忘(?:了|记)[：:，,\s]*(.+)$`),
+	regexp.MustCompile(`(?i)^(?:please\s+)?(?:remember|don'?t\s+forget|do\s+not\s+forget)(?:\s+that\s+|\s*:\s*)(.+)$`),
+}
+
+// detectNote 识别用户消息中明确的记住请求（如 "请记住我对花生过敏"），返回要记住的内容。
+// 问句（如 "你记住我的生日了吗？"）不算
+func detectNote(content string) (string, bool) {
+	content = strings.TrimSpace(content)
+	if strings.HasSuffix(content, "?") || strings.HasSuffix(content, "？") || strings.HasSuffix(content, "吗") {
+		return "", false
+	}
+	for _, p := range notePatterns {
+		if m := p.FindStringSubmatch(content); m != nil {
+			note := strings.TrimRight(strings.TrimSpace(m[1]), "。.！!")
+			return note, note != ""
+		}
+	}
+	return "", false
+}
+
+// Notes 返回置顶笔记的副本，按添加顺序排列
+func (m *Manager) Notes() []types.Note {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]types.Note(nil), m.memory.Notes...)
+}
+
+// PinNote 添加置顶笔记。笔记每轮都放在上下文中系统提示词之后，不会被摘要、归档或检索排序挤掉，
+// 超出上下文预算时也会放入（见 ContextResult.Overflow）；
+// 已有相同内容（不区分大小写）的笔记时返回已有的笔记。内容为空或超过 MaxNoteLength 时返回 ErrInvalidNote
+func (m *Manager) PinNote(content string) (types.Note, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pinNote(content, "", "")
+}
+
+// pinNote 添加笔记，threadID 和 messageID 为识别出笔记的用户消息，手动添加时为空，需持有锁
+func (m *Manager) pinNote(content, threadID, messageID string) (types.Note, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return types.Note{}, fmt.Errorf("%w: empty content", ErrInvalidNote)
+	}
+	if n := utf8.RuneCountInString(content); n > MaxNoteLength {
+		return types.Note{}, fmt.Errorf("%w: %d characters exceeds %d", ErrInvalidNote, n, MaxNoteLength)
+	}
+	for _, n := range m.memory.Notes {
+		if strings.EqualFold(n.Content, content) {
+			return n, nil
+		}
+	}
+
+	note := types.Note{
+		ID:        types.NewNoteID(),
+		Content:   content,
+		Thread:    threadID,
+		MessageID: messageID,
+		CreatedAt: time.Now(),
+	}
+	m.memory.Notes = append(m.memory.Notes, note)
+	m.journal(nil, storage.Entry{Kind: storage.EntryNote, Note: &note})
+	pinned := note
+	m.emit(Event{Kind: EventNotePinned, Thread: threadID, Note: &pinned})
+	return note, nil
+}
+
+// UnpinNote 删除置顶笔记，没有该笔记时返回 ErrNoteNotFound
+func (m *Manager) UnpinNote(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, n := range m.memory.Notes {
+		if n.ID != id {
+			continue
+		}
+		m.memory.Notes = storage.RemoveNote(m.memory.Notes, id)
+		m.journal(nil, storage.Entry{Kind: storage.EntryUnpin, NoteID: id})
+		m.emit(Event{Kind: EventNoteUnpinned, Thread: n.Thread, Note: &n})
+		return nil
+	}
+	return fmt.Errorf("unpin %q: %w", id, ErrNoteNotFound)
+}
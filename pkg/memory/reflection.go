@@ -0,0 +1,112 @@
+package memory
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// ReflectionScoring 控制反思的检索排序（参考 Generative Agents）：
+// 得分 = 时近性权重 × 时近性 + 重要性权重 × 重要性 + 相关性权重 × 相关性，
+// 三项都归一化到 [0, 1]
+type ReflectionScoring struct {
+	RecencyWeight    float64 // 时近性权重
+	ImportanceWeight float64 // 重要性权重
+	RelevanceWeight  float64 // 相关性权重
+
+	// DecayPerHour 时近性按小时指数衰减的底数，例如 0.995 表示每过一小时乘以 0.995
+	DecayPerHour float64
+	// TopK 最多放入上下文的反思条数
+	TopK int
+	// TokenBudget 反思部分最多占用的token数，0 表示只受总预算限制
+	TokenBudget int
+}
+
+// DefaultReflectionScoring 三项等权，每小时衰减 0.5%，最多注入 3 条
+func DefaultReflectionScoring() ReflectionScoring {
+	return ReflectionScoring{
+		RecencyWeight:    1,
+		ImportanceWeight: 1,
+		RelevanceWeight:  1,
+		DecayPerHour:     0.995,
+		TopK:             3,
+		TokenBudget:      300,
+	}
+}
+
+// scoredReflection 带得分的反思
+type scoredReflection struct {
+	reflection types.Reflection
+	score      float64
+}
+
+// rankReflections 根据查询为 visible 接受的反思打分，返回预算内得分最高的反思（按得分降序）。
+// visible 为 nil 时使用全部反思
+func (m *Manager) rankReflections(query string, now time.Time, visible func(types.Reflection) bool) []types.Reflection {
+	reflections := m.memory.Reflections
+	sc := m.config.Reflection
+	if len(reflections) == 0 || sc.TopK <= 0 {
+		return nil
+	}
+	if visible == nil {
+		visible = func(types.Reflection) bool { return true }
+	}
+
+	relevance := make([]float64, len(reflections))
+	if query != "" && sc.RelevanceWeight != 0 {
+		li := m.loadLexical(false)
+		filter := func(id int) bool {
+			doc := li.docs[id]
+			return doc.Kind == SearchReflection && visible(reflections[doc.Index])
+		}
+		hits := li.index.Search(query, len(reflections), filter)
+		for _, hit := range hits {
+			// 结果按得分降序，用最高分归一化
+			relevance[li.docs[hit.ID].Index] = hit.Score / hits[0].Score
+		}
+	}
+
+	scored := make([]scoredReflection, 0, len(reflections))
+	for i, r := range reflections {
+		if !visible(r) {
+			continue
+		}
+		hours := now.Sub(r.Timestamp).Hours()
+		if hours < 0 {
+			hours = 0
+		}
+		recency := math.Pow(sc.DecayPerHour, hours)
+		importance := float64(r.Importance) / 10
+
+		scored = append(scored, scoredReflection{
+			reflection: r,
+			score: sc.RecencyWeight*recency +
+				sc.ImportanceWeight*importance +
+				sc.RelevanceWeight*relevance[i],
+		})
+	}
+	// 得分相同时较新的反思优先
+	sort.SliceStable(scored, func(i, j int) bool {
+		if scored[i].score != scored[j].score {
+			return scored[i].score > scored[j].score
+		}
+		return scored[i].reflection.Timestamp.After(scored[j].reflection.Timestamp)
+	})
+
+	var result []types.Reflection
+	used := 0
+	for _, s := range scored {
+		if len(result) == sc.TopK {
+			break
+		}
+		cost := m.tokens.Count(s.reflection.Content)
+		if sc.TokenBudget > 0 && used+cost > sc.TokenBudget {
+			continue
+		}
+		used += cost
+		result = append(result, s.reflection)
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package memory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/search"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// SearchKind 检索结果的来源
+type SearchKind string
+
+const (
+	SearchMessage    SearchKind = "message"
+	SearchSummary    SearchKind = "summary"
+	SearchReflection SearchKind = "reflection"
+)
+
+// SearchResult 一条关键词检索结果
+type SearchResult struct {
+	Kind      SearchKind `json:"kind"`
+	Thread    string     `json:"thread,omitempty"` // 消息和摘要所属的会话
+	Index     int        `json:"index"`            // 在对应列表（会话全部消息/摘要/反思）中的下标，消息的下标包括已归档的消息
+	Role      string     `json:"role,omitempty"`
+	Content   string     `json:"content"`
+	Timestamp time.Time  `json:"timestamp"`
+	Score     float64    `json:"score"`
+}
+
+// lexicalIndex 对消息、摘要和反思建立的 BM25 索引，文档ID即 docs 中的下标
+type lexicalIndex struct {
+	index    *search.Index
+	docs     []SearchResult
+	archived bool // 是否包含归档段中的消息
+}
+
+// add 索引一篇文档
+func (li *lexicalIndex) add(doc SearchResult) {
+	li.index.Add(len(li.docs), doc.Content)
+	li.docs = append(li.docs, doc)
+}
+
+// addMessage 索引会话中的一条消息，i 为消息在会话全部消息中的下标
+func (li *lexicalIndex) addMessage(thread string, i int, msg types.Message) {
+	li.add(SearchResult{Kind: SearchMessage, Thread: thread, Index: i, Role: msg.Role, Content: msg.Content, Timestamp: msg.Timestamp})
+}
+
+// loadLexical 按需构建关键词索引，withArchive 为 true 时读取归档段并索引其中的消息。
+// 摘要和反思变化时索引会被丢弃，下次使用时重建
+func (m *Manager) loadLexical(withArchive bool) *lexicalIndex {
+	if m.lexical != nil && (m.lexical.archived || !withArchive) {
+		return m.lexical
+	}
+
+	li := &lexicalIndex{index: search.NewIndex(), archived: withArchive}
+	for _, t := range m.memory.Threads {
+		for _, seg := range t.Segments {
+			if !withArchive {
+				break
+			}
+			msgs, err := m.loadSegment(seg)
+			if err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				continue
+			}
+			for i, msg := range msgs {
+				li.addMessage(t.ID, seg.First+i, msg)
+			}
+		}
+		for i, msg := range t.Messages {
+			li.addMessage(t.ID, t.Archived()+i, msg)
+		}
+		for i, s := range t.Summaries {
+			li.add(SearchResult{Kind: SearchSummary, Thread: t.ID, Index: i, Content: s.Content, Timestamp: s.CreatedAt})
+		}
+	}
+	for i, r := range m.memory.Reflections {
+		li.add(SearchResult{Kind: SearchReflection, Index: i, Content: r.Content, Timestamp: r.Timestamp})
+	}
+	m.lexical = li
+	return li
+}
+
+// Search 在所有会话的消息（包括归档的消息）、摘要以及反思中按 BM25 得分检索，返回最相关的 k 条。
+// 第一次检索时读取归档段
+func (m *Manager) Search(query string, k int) []SearchResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	li := m.loadLexical(true)
+
+	var results []SearchResult
+	for _, hit := range li.index.Search(query, k, nil) {
+		r := li.docs[hit.ID]
+		r.Score = hit.Score
+		results = append(results, r)
+	}
+	return results
+}
+
+// retrieve 返回分支上与最新一条用户消息最相关的、已被摘要覆盖的历史消息。
+// 启用 embedder 时按向量相似度检索（包括归档的消息，命中时读取归档段），
+// 否则按关键词检索（只包括已加载到索引中的消息）。
+// 尚未被摘要覆盖的消息由最近消息部分负责放入上下文
+func (m *Manager) retrieve(b *branch) []types.Message {
+	last := b.lastUserIndex()
+	covered := b.coveredEnd()
+	if last < 0 || covered == 0 {
+		return nil
+	}
+	// 只检索分支上已被摘要覆盖的消息，参数为消息在会话全部消息中的下标
+	archived := b.thread.Archived()
+	candidate := func(i int) bool {
+		if i < archived {
+			return b.offset > 0 // 归档的消息都已被摘要覆盖
+		}
+		pos, ok := b.position[i-archived]
+		return ok && pos < covered
+	}
+
+	if m.embedder != nil && m.vectors[b.thread.ID] != nil {
+		return m.retrieveByVector(b.thread, archived+b.indices[last], candidate)
+	}
+
+	li := m.loadLexical(false)
+	filter := func(id int) bool {
+		doc := li.docs[id]
+		return doc.Kind == SearchMessage && doc.Thread == b.thread.ID && candidate(doc.Index)
+	}
+	var msgs []types.Message
+	for _, hit := range li.index.Search(b.messages[last].Content, m.config.RetrievalTopK, filter) {
+		if msg, ok := m.messageAt(b.thread, li.docs[hit.ID].Index); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,120 @@
+package memory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// summaryTokens 返回摘要的token总数
+func (m *Manager) summaryTokens(summaries []types.Summary) int {
+	total := 0
+	for _, s := range summaries {
+		total += m.tokens.Count(s.Content)
+	}
+	return total
+}
+
+// addSummary 向会话加入摘要，重新计算当前分支的上下文大小并记录日志
+func (m *Manager) addSummary(t *types.Thread, summary types.Summary) {
+	storage.AddSummary(t, summary)
+	t.ContextSize = m.contextSize(branchOf(t))
+
+	m.journal(t, storage.Entry{Kind: storage.EntrySummary, Summary: &summary})
+	created := summary
+	m.emit(Event{Kind: EventSummaryCreated, Thread: t.ID, Summary: &created})
+	m.lexical = nil
+}
+
+// rollupSummaries 当前分支上的摘要总量超过配置的摘要预算时，把较早的摘要汇总为一条更高层的摘要。
+// 最新的摘要尽量保留原样，每次汇总都会减少摘要条数，因此循环必然结束。
+// 由后台任务在未持有锁时调用
+func (m *Manager) rollupSummaries(threadID string) error {
+	for {
+		m.mu.Lock()
+		var group []types.Summary
+		t := m.memory.Thread(threadID)
+		if t != nil {
+			if b := branchOf(t); m.summaryTokens(b.summaries) > m.config.SummaryBudget {
+				group = rollupGroup(b.summaries)
+			}
+		}
+		lang, set := m.language(), m.prompts
+		gen := m.generation
+		m.mu.Unlock()
+		if len(group) < 2 {
+			return nil
+		}
+
+		msgs := make([]types.Message, 0, len(group))
+		level := 0
+		for _, s := range group {
+			msgs = append(msgs, types.Message{
+				Role:    "user",
+				Content: set.Text(lang, prompts.SummarizeRollup, prompts.Rollup{Start: s.Start, End: s.End - 1, Content: s.Content}),
+			})
+			if s.Level > level {
+				level = s.Level
+			}
+		}
+
+		content, err := m.llmClient.Summarize(msgs, lang)
+		if err != nil {
+			return fmt.Errorf("generate summary: %w", err)
+		}
+
+		m.mu.Lock()
+		if m.generation != gen {
+			m.mu.Unlock()
+			return nil
+		}
+		m.addSummary(t, types.Summary{
+			Content:   content,
+			Start:     group[0].Start,
+			End:       group[len(group)-1].End,
+			StartID:   group[0].StartID,
+			EndID:     group[len(group)-1].EndID,
+			Level:     level + 1,
+			CreatedAt: time.Now(),
+		})
+		m.mu.Unlock()
+	}
+}
+
+// rollupGroup 选出下一批需要汇总的摘要：在除最新一条之外的摘要中，
+// 优先取最低层级中最早的一段连续摘要，不足两条时取全部。只有两条摘要时两条一起汇总
+func rollupGroup(summaries []types.Summary) []types.Summary {
+	if len(summaries) < 2 {
+		return nil
+	}
+	if len(summaries) == 2 {
+		return summaries
+	}
+	candidates := summaries[:len(summaries)-1]
+
+	minLevel := candidates[0].Level
+	for _, s := range candidates {
+		if s.Level < minLevel {
+			minLevel = s.Level
+		}
+	}
+
+	start := -1
+	for i, s := range candidates {
+		if s.Level == minLevel {
+			start = i
+			break
+		}
+	}
+	end := start
+	for end < len(candidates) && candidates[end].Level == minLevel {
+		end++
+	}
+	if end-start >= 2 {
+		return candidates[start:end]
+	}
+	return candidates
+}
@@ -0,0 +1,93 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// maxThreadIDLen 会话ID的最大长度（字符数）
+const maxThreadIDLen = 64
+
+// ThreadInfo 会话概况
+type ThreadInfo struct {
+	ID           string    `json:"id"`
+	Messages     int       `json:"messages"` // 全部消息数，包括已归档的消息
+	Archived     int       `json:"archived"`
+	Summaries    int       `json:"summaries"`
+	ContextSize  int       `json:"context_size"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// ValidThreadID 检查会话ID是否合法：1-64 个字母、数字、'-' 或 '_'。
+// 会话ID会出现在附加数据名中，因此不允许路径分隔符等字符
+func ValidThreadID(id string) bool {
+	if id == "" || utf8.RuneCountInString(id) > maxThreadIDLen {
+		return false
+	}
+	for _, r := range id {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// SetThread 切换当前会话，之后的消息和上下文都使用该会话。
+// 会话在添加第一条消息时创建
+func (m *Manager) SetThread(id string) error {
+	if !ValidThreadID(id) {
+		return fmt.Errorf("invalid thread id %q", id)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.thread = id
+	return nil
+}
+
+// Thread 返回当前会话ID
+func (m *Manager) Thread() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.thread
+}
+
+// Threads 返回所有会话的概况，最近活跃的在前
+func (m *Manager) Threads() []ThreadInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := make([]ThreadInfo, 0, len(m.memory.Threads))
+	for _, t := range m.memory.Threads {
+		info := ThreadInfo{
+			ID:           t.ID,
+			Messages:     t.Archived() + len(t.Messages),
+			Archived:     t.Archived(),
+			Summaries:    len(t.Summaries),
+			ContextSize:  t.ContextSize,
+			CreatedAt:    t.CreatedAt,
+			LastActivity: t.CreatedAt,
+		}
+		if n := len(t.Messages); n > 0 {
+			info.LastActivity = t.Messages[n-1].Timestamp
+		}
+		infos = append(infos, info)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].LastActivity.After(infos[j].LastActivity)
+	})
+	return infos
+}
+
+// current 返回当前会话，尚未创建时返回一个不加入记忆的空会话
+func (m *Manager) current() *types.Thread {
+	if t := m.memory.Thread(m.thread); t != nil {
+		return t
+	}
+	return &types.Thread{ID: m.thread}
+}
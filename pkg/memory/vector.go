@@ -0,0 +1,311 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+const (
+	// vectorBlob 向量索引在存储中的附加数据名
+	vectorBlob = "vectors.bin"
+	// vectorMagic 向量索引文件头
+	vectorMagic = "MCVEC1\n"
+	// embedBatchSize 单次向量化请求的最大条数
+	embedBatchSize = 64
+)
+
+// VectorIndex 按消息下标保存消息向量。
+// 持久化格式为文件头（魔数 + 模型名 + 换行）后接若干记录，
+// 每条记录为小端序的 uint32 下标、uint32 维度和对应数量的 float32，
+// 因此新增向量只需追加记录
+type VectorIndex struct {
+	model   string
+	vectors map[int][]float32
+}
+
+// newVectorIndex 创建空索引
+func newVectorIndex(model string) *VectorIndex {
+	return &VectorIndex{model: model, vectors: make(map[int][]float32)}
+}
+
+// decodeVectorIndex 解析持久化的索引，末尾不完整的记录会被忽略
+func decodeVectorIndex(data []byte) (*VectorIndex, error) {
+	if !bytes.HasPrefix(data, []byte(vectorMagic)) {
+		return nil, errors.New("invalid vector index header")
+	}
+	data = data[len(vectorMagic):]
+
+	nl := bytes.IndexByte(data, '\n')
+	if nl < 0 {
+		return nil, errors.New("invalid vector index header")
+	}
+	ix := newVectorIndex(string(data[:nl]))
+	data = data[nl+1:]
+
+	for len(data) >= 8 {
+		idx := int(binary.LittleEndian.Uint32(data[0:4]))
+		dim := int(binary.LittleEndian.Uint32(data[4:8]))
+		if len(data) < 8+dim*4 {
+			break
+		}
+		vec := make([]float32, dim)
+		for i := range vec {
+			vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[8+i*4:]))
+		}
+		ix.vectors[idx] = vec
+		data = data[8+dim*4:]
+	}
+	return ix, nil
+}
+
+// header 返回索引文件头
+func (ix *VectorIndex) header() []byte {
+	return []byte(vectorMagic + ix.model + "\n")
+}
+
+// encode 编码指定下标的向量记录
+func (ix *VectorIndex) encode(indices []int) []byte {
+	var buf bytes.Buffer
+	for _, idx := range indices {
+		vec := ix.vectors[idx]
+		binary.Write(&buf, binary.LittleEndian, uint32(idx))
+		binary.Write(&buf, binary.LittleEndian, uint32(len(vec)))
+		binary.Write(&buf, binary.LittleEndian, vec)
+	}
+	return buf.Bytes()
+}
+
+// all 返回所有已索引的下标（升序）
+func (ix *VectorIndex) all() []int {
+	indices := make([]int, 0, len(ix.vectors))
+	for idx := range ix.vectors {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// Search 返回满足 filter 的消息中与 query 最相似的 k 条（按相似度降序），filter 为 nil 时不过滤
+func (ix *VectorIndex) Search(query []float32, k int, filter func(int) bool) []int {
+	type hit struct {
+		idx   int
+		score float64
+	}
+	var hits []hit
+	for idx, vec := range ix.vectors {
+		if filter != nil && !filter(idx) {
+			continue
+		}
+		hits = append(hits, hit{idx, cosine(query, vec)})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].idx < hits[j].idx
+	})
+
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	result := make([]int, len(hits))
+	for i, h := range hits {
+		result[i] = h.idx
+	}
+	return result
+}
+
+// cosine 计算余弦相似度
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// vectorBlobName 返回会话向量索引的附加数据名，默认会话沿用原来的名称
+func vectorBlobName(threadID string) string {
+	if threadID == types.DefaultThread {
+		return vectorBlob
+	}
+	return "vectors-" + threadID + ".bin"
+}
+
+// resetVectors 丢弃所有已加载和尚未保存的向量，之后按需重新加载
+func (m *Manager) resetVectors() {
+	m.vectors = make(map[string]*VectorIndex)
+	m.unsavedVectors = make(map[string][]int)
+	m.vectorsRewrite = make(map[string]bool)
+}
+
+// loadVectors 按需加载会话的向量索引，模型变化时丢弃旧索引
+func (m *Manager) loadVectors(threadID string) *VectorIndex {
+	if ix := m.vectors[threadID]; ix != nil {
+		return ix
+	}
+
+	m.vectors[threadID] = newVectorIndex(m.embedder.Model())
+	m.vectorsRewrite[threadID] = true
+
+	blobs, ok := m.store.(storage.BlobStore)
+	if !ok {
+		return m.vectors[threadID]
+	}
+	data, err := blobs.LoadBlob(m.memory.UserID, vectorBlobName(threadID))
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			fmt.Printf("Warning: failed to load vector index: %v\n", err)
+		}
+		return m.vectors[threadID]
+	}
+	ix, err := decodeVectorIndex(data)
+	if err != nil || ix.model != m.embedder.Model() {
+		return m.vectors[threadID]
+	}
+	m.vectors[threadID] = ix
+	m.vectorsRewrite[threadID] = false
+	return ix
+}
+
+// indexMessages 为会话中尚未向量化的未归档消息生成向量，向量按消息在会话全部消息中的下标保存，
+// 归档后仍然有效。由后台任务在未持有锁时调用
+func (m *Manager) indexMessages(threadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.memory.Thread(threadID)
+	if t == nil || m.embedder == nil {
+		return nil
+	}
+	ix := m.loadVectors(threadID)
+	archived := t.Archived()
+	var missing []int
+	var texts []string
+	for i, msg := range t.Messages {
+		if _, ok := ix.vectors[archived+i]; !ok {
+			missing = append(missing, archived+i)
+			texts = append(texts, msg.Content)
+		}
+	}
+
+	gen := m.generation
+	for len(missing) > 0 {
+		n := min(len(missing), embedBatchSize)
+		if err := m.embed(threadID, gen, missing[:n], texts[:n]); err != nil {
+			return err
+		}
+		// 嵌入期间记忆被替换或索引被重建，剩下的消息不必再发送
+		if m.generation != gen || m.vectors[threadID] != ix {
+			return nil
+		}
+		missing, texts = missing[n:], texts[n:]
+	}
+	return nil
+}
+
+// embedQuery 为当前分支最后一条用户消息补齐检索用的向量，后台任务可能尚未处理这条消息。
+// 没有可检索的历史消息时不需要向量，需持有锁
+func (m *Manager) embedQuery() {
+	if m.embedder == nil {
+		return
+	}
+	t := m.current()
+	b := branchOf(t)
+	last := b.lastUserIndex()
+	if last < 0 || b.coveredEnd() == 0 {
+		return
+	}
+	idx := t.Archived() + b.indices[last]
+	if _, ok := m.loadVectors(t.ID).vectors[idx]; ok {
+		return
+	}
+	if err := m.embed(t.ID, m.generation, []int{idx}, []string{b.messages[last].Content}); err != nil {
+		// 检索失败不应该阻止对话继续，本轮不注入检索到的记忆
+		fmt.Printf("Warning: failed to embed query: %v\n", err)
+	}
+}
+
+// embed 为会话中指定下标的消息生成向量。调用时需持有锁，调用 embedder 期间释放锁；
+// 记忆在此期间被整体替换（gen 变化）或向量索引被重置时丢弃结果
+func (m *Manager) embed(threadID string, gen uint64, indices []int, texts []string) error {
+	ix := m.loadVectors(threadID)
+	embedder := m.embedder
+	m.mu.Unlock()
+	vecs, err := embedder.Embed(texts)
+	m.mu.Lock()
+	if err != nil {
+		return fmt.Errorf("embed messages: %w", err)
+	}
+	if len(vecs) != len(texts) {
+		return fmt.Errorf("embed messages: got %d vectors for %d texts", len(vecs), len(texts))
+	}
+	if m.generation != gen || m.vectors[threadID] != ix {
+		return nil
+	}
+	for i, idx := range indices {
+		if _, ok := ix.vectors[idx]; !ok {
+			ix.vectors[idx] = vecs[i]
+			m.unsavedVectors[threadID] = append(m.unsavedVectors[threadID], idx)
+		}
+	}
+	return nil
+}
+
+// saveVectors 持久化新增的向量：索引重建后整体写入，否则只追加新记录
+func (m *Manager) saveVectors() error {
+	blobs, ok := m.store.(storage.BlobStore)
+	if !ok {
+		return nil
+	}
+
+	for threadID, ix := range m.vectors {
+		name := vectorBlobName(threadID)
+		if m.vectorsRewrite[threadID] {
+			data := append(ix.header(), ix.encode(ix.all())...)
+			if err := blobs.SaveBlob(m.memory.UserID, name, data); err != nil {
+				return err
+			}
+		} else if len(m.unsavedVectors[threadID]) > 0 {
+			if err := blobs.AppendBlob(m.memory.UserID, name, ix.encode(m.unsavedVectors[threadID])); err != nil {
+				return err
+			}
+		}
+		delete(m.vectorsRewrite, threadID)
+		delete(m.unsavedVectors, threadID)
+	}
+	return nil
+}
+
+// retrieveByVector 按向量相似度检索会话中满足 filter 的消息，query 为查询消息的下标，
+// 下标都是消息在会话全部消息中的下标
+func (m *Manager) retrieveByVector(t *types.Thread, query int, filter func(int) bool) []types.Message {
+	ix := m.vectors[t.ID]
+	vec, ok := ix.vectors[query]
+	if !ok {
+		return nil
+	}
+
+	var msgs []types.Message
+	for _, idx := range ix.Search(vec, m.config.RetrievalTopK, filter) {
+		if msg, ok := m.messageAt(t, idx); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,138 @@
+package memory
+
+import "fmt"
+
+// schedule 请求后台为会话生成摘要或反思，需持有锁。
+// 后台任务尚未处理的重复请求会被合并为一次，反思只依据最近一次请求的会话生成
+func (m *Manager) schedule(threadID string, summarize, reflect bool) {
+	if m.closed || (!summarize && !reflect) {
+		return
+	}
+	if summarize {
+		m.needSummary[threadID] = true
+	}
+	if reflect {
+		m.needReflect = threadID
+	}
+	m.wakeWorker()
+}
+
+// scheduleFacts 请求后台从会话当前分支 fromID 开始的对话中提取事实，需持有锁。
+// 后台任务尚未处理的重复请求会被合并，从最早请求的消息开始提取
+func (m *Manager) scheduleFacts(threadID, fromID string) {
+	if m.closed || !m.config.ExtractFacts {
+		return
+	}
+	if _, ok := m.needFacts[threadID]; !ok {
+		m.needFacts[threadID] = fromID
+	}
+	m.wakeWorker()
+}
+
+// scheduleVectors 请求后台为会话中尚未向量化的消息生成向量，需持有锁
+func (m *Manager) scheduleVectors(threadID string) {
+	if m.closed {
+		return
+	}
+	m.needVectors[threadID] = true
+	m.wakeWorker()
+}
+
+// wakeWorker 唤醒后台任务，尚未启动时启动，需持有锁
+func (m *Manager) wakeWorker() {
+	if m.wake == nil {
+		m.wake = make(chan struct{}, 1)
+		m.workerDone = make(chan struct{})
+		go m.runMaintenance()
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default: // 已有待处理的唤醒
+	}
+}
+
+// runMaintenance 后台任务主循环，wake 关闭后处理完剩余请求再退出
+func (m *Manager) runMaintenance() {
+	defer close(m.workerDone)
+	for range m.wake {
+		m.maintain()
+	}
+}
+
+// maintain 执行一轮向量化、摘要、归档、反思和事实提取，并保存结果
+func (m *Manager) maintain() {
+	m.mu.Lock()
+	vectors, summarize, reflect, facts := m.needVectors, m.needSummary, m.needReflect, m.needFacts
+	m.needVectors, m.needSummary, m.needReflect, m.needFacts = make(map[string]bool), make(map[string]bool), "", make(map[string]string)
+	m.working = true
+	m.mu.Unlock()
+
+	for threadID := range vectors {
+		if err := m.indexMessages(threadID); err != nil {
+			// 向量化失败不应该阻止对话继续，下次添加消息时会补齐
+			fmt.Printf("Warning: failed to index messages of thread %s: %v\n", threadID, err)
+		}
+	}
+	for threadID := range summarize {
+		if err := m.summarize(threadID); err != nil {
+			fmt.Printf("Warning: failed to summarize thread %s: %v\n", threadID, err)
+		}
+		if err := m.archive(threadID); err != nil {
+			fmt.Printf("Warning: failed to archive thread %s: %v\n", threadID, err)
+		}
+	}
+	if reflect != "" {
+		if err := m.reflect(reflect); err != nil {
+			// 反思失败不应该阻止对话继续
+			fmt.Printf("Warning: failed to generate reflection: %v\n", err)
+		}
+	}
+	for threadID, fromID := range facts {
+		if err := m.extractFacts(threadID, fromID); err != nil {
+			fmt.Printf("Warning: failed to extract facts from thread %s: %v\n", threadID, err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.save(); err != nil {
+		fmt.Printf("Warning: failed to save memory for user %s: %v\n", m.memory.UserID, err)
+	}
+	m.working = false
+	m.idle.Broadcast()
+}
+
+// Wait 等待已请求的后台向量化、摘要、反思和事实提取全部完成，并等待已发生的事件分发给订阅者
+func (m *Manager) Wait() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.needVectors) > 0 || len(m.needSummary) > 0 || m.needReflect != "" || len(m.needFacts) > 0 || m.working || m.dispatching {
+		m.idle.Wait()
+	}
+}
+
+// Close 等待后台任务完成并停止后台任务，之后不再自动生成摘要和反思。
+// 返回前已发生的事件都已分发给订阅者
+func (m *Manager) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	wake, done := m.wake, m.workerDone
+	if wake != nil {
+		close(wake)
+	}
+	m.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+
+	m.mu.Lock()
+	for m.dispatching {
+		m.idle.Wait()
+	}
+	m.mu.Unlock()
+}
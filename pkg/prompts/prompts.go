@@ -0,0 +1,225 @@
+// Package prompts 管理发给模型的内部提示词。每个提示词是一个以名称区分的 text/template 模板，
+// 按语言分别提供；内置中文和英文模板，可以从配置目录覆盖或增加语言
+package prompts
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// DefaultLanguage 未指定语言或语言不受支持时使用的语言，某个语言缺少的模板也从这里取
+const DefaultLanguage = "zh"
+
+// 模板名，括号中为渲染时的数据
+const (
+	// SummarizeSystem 生成摘要的系统提示词
+	SummarizeSystem = "summarize.system"
+	// SummarizeRequest 放在待摘要对话之后的请求
+	SummarizeRequest = "summarize.request"
+	// SummarizeRollup 汇总时每条低层摘要的格式（Rollup）
+	SummarizeRollup = "summarize.rollup"
+	// ReflectionSystem 生成反思的系统提示词
+	ReflectionSystem = "reflection.system"
+	// ReflectionSummary 生成反思时附带的历史摘要（摘要文本）
+	ReflectionSummary = "reflection.summary"
+	// ReflectionRequest 放在对话之后的反思请求
+	ReflectionRequest = "reflection.request"
+	// FactsSystem 提取事实的系统提示词（已知的有效事实 []types.Fact）
+	FactsSystem = "facts.system"
+	// StructuredRepair 结构化输出无效时要求模型重新输出（错误说明）
+	StructuredRepair = "structured.repair"
+	// ContextSummary 上下文中的历史摘要（摘要文本）
+	ContextSummary = "context.summary"
+	// ContextNotes 上下文中置顶笔记部分的标题
+	ContextNotes = "context.notes"
+	// ContextFacts 上下文中用户事实部分的标题
+	ContextFacts = "context.facts"
+	// ContextFact 上下文中的一条事实（types.Fact）
+	ContextFact = "context.fact"
+	// ContextReflections 上下文中反思部分的标题
+	ContextReflections = "context.reflections"
+	// ContextPreferences 附在反思之后的用户偏好（[]string）
+	ContextPreferences = "context.preferences"
+	// ContextRetrieved 上下文中检索到的历史消息部分的标题
+	ContextRetrieved = "context.retrieved"
+)
+
+// names 全部模板名，加载时拒绝其他名称，避免文件名拼错的模板被静默忽略
+var names = map[string]bool{
+	SummarizeSystem: true, SummarizeRequest: true, SummarizeRollup: true,
+	ReflectionSystem: true, ReflectionSummary: true, ReflectionRequest: true,
+	FactsSystem: true, StructuredRepair: true,
+	ContextSummary: true, ContextNotes: true, ContextFacts: true, ContextFact: true,
+	ContextReflections: true, ContextPreferences: true, ContextRetrieved: true,
+}
+
+// Rollup SummarizeRollup 模板的数据，End 为覆盖的最后一条消息的下标
+type Rollup struct {
+	Start   int
+	End     int
+	Content string
+}
+
+// ErrUnsupportedLanguage 表示没有该语言的模板
+var ErrUnsupportedLanguage = errors.New("unsupported prompt language")
+
+//go:embed templates
+var builtin embed.FS
+
+// funcs 模板中可用的函数
+var funcs = template.FuncMap{"join": strings.Join}
+
+// Set 按语言组织的一组提示词模板，可以并发使用
+type Set struct {
+	langs map[string]*template.Template
+}
+
+var (
+	defaultOnce sync.Once
+	defaultSet  *Set
+)
+
+// Default 返回只包含内置模板的集合
+func Default() *Set {
+	defaultOnce.Do(func() {
+		defaultSet = &Set{langs: make(map[string]*template.Template)}
+		if err := defaultSet.add(builtin, "templates"); err != nil {
+			panic(fmt.Sprintf("parse builtin prompts: %v", err))
+		}
+	})
+	return defaultSet
+}
+
+// Load 在内置模板的基础上加载 dir 中的模板，dir 为空时只使用内置模板。
+// dir 下每个子目录对应一种语言（如 zh、en），其中的 <模板名>.tmpl 覆盖该语言的同名模板；
+// 新语言的子目录可以只提供部分模板，其余使用 DefaultLanguage 的模板
+func Load(dir string) (*Set, error) {
+	s := &Set{langs: make(map[string]*template.Template)}
+	if err := s.add(builtin, "templates"); err != nil {
+		return nil, fmt.Errorf("parse builtin prompts: %w", err)
+	}
+	if dir == "" {
+		return s, nil
+	}
+	if err := s.add(os.DirFS(dir), "."); err != nil {
+		return nil, fmt.Errorf("load prompts from %s: %w", dir, err)
+	}
+	return s, nil
+}
+
+// add 解析 root 下各语言子目录中的模板，同名模板替换已有的定义
+func (s *Set) add(fsys fs.FS, root string) error {
+	dirs, err := fs.ReadDir(fsys, root)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		lang := normalize(dir.Name())
+		files, err := fs.ReadDir(fsys, path.Join(root, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name, ok := strings.CutSuffix(file.Name(), ".tmpl")
+			if !ok || file.IsDir() {
+				continue
+			}
+			if !names[name] {
+				return fmt.Errorf("%s/%s: unknown prompt template %q", dir.Name(), file.Name(), name)
+			}
+			data, err := fs.ReadFile(fsys, path.Join(root, dir.Name(), file.Name()))
+			if err != nil {
+				return err
+			}
+			t := s.langs[lang]
+			if t == nil {
+				t = template.New(lang).Funcs(funcs)
+				s.langs[lang] = t
+			}
+			// 文件末尾的换行只是编辑习惯，不属于提示词
+			if _, err := t.New(name).Parse(strings.TrimSuffix(string(data), "\n")); err != nil {
+				return fmt.Errorf("%s/%s: %w", dir.Name(), file.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// normalize 统一语言标签的写法，如 "en_US" 和 "EN-us" 都写作 "en-us"
+func normalize(lang string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(lang)), "_", "-")
+}
+
+// Languages 返回有模板的语言，按字典序排列
+func (s *Set) Languages() []string {
+	langs := make([]string, 0, len(s.langs))
+	for lang := range s.langs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Resolve 返回语言标签对应的模板语言：先按完整标签查找，再按主语言（如 "en-US" 的 "en"）查找。
+// 空标签解析为 DefaultLanguage；没有对应模板时返回 DefaultLanguage 和 ErrUnsupportedLanguage
+func (s *Set) Resolve(lang string) (string, error) {
+	lang = normalize(lang)
+	if lang == "" {
+		return DefaultLanguage, nil
+	}
+	if _, ok := s.langs[lang]; ok {
+		return lang, nil
+	}
+	if base, _, ok := strings.Cut(lang, "-"); ok {
+		if _, ok := s.langs[base]; ok {
+			return base, nil
+		}
+	}
+	return DefaultLanguage, fmt.Errorf("%w: %q (available: %s)", ErrUnsupportedLanguage, lang, strings.Join(s.Languages(), ", "))
+}
+
+// Render 用指定语言的模板渲染提示词，不受支持的语言使用 DefaultLanguage
+func (s *Set) Render(lang, name string, data interface{}) (string, error) {
+	lang, _ = s.Resolve(lang)
+	t := s.langs[lang].Lookup(name)
+	if t == nil {
+		t = s.langs[DefaultLanguage].Lookup(name)
+	}
+	if t == nil {
+		return "", fmt.Errorf("unknown prompt template %q", name)
+	}
+
+	var out strings.Builder
+	if err := t.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("render prompt %s/%s: %w", lang, name, err)
+	}
+	return out.String(), nil
+}
+
+// Text 与 Render 相同，但自定义模板渲染失败时改用内置模板，保证总能得到提示词
+func (s *Set) Text(lang, name string, data interface{}) string {
+	if s == nil {
+		s = Default()
+	}
+	text, err := s.Render(lang, name, data)
+	if err == nil {
+		return text
+	}
+	fmt.Printf("Warning: %v, using builtin template\n", err)
+	text, err = Default().Render(lang, name, data)
+	if err != nil {
+		panic(fmt.Sprintf("render builtin prompt: %v", err))
+	}
+	return text
+}
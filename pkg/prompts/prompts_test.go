@@ -0,0 +1,121 @@
+package prompts
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sampleData 各模板渲染时使用的测试数据
+var sampleData = map[string]interface{}{
+	SummarizeRollup:    Rollup{Start: 0, End: 9, Content: "s"},
+	ReflectionSummary:  "s",
+	FactsSystem:        []struct{ Subject, Attribute, Value string }{{"user", "diet", "vegetarian"}},
+	StructuredRepair:   "bad",
+	ContextSummary:     "s",
+	ContextFact:        struct{ Subject, Attribute, Value string }{"user", "diet", "vegetarian"},
+	ContextPreferences: []string{"a", "b"},
+}
+
+func TestBuiltinTemplates(t *testing.T) {
+	s := Default()
+	if langs := s.Languages(); strings.Join(langs, ",") != "en,zh" {
+		t.Fatalf("Expected builtin en and zh, got %v", langs)
+	}
+	for _, lang := range s.Languages() {
+		for name := range names {
+			if s.langs[lang].Lookup(name) == nil {
+				t.Errorf("Builtin %s is missing template %s", lang, name)
+				continue
+			}
+			text, err := s.Render(lang, name, sampleData[name])
+			if err != nil || strings.TrimSpace(text) == "" || strings.Contains(text, "<no value>") {
+				t.Errorf("Render %s/%s: %q, %v", lang, name, text, err)
+			}
+		}
+	}
+
+	facts, _ := s.Render("zh", FactsSystem, sampleData[FactsSystem])
+	if !strings.HasSuffix(facts, "没有新的事实时输出 {\"facts\": []}。\n\n已知事实：\n- user / diet: vegetarian") {
+		t.Errorf("Unexpected known facts section: %q", facts)
+	}
+	if facts, _ := s.Render("zh", FactsSystem, nil); strings.Contains(facts, "已知事实：") {
+		t.Errorf("Expected no known facts section, got %q", facts)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	s := Default()
+	for tag, want := range map[string]string{"": "zh", "en": "en", "en_US": "en", "EN-gb": "en", "zh-CN": "zh"} {
+		if got, err := s.Resolve(tag); got != want || err != nil {
+			t.Errorf("Resolve(%q) = %q, %v; want %q", tag, got, err, want)
+		}
+	}
+	if got, err := s.Resolve("fr"); got != DefaultLanguage || !errors.Is(err, ErrUnsupportedLanguage) {
+		t.Errorf("Expected unsupported language, got %q, %v", got, err)
+	}
+	if text, _ := s.Render("fr", ContextFacts, nil); text != "已知的用户信息：" {
+		t.Errorf("Expected fallback to %s, got %q", DefaultLanguage, text)
+	}
+}
+
+func TestLoad_OverridesAndAddsLanguages(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("en/summarize.system.tmpl", "Summarize briefly.\n")
+	write("fr/context.facts.tmpl", "Ce que l'on sait de l'utilisateur :\n")
+	write("README.md", "ignored")
+
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if text, _ := s.Render("en", SummarizeSystem, nil); text != "Summarize briefly." {
+		t.Errorf("Expected overridden template without trailing newline, got %q", text)
+	}
+	if text, _ := s.Render("en", SummarizeRequest, nil); text != "Please provide a summary of the conversation above." {
+		t.Errorf("Expected builtin template to be kept, got %q", text)
+	}
+	if lang, err := s.Resolve("fr-FR"); lang != "fr" || err != nil {
+		t.Errorf("Expected fr to be supported, got %q, %v", lang, err)
+	}
+	if text, _ := s.Render("fr", ContextRetrieved, nil); text != "相关的历史对话：" {
+		t.Errorf("Expected missing template to fall back to %s, got %q", DefaultLanguage, text)
+	}
+	if text, _ := Default().Render("en", SummarizeSystem, nil); text == "Summarize briefly." {
+		t.Error("Load should not modify the default set")
+	}
+
+	write("en/summarize.sytem.tmpl", "typo")
+	if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), "unknown prompt template") {
+		t.Errorf("Expected unknown template error, got %v", err)
+	}
+}
+
+func TestText_FallsBackToBuiltin(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "en"), 0o755)
+	os.WriteFile(filepath.Join(dir, "en", "context.fact.tmpl"), []byte("{{.Missing.Field}}"), 0o644)
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	fact := struct{ Subject, Attribute, Value string }{"user", "diet", "vegetarian"}
+	if _, err := s.Render("en", ContextFact, fact); err == nil {
+		t.Fatal("Expected render error")
+	}
+	if text := s.Text("en", ContextFact, fact); text != "user / diet: vegetarian" {
+		t.Errorf("Expected builtin en template, got %q", text)
+	}
+}
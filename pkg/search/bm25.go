@@ -0,0 +1,127 @@
+package search
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// K1 词频饱和参数
+	K1 = 1.2
+	// B 文档长度归一化参数
+	B = 0.75
+)
+
+// Hit 一条检索结果
+type Hit struct {
+	ID    int
+	Score float64
+}
+
+// Index 基于 BM25 排序的内存倒排索引
+type Index struct {
+	postings map[string]map[int]int // 检索词 -> 文档ID -> 词频
+	lengths  map[int]int            // 文档ID -> 检索词数
+	totalLen int
+}
+
+// NewIndex 创建空索引
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string]map[int]int),
+		lengths:  make(map[int]int),
+	}
+}
+
+// Len 返回已索引的文档数
+func (ix *Index) Len() int {
+	return len(ix.lengths)
+}
+
+// Add 索引一篇文档，相同ID的旧文档会被替换
+func (ix *Index) Add(id int, text string) {
+	ix.Remove(id)
+
+	tokens := Tokenize(text)
+	for _, tok := range tokens {
+		docs, ok := ix.postings[tok]
+		if !ok {
+			docs = make(map[int]int)
+			ix.postings[tok] = docs
+		}
+		docs[id]++
+	}
+	ix.lengths[id] = len(tokens)
+	ix.totalLen += len(tokens)
+}
+
+// Remove 从索引中移除文档
+func (ix *Index) Remove(id int) {
+	n, ok := ix.lengths[id]
+	if !ok {
+		return
+	}
+	for tok, docs := range ix.postings {
+		if _, ok := docs[id]; ok {
+			delete(docs, id)
+			if len(docs) == 0 {
+				delete(ix.postings, tok)
+			}
+		}
+	}
+	delete(ix.lengths, id)
+	ix.totalLen -= n
+}
+
+// Search 返回与查询得分最高的 k 篇文档（按得分降序）。
+// filter 不为 nil 时只考虑其返回 true 的文档；不含任何查询词的文档不会返回
+func (ix *Index) Search(query string, k int, filter func(id int) bool) []Hit {
+	if len(ix.lengths) == 0 || k <= 0 {
+		return nil
+	}
+
+	n := float64(len(ix.lengths))
+	avgLen := float64(ix.totalLen) / n
+	if avgLen == 0 {
+		avgLen = 1
+	}
+
+	scores := make(map[int]float64)
+	seen := make(map[string]bool)
+	for _, tok := range Tokenize(query) {
+		if seen[tok] {
+			continue
+		}
+		seen[tok] = true
+
+		docs := ix.postings[tok]
+		if len(docs) == 0 {
+			continue
+		}
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, tf := range docs {
+			if filter != nil && !filter(id) {
+				continue
+			}
+			f := float64(tf)
+			norm := 1 - B + B*float64(ix.lengths[id])/avgLen
+			scores[id] += idf * f * (K1 + 1) / (f + K1*norm)
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, Hit{ID: id, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
@@ -0,0 +1,47 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize_MixedText(t *testing.T) {
+	got := Tokenize("我的Go项目, v2 上线!")
+	want := []string{"我", "我的", "的", "go", "项", "项目", "目", "v2", "上", "上线", "线"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize = %q, want %q", got, want)
+	}
+}
+
+func TestIndex_RanksChineseAndEnglish(t *testing.T) {
+	ix := NewIndex()
+	ix.Add(0, "今天天气很好，我们去公园散步吧")
+	ix.Add(1, "我上个月开始做一个记忆管理的项目，用 Go 写的")
+	ix.Add(2, "项目的部署脚本还没写完")
+	ix.Add(3, "The deploy script for the project is done")
+
+	hits := ix.Search("我的项目", 2, nil)
+	if len(hits) != 2 || hits[0].ID != 1 {
+		t.Fatalf("Expected doc 1 first for 我的项目, got %+v", hits)
+	}
+
+	hits = ix.Search("Deploy", 5, nil)
+	if len(hits) != 1 || hits[0].ID != 3 {
+		t.Errorf("Expected only doc 3 for Deploy, got %+v", hits)
+	}
+
+	hits = ix.Search("项目", 5, func(id int) bool { return id != 1 })
+	for _, h := range hits {
+		if h.ID == 1 {
+			t.Errorf("Filtered doc returned: %+v", hits)
+		}
+	}
+
+	ix.Remove(1)
+	if ix.Len() != 3 {
+		t.Errorf("Expected 3 docs after remove, got %d", ix.Len())
+	}
+	if hits := ix.Search("记忆管理", 5, nil); len(hits) != 0 {
+		t.Errorf("Removed doc still searchable: %+v", hits)
+	}
+}
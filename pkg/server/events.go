@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/Heng-Bian/memory-chat/pkg/memory"
+)
+
+// eventSubscriber 服务器级的记忆事件订阅者
+type eventSubscriber struct {
+	id int
+	fn func(memory.Event)
+}
+
+// Subscribe 订阅所有用户的记忆事件（见 memory.Manager.Subscribe），返回取消订阅的函数。
+// 同一用户的事件按发生顺序分发，不同用户的事件可能同时分发，订阅者需要自行处理并发
+func (s *Server) Subscribe(fn func(memory.Event)) (unsubscribe func()) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	s.nextSubscriber++
+	id := s.nextSubscriber
+	s.subscribers = append(s.subscribers, eventSubscriber{id: id, fn: fn})
+	return func() {
+		s.subMu.Lock()
+		defer s.subMu.Unlock()
+		for i, sub := range s.subscribers {
+			if sub.id == id {
+				s.subscribers = append(s.subscribers[:i:i], s.subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// publish 把用户的记忆事件转发给服务器级的订阅者
+func (s *Server) publish(e memory.Event) {
+	s.subMu.Lock()
+	subscribers := s.subscribers
+	s.subMu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.fn(e)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/memory"
+)
+
+const (
+	// DefaultMaxResidentUsers 默认常驻内存的用户数上限
+	DefaultMaxResidentUsers = 1000
+	// DefaultIdleTimeout 默认的空闲淘汰时间
+	DefaultIdleTimeout = 30 * time.Minute
+)
+
+// CacheStats 记忆管理器缓存的统计信息
+type CacheStats struct {
+	Resident  int    `json:"resident"`  // 常驻内存的用户数
+	Hits      uint64 `json:"hits"`      // 命中已加载管理器的次数
+	Misses    uint64 `json:"misses"`    // 需要从存储加载的次数
+	Evictions uint64 `json:"evictions"` // 被淘汰的次数
+}
+
+// managerEntry 注册表中的记忆管理器。ready 关闭后才能使用；
+// 被淘汰后 evicted 为 true，记忆写回存储后 gone 关闭
+type managerEntry struct {
+	userID   string
+	mm       *memory.Manager
+	ready    chan struct{}
+	refs     int
+	lastUsed time.Time
+	elem     *list.Element
+	evicted  bool
+	gone     chan struct{}
+}
+
+// SetCacheLimits 设置常驻内存的用户数上限和空闲淘汰时间，0 表示不限制。
+// 需在处理请求之前调用
+func (s *Server) SetCacheLimits(maxResident int, idleTimeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxResident = maxResident
+	s.idleTimeout = idleTimeout
+	if idleTimeout > 0 && s.stopJanitor == nil {
+		s.stopJanitor = make(chan struct{})
+		go s.runJanitor(idleTimeout, s.stopJanitor)
+	}
+}
+
+// CacheStats 返回缓存统计信息
+func (s *Server) CacheStats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Resident = s.lru.Len()
+	return stats
+}
+
+// acquire 获取或创建用户的记忆管理器，使用完毕后必须调用 release。
+// 使用中的管理器不会被淘汰。加载记忆时不持有注册表锁，
+// 其他用户的请求不受影响；同一用户的请求等待加载完成
+func (s *Server) acquire(userID string) (mm *memory.Manager, release func()) {
+	// 验证 userID 防止路径遍历攻击
+	if strings.Contains(userID, "..") || strings.Contains(userID, "/") || strings.Contains(userID, "\\") {
+		userID = "invalid_user"
+	}
+
+	s.mu.Lock()
+	for {
+		entry, exists := s.memoryManagers[userID]
+		if !exists {
+			break
+		}
+		if entry.evicted {
+			// 等待上一个管理器把记忆写回存储再重新加载
+			s.mu.Unlock()
+			<-entry.gone
+			s.mu.Lock()
+			continue
+		}
+
+		s.stats.Hits++
+		entry.refs++
+		s.lru.MoveToFront(entry.elem)
+		s.mu.Unlock()
+		<-entry.ready
+		return entry.mm, s.releaser(entry)
+	}
+
+	s.stats.Misses++
+	entry := &managerEntry{
+		userID: userID,
+		mm:     memory.NewManager(userID, s.llmClient, s.store, s.config),
+		ready:  make(chan struct{}),
+		refs:   1,
+		gone:   make(chan struct{}),
+	}
+	entry.elem = s.lru.PushFront(entry)
+	s.memoryManagers[userID] = entry
+	evicted := s.evictOverflowLocked()
+	s.mu.Unlock()
+
+	// 写回被淘汰的记忆可能要等待其后台任务，不阻塞当前请求
+	go s.flush(evicted)
+
+	entry.mm.SetTokenCounter(s.tokens)
+	if s.embedder != nil {
+		entry.mm.SetEmbedder(s.embedder)
+	}
+	if s.prompts != nil {
+		entry.mm.SetPrompts(s.prompts)
+	}
+	entry.mm.Subscribe(s.publish)
+	if err := entry.mm.Load(); err != nil {
+		// 记录加载错误但继续使用空记忆
+		fmt.Printf("Warning: failed to load memory for user %s: %v\n", userID, err)
+	}
+	close(entry.ready)
+	return entry.mm, s.releaser(entry)
+}
+
+// releaser 返回归还管理器的函数
+func (s *Server) releaser(entry *managerEntry) func() {
+	return func() {
+		s.mu.Lock()
+		entry.refs--
+		entry.lastUsed = time.Now()
+		evicted := s.evictOverflowLocked()
+		s.mu.Unlock()
+		go s.flush(evicted)
+	}
+}
+
+// evictOverflowLocked 用户数超过上限时从最久未使用的一端淘汰空闲的管理器，需持有锁
+func (s *Server) evictOverflowLocked() []*managerEntry {
+	if s.maxResident <= 0 {
+		return nil
+	}
+	var evicted []*managerEntry
+	for e := s.lru.Back(); e != nil && s.lru.Len() > s.maxResident; {
+		entry := e.Value.(*managerEntry)
+		e = e.Prev()
+		if entry.refs == 0 {
+			evicted = append(evicted, s.evictLocked(entry))
+		}
+	}
+	return evicted
+}
+
+// evictIdle 淘汰空闲超过 idleTimeout 的管理器
+func (s *Server) evictIdle(now time.Time) {
+	s.mu.Lock()
+	var evicted []*managerEntry
+	for e := s.lru.Back(); e != nil; {
+		entry := e.Value.(*managerEntry)
+		e = e.Prev()
+		if entry.refs == 0 && now.Sub(entry.lastUsed) >= s.idleTimeout {
+			evicted = append(evicted, s.evictLocked(entry))
+		}
+	}
+	s.mu.Unlock()
+	s.flush(evicted)
+}
+
+// evictLocked 将管理器标记为已淘汰，需持有锁
+func (s *Server) evictLocked(entry *managerEntry) *managerEntry {
+	entry.evicted = true
+	s.lru.Remove(entry.elem)
+	s.stats.Evictions++
+	return entry
+}
+
+// flush 等待被淘汰的管理器完成后台任务并写回存储，然后从注册表移除
+func (s *Server) flush(entries []*managerEntry) {
+	for _, entry := range entries {
+		<-entry.ready
+		entry.mm.Close()
+		if err := entry.mm.Save(); err != nil {
+			fmt.Printf("Warning: failed to save memory for user %s: %v\n", entry.userID, err)
+		}
+		entry.mm.Wait() // 写回的事件分发完成
+
+		s.mu.Lock()
+		if s.memoryManagers[entry.userID] == entry {
+			delete(s.memoryManagers, entry.userID)
+		}
+		s.mu.Unlock()
+		close(entry.gone)
+	}
+}
+
+// runJanitor 定期淘汰空闲的管理器
+func (s *Server) runJanitor(idleTimeout time.Duration, stop chan struct{}) {
+	interval := idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.evictIdle(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close 停止空闲淘汰，等待所有用户的后台摘要和反思完成并写回存储
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.stopJanitor != nil {
+		close(s.stopJanitor)
+		s.stopJanitor = nil
+	}
+	var evicted []*managerEntry
+	for e := s.lru.Back(); e != nil; {
+		entry := e.Value.(*managerEntry)
+		e = e.Prev()
+		evicted = append(evicted, s.evictLocked(entry))
+	}
+	s.mu.Unlock()
+	s.flush(evicted)
+}
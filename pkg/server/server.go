@@ -1,62 +1,83 @@
 package server
 
 import (
+	"bytes"
+	"container/list"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Heng-Bian/memory-chat/pkg/llm"
 	"github.com/Heng-Bian/memory-chat/pkg/memory"
+	"github.com/Heng-Bian/memory-chat/pkg/prompts"
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/tokenizer"
 	"github.com/Heng-Bian/memory-chat/pkg/types"
 )
 
 // Server OpenAI兼容的HTTP服务器
 type Server struct {
-	llmClient      llm.Client
-	memoryManagers map[string]*memory.Manager
-	memoryDir      string
+	llmClient llm.Client
+	store     storage.Store
+	tokens    tokenizer.Counter
+	embedder  llm.Embedder
+	prompts   *prompts.Set
+	config    memory.Config
+
+	// mu 保护记忆管理器注册表，见 registry.go
+	mu             sync.Mutex
+	memoryManagers map[string]*managerEntry
+	lru            *list.List // 常驻的管理器，最近使用的在前
+	maxResident    int
+	idleTimeout    time.Duration
+	stopJanitor    chan struct{}
+	stats          CacheStats
+
+	// subMu 保护记忆事件的订阅者，见 events.go
+	subMu          sync.Mutex
+	subscribers    []eventSubscriber
+	nextSubscriber int
 }
 
-// NewServer 创建新的服务器
-func NewServer(llmClient llm.Client, memoryDir string) *Server {
+// NewServer 创建新的服务器，config 应已通过 Validate 检查
+func NewServer(llmClient llm.Client, store storage.Store, tokens tokenizer.Counter, config memory.Config) *Server {
 	return &Server{
 		llmClient:      llmClient,
-		memoryManagers: make(map[string]*memory.Manager),
-		memoryDir:      memoryDir,
+		memoryManagers: make(map[string]*managerEntry),
+		lru:            list.New(),
+		maxResident:    DefaultMaxResidentUsers,
+		store:          store,
+		tokens:         tokens,
+		config:         config,
 	}
 }
 
-// getMemoryManager 获取或创建用户的记忆管理器
-func (s *Server) getMemoryManager(userID string) *memory.Manager {
-	// 验证 userID 防止路径遍历攻击
-	if strings.Contains(userID, "..") || strings.Contains(userID, "/") || strings.Contains(userID, "\\") {
-		userID = "invalid_user"
-	}
-	
-	if mm, exists := s.memoryManagers[userID]; exists {
-		return mm
-	}
-
-	storePath := fmt.Sprintf("%s/%s.yaml", s.memoryDir, userID)
-	mm := memory.NewManager(userID, s.llmClient, storePath)
-	if err := mm.Load(); err != nil {
-		// 记录加载错误但继续使用空记忆
-		fmt.Printf("Warning: failed to load memory for user %s: %v\n", userID, err)
-	}
+// SetEmbedder 为所有用户启用基于向量的历史消息检索
+func (s *Server) SetEmbedder(embedder llm.Embedder) {
+	s.embedder = embedder
+}
 
-	s.memoryManagers[userID] = mm
-	return mm
+// SetPrompts 设置所有用户的提示词模板，默认使用内置模板
+func (s *Server) SetPrompts(set *prompts.Set) {
+	s.prompts = set
 }
 
 // ChatCompletionRequest OpenAI聊天请求格式
 type ChatCompletionRequest struct {
-	Model    string          `json:"model"`
-	Messages []types.Message `json:"messages"`
-	Stream   bool            `json:"stream,omitempty"`
-	UserID   string          `json:"user,omitempty"` // 用于记忆管理
+	Model      string          `json:"model"`
+	Messages   []types.Message `json:"messages"`
+	Stream     bool            `json:"stream,omitempty"`
+	UserID     string          `json:"user,omitempty"`       // 用于记忆管理
+	Thread     string          `json:"thread,omitempty"`     // 会话ID，默认为 default
+	EditID     string          `json:"edit_id,omitempty"`    // 要编辑的历史消息ID，以最后一条用户消息的内容创建新的分支
+	Regenerate bool            `json:"regenerate,omitempty"` // 重新生成当前分支的最后一条回复，原回复保留在另一个分支上
+	Language   string          `json:"language,omitempty"`   // 内部提示词的语言，同时保存为该用户的语言
 }
 
 // ChatCompletionResponse OpenAI聊天响应格式
@@ -91,6 +112,7 @@ type ChatCompletionStreamResponse struct {
 		} `json:"delta"`
 		FinishReason string `json:"finish_reason,omitempty"`
 	} `json:"choices"`
+	MessageID string `json:"message_id,omitempty"` // 回复写入记忆后的消息ID，只在最后一个数据块中出现
 }
 
 // HandleChatCompletions 处理聊天完成请求
@@ -105,24 +127,68 @@ func (s *Server) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if req.Thread == "" {
+		req.Thread = types.DefaultThread
+	}
+	if !memory.ValidThreadID(req.Thread) {
+		http.Error(w, "Invalid thread: use 1-64 letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
 
 	// 如果请求包含用户ID，使用记忆管理器
 	var contextMessages []types.Message
 	var mm *memory.Manager
 
 	if req.UserID != "" {
-		mm = s.getMemoryManager(req.UserID)
+		var release func()
+		mm, release = s.acquire(req.UserID)
+		defer release()
+
+		// 同一用户的请求依次处理，直到回复写入记忆
+		endTurn := mm.BeginTurn()
+		defer endTurn()
+		mm.SetThread(req.Thread)
+		if req.Language != "" {
+			if err := mm.SetLanguage(req.Language); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
-		// 添加用户消息到记忆
-		if len(req.Messages) > 0 {
-			lastMsg := req.Messages[len(req.Messages)-1]
-			if lastMsg.Role == "user" {
-				mm.AddMessage(lastMsg.Role, lastMsg.Content)
+		// 添加用户消息到记忆，编辑历史消息或重新生成回复时切换到新的分支
+		var lastMsg *types.Message
+		if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == "user" {
+			lastMsg = &req.Messages[n-1]
+		}
+		var err error
+		switch {
+		case req.Regenerate:
+			err = mm.Regenerate()
+		case req.EditID != "":
+			if lastMsg == nil {
+				http.Error(w, "edit_id requires a trailing user message", http.StatusBadRequest)
+				return
 			}
+			err = mm.EditMessage(req.EditID, lastMsg.Content)
+		case lastMsg != nil:
+			err = mm.AddMessage(lastMsg.Role, lastMsg.Content)
+		}
+		if errors.Is(err, memory.ErrMessageNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		// 获取包含历史记忆的上下文
-		contextMessages = mm.GetContextMessages()
+		// 在token预算内组装包含历史记忆的上下文
+		result := mm.BuildContext(systemPrompt(req.Messages))
+		if len(result.Dropped) > 0 || result.Overflow > 0 {
+			fmt.Printf("Info: context for user %s over budget (%d/%d tokens), dropped %d items\n",
+				req.UserID, result.Tokens, result.Budget, len(result.Dropped))
+		}
+		contextMessages = result.Messages
 	} else {
 		contextMessages = req.Messages
 	}
@@ -137,17 +203,30 @@ func (s *Server) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	s.handleNormalResponse(w, req, contextMessages, mm)
 }
 
+// systemPrompt 合并请求中客户端提供的系统消息
+func systemPrompt(messages []types.Message) string {
+	var parts []string
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			parts = append(parts, msg.Content)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
 // handleNormalResponse 处理非流式响应
 func (s *Server) handleNormalResponse(w http.ResponseWriter, req ChatCompletionRequest, contextMessages []types.Message, mm *memory.Manager) {
-	response, tokens, err := s.llmClient.Chat(contextMessages)
+	response, _, err := s.llmClient.Chat(contextMessages)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("LLM error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// 如果使用记忆管理器，保存助手响应
+	// 如果使用记忆管理器，保存助手响应，并在响应中返回消息ID
 	if mm != nil {
+		parent := mm.Head()
 		mm.AddMessage("assistant", response.Content)
+		response.ID, response.ParentID = mm.Head(), parent
 		if err := mm.Save(); err != nil {
 			fmt.Printf("Warning: failed to save memory: %v\n", err)
 		}
@@ -169,9 +248,9 @@ func (s *Server) handleNormalResponse(w http.ResponseWriter, req ChatCompletionR
 	resp.Choices[0].Index = 0
 	resp.Choices[0].Message = *response
 	resp.Choices[0].FinishReason = "stop"
-	resp.Usage.TotalTokens = tokens
-	resp.Usage.PromptTokens = tokens / 2
-	resp.Usage.CompletionTokens = tokens / 2
+	resp.Usage.PromptTokens = s.countMessages(contextMessages)
+	resp.Usage.CompletionTokens = s.tokens.Count(response.Content)
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
@@ -246,8 +325,10 @@ func (s *Server) handleStreamResponse(w http.ResponseWriter, r *http.Request, re
 	}
 
 	// 如果使用记忆管理器，保存助手响应
+	var messageID string
 	if mm != nil {
 		mm.AddMessage("assistant", fullContent.String())
+		messageID = mm.Head()
 		if err := mm.Save(); err != nil {
 			fmt.Printf("Warning: failed to save memory: %v\n", err)
 		}
@@ -269,6 +350,7 @@ func (s *Server) handleStreamResponse(w http.ResponseWriter, r *http.Request, re
 		}, 1),
 	}
 	finalResp.Choices[0].FinishReason = "stop"
+	finalResp.MessageID = messageID
 	sendSSE(w, flusher, finalResp)
 
 	// 发送[DONE]
@@ -278,6 +360,15 @@ func (s *Server) handleStreamResponse(w http.ResponseWriter, r *http.Request, re
 	_ = tokens // 在生产环境中可以记录token使用情况
 }
 
+// countMessages 计算消息列表的token数
+func (s *Server) countMessages(messages []types.Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += s.tokens.Count(msg.Content) + tokenizer.MessageOverhead
+	}
+	return total
+}
+
 // sendSSE 发送SSE事件
 func sendSSE(w io.Writer, flusher http.Flusher, data interface{}) error {
 	jsonData, err := json.Marshal(data)
@@ -290,23 +381,361 @@ func sendSSE(w io.Writer, flusher http.Flusher, data interface{}) error {
 	return nil
 }
 
+// HandleMemorySearch 按关键词检索用户记忆：GET /v1/memory/search?user=alice&q=项目&k=5
+func (s *Server) HandleMemorySearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	query := r.URL.Query().Get("q")
+	if userID == "" || query == "" {
+		http.Error(w, "Missing user or q parameter", http.StatusBadRequest)
+		return
+	}
+	k := 5
+	if v := r.URL.Query().Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid k parameter", http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+
+	mm, release := s.acquire(userID)
+	defer release()
+	results := mm.Search(query, k)
+	if results == nil {
+		results = []memory.SearchResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   results,
+	})
+}
+
+// HandleMemoryThreads 列出用户的所有会话：GET /v1/memory/threads?user=alice
+func (s *Server) HandleMemoryThreads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		http.Error(w, "Missing user parameter", http.StatusBadRequest)
+		return
+	}
+
+	mm, release := s.acquire(userID)
+	defer release()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   mm.Threads(),
+	})
+}
+
+// HandleMemoryFacts 查询用户的结构化事实：GET /v1/memory/facts?user=alice&subject=用户&attribute=饮食，
+// history=true 时包含已被取代的事实
+func (s *Server) HandleMemoryFacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	userID := q.Get("user")
+	if userID == "" {
+		http.Error(w, "Missing user parameter", http.StatusBadRequest)
+		return
+	}
+	filter := memory.FactFilter{Subject: q.Get("subject"), Attribute: q.Get("attribute")}
+	if v := q.Get("history"); v != "" {
+		history, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid history parameter", http.StatusBadRequest)
+			return
+		}
+		filter.History = history
+	}
+
+	mm, release := s.acquire(userID)
+	defer release()
+	facts := mm.Facts(filter)
+	if facts == nil {
+		facts = []types.Fact{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   facts,
+	})
+}
+
+// NoteRequest 添加置顶笔记的请求体
+type NoteRequest struct {
+	Content string `json:"content"`
+}
+
+// HandleMemoryNotes 管理用户的置顶笔记：GET /v1/memory/notes?user=alice 列出笔记，
+// POST 添加笔记（请求体为 NoteRequest），DELETE /v1/memory/notes?user=alice&id=<笔记ID> 删除笔记
+func (s *Server) HandleMemoryNotes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	userID := q.Get("user")
+	if userID == "" {
+		http.Error(w, "Missing user parameter", http.StatusBadRequest)
+		return
+	}
+
+	mm, release := s.acquire(userID)
+	defer release()
+	switch r.Method {
+	case http.MethodGet:
+		notes := mm.Notes()
+		if notes == nil {
+			notes = []types.Note{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   notes,
+		})
+		return
+	case http.MethodDelete:
+		id := q.Get("id")
+		if id == "" {
+			http.Error(w, "Missing id parameter", http.StatusBadRequest)
+			return
+		}
+		err := mm.UnpinNote(id)
+		if errors.Is(err, memory.ErrNoteNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = mm.Save()
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unpin failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req NoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	note, err := mm.PinNote(req.Content)
+	if errors.Is(err, memory.ErrInvalidNote) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = mm.Save()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Pin failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(note)
+}
+
+// maxImportBytes 导入请求体的大小上限
+const maxImportBytes = 64 << 20
+
+// HandleMemoryExport 导出用户记忆：GET /v1/memory/export?user=alice&format=markdown
+func (s *Server) HandleMemoryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		http.Error(w, "Missing user parameter", http.StatusBadRequest)
+		return
+	}
+	format := memory.ExportJSON
+	if v := r.URL.Query().Get("format"); v != "" {
+		f, err := memory.ParseExportFormat(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format = f
+	}
+
+	mm, release := s.acquire(userID)
+	defer release()
+	var buf bytes.Buffer
+	if err := mm.Export(&buf, format); err != nil {
+		http.Error(w, fmt.Sprintf("Export failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", userID+format.Extension()))
+	w.Write(buf.Bytes())
+}
+
+// HandleMemoryImport 把 JSON 格式导出的记忆合并到用户记忆：POST /v1/memory/import?user=alice，
+// checkout=true 时切换到导入的分支
+func (s *Server) HandleMemoryImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		http.Error(w, "Missing user parameter", http.StatusBadRequest)
+		return
+	}
+
+	mm, release := s.acquire(userID)
+	defer release()
+	// 导入期间不处理该用户的对话
+	endTurn := mm.BeginTurn()
+	defer endTurn()
+	result, err := mm.Import(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if errors.Is(err, memory.ErrInvalidImport) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Import failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("checkout") == "true" && len(result.Branches) > 0 {
+		if err := checkoutBranches(mm, result.Branches); err != nil {
+			http.Error(w, fmt.Sprintf("Checkout failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkoutBranches 切换到导入时单独保留的分支（会话ID → 消息ID）并保存
+func checkoutBranches(mm *memory.Manager, branches map[string]string) error {
+	current := mm.Thread()
+	defer mm.SetThread(current)
+	for threadID, id := range branches {
+		if err := mm.SetThread(threadID); err != nil {
+			return err
+		}
+		if err := mm.Checkout(id); err != nil {
+			return err
+		}
+	}
+	return mm.Save()
+}
+
+// HandleMemoryForget 删除用户记忆：POST /v1/memory/forget?user=alice，请求体为删除条件；
+// GET 返回删除记录
+func (s *Server) HandleMemoryForget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		http.Error(w, "Missing user parameter", http.StatusBadRequest)
+		return
+	}
+
+	mm, release := s.acquire(userID)
+	defer release()
+	if r.Method == http.MethodGet {
+		records, err := mm.ForgetLog()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Load forget log failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if records == nil {
+			records = []memory.ForgetRecord{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   records,
+		})
+		return
+	}
+
+	var query memory.ForgetQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// 删除期间不处理该用户的对话
+	endTurn := mm.BeginTurn()
+	defer endTurn()
+	record, err := mm.Forget(query)
+	switch {
+	case errors.Is(err, memory.ErrEmptyQuery):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, memory.ErrMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil && record == nil:
+		http.Error(w, fmt.Sprintf("Forget failed: %v", err), http.StatusInternalServerError)
+		return
+	case err != nil:
+		// 删除已完成，只是审计记录写入失败
+		fmt.Printf("Warning: %v\n", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
 // HandleHealth 健康检查端点
 func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status": "ok",
 		"time":   time.Now().Format(time.RFC3339),
+		"cache":  s.CacheStats(),
 	})
 }
 
 // Start 启动HTTP服务器
 func (s *Server) Start(addr string) error {
 	http.HandleFunc("/v1/chat/completions", s.HandleChatCompletions)
+	http.HandleFunc("/v1/memory/search", s.HandleMemorySearch)
+	http.HandleFunc("/v1/memory/threads", s.HandleMemoryThreads)
+	http.HandleFunc("/v1/memory/facts", s.HandleMemoryFacts)
+	http.HandleFunc("/v1/memory/notes", s.HandleMemoryNotes)
+	http.HandleFunc("/v1/memory/export", s.HandleMemoryExport)
+	http.HandleFunc("/v1/memory/import", s.HandleMemoryImport)
+	http.HandleFunc("/v1/memory/forget", s.HandleMemoryForget)
 	http.HandleFunc("/health", s.HandleHealth)
 
 	fmt.Printf("🚀 HTTP服务器启动在 %s\n", addr)
 	fmt.Println("端点:")
 	fmt.Println("  - POST /v1/chat/completions (OpenAI兼容)")
+	fmt.Println("  - GET  /v1/memory/search (记忆检索)")
+	fmt.Println("  - GET  /v1/memory/threads (会话列表)")
+	fmt.Println("  - GET  /v1/memory/facts (用户事实)")
+	fmt.Println("  - GET  /v1/memory/notes (置顶笔记，POST 添加、DELETE 删除)")
+	fmt.Println("  - GET  /v1/memory/export (导出记忆)")
+	fmt.Println("  - POST /v1/memory/import (导入记忆)")
+	fmt.Println("  - POST /v1/memory/forget (删除记忆，GET 查看删除记录)")
 	fmt.Println("  - GET  /health (健康检查)")
 	fmt.Println()
 
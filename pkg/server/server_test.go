@@ -0,0 +1,451 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/memory"
+	"github.com/Heng-Bian/memory-chat/pkg/storage"
+	"github.com/Heng-Bian/memory-chat/pkg/tokenizer"
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// mockLLMClient 固定回复的模拟LLM客户端
+type mockLLMClient struct{}
+
+func (mockLLMClient) Chat(messages []types.Message) (*types.Message, int, error) {
+	return &types.Message{Role: "assistant", Content: "ok"}, 1, nil
+}
+
+func (mockLLMClient) ChatStream(messages []types.Message, streamFunc func(string) error) (int, error) {
+	return 1, streamFunc("ok")
+}
+
+func (mockLLMClient) Summarize(messages []types.Message, lang string) (string, error) {
+	return "summary", nil
+}
+
+func (mockLLMClient) GenerateReflection(messages []types.Message, summary, lang string) (*types.Reflection, error) {
+	return &types.Reflection{Content: "reflection", Importance: 5, Timestamp: time.Now()}, nil
+}
+
+func (mockLLMClient) ExtractFacts(messages []types.Message, known []types.Fact, lang string) ([]types.Fact, error) {
+	var facts []types.Fact
+	for _, msg := range messages {
+		if msg.Role == "user" {
+			facts = append(facts, types.Fact{Subject: "用户", Attribute: "最近说的话", Value: msg.Content, Confidence: 0.5})
+		}
+	}
+	return facts, nil
+}
+
+func newTestServer(t *testing.T) (*Server, storage.Store) {
+	store := storage.NewYAMLStore(t.TempDir())
+	return NewServer(mockLLMClient{}, store, tokenizer.Estimator{}, memory.DefaultConfig()), store
+}
+
+func chat(s *Server, userID, content string, stream bool) {
+	body, _ := json.Marshal(ChatCompletionRequest{
+		Messages: []types.Message{{Role: "user", Content: content}},
+		Stream:   stream,
+		UserID:   userID,
+	})
+	s.HandleChatCompletions(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+}
+
+func TestServer_ConcurrentRequests(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chat(s, []string{"alice", "bob"}[i%2], "hi", i%3 == 0)
+			s.HandleMemorySearch(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/memory/search?user=alice&q=hi", nil))
+		}(i)
+	}
+	wg.Wait()
+	defer s.Close()
+
+	mm, release := s.acquire("alice")
+	defer release()
+	if n := len(mm.GetMemory().Thread(types.DefaultThread).Messages); n != 20 {
+		t.Errorf("Expected 20 messages for alice, got %d", n)
+	}
+}
+
+func TestServer_EvictsLeastRecentlyUsed(t *testing.T) {
+	s, store := newTestServer(t)
+	s.SetCacheLimits(2, 0)
+
+	chat(s, "alice", "hello from alice", false)
+	chat(s, "bob", "hello from bob", false)
+	chat(s, "alice", "again", false) // alice 变为最近使用
+	chat(s, "carol", "hello from carol", false)
+
+	// 等待 bob 的记忆写回并移出注册表
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		_, resident := s.memoryManagers["bob"]
+		s.mu.Unlock()
+		if !resident || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := s.CacheStats()
+	if stats.Resident != 2 || stats.Evictions != 1 || stats.Misses != 3 || stats.Hits != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	mem, err := store.Load("bob")
+	if err != nil || len(mem.Thread(types.DefaultThread).Messages) != 2 {
+		t.Fatalf("Expected bob's memory flushed on eviction, got %v, %+v", err, mem)
+	}
+
+	// 被淘汰的用户再次访问时从存储重新加载
+	chat(s, "bob", "back", false)
+	mm, release := s.acquire("bob")
+	if n := len(mm.GetMemory().Thread(types.DefaultThread).Messages); n != 4 {
+		t.Errorf("Expected reloaded history plus new turn, got %d messages", n)
+	}
+	release()
+	s.Close()
+}
+
+func TestServer_EvictsIdleButNotInUse(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.SetCacheLimits(0, time.Hour)
+	defer s.Close()
+
+	chat(s, "alice", "hi", false)
+	_, release := s.acquire("bob")
+
+	s.evictIdle(time.Now().Add(2 * time.Hour))
+	release()
+
+	s.mu.Lock()
+	_, aliceResident := s.memoryManagers["alice"]
+	_, bobResident := s.memoryManagers["bob"]
+	s.mu.Unlock()
+	if aliceResident {
+		t.Error("Idle manager should be evicted")
+	}
+	if !bobResident {
+		t.Error("Manager in use should not be evicted")
+	}
+}
+
+func TestServer_Threads(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Close()
+
+	send := func(thread string) int {
+		body, _ := json.Marshal(ChatCompletionRequest{
+			Messages: []types.Message{{Role: "user", Content: "hi"}},
+			UserID:   "alice",
+			Thread:   thread,
+		})
+		rec := httptest.NewRecorder()
+		s.HandleChatCompletions(rec, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+		return rec.Code
+	}
+	send("")
+	send("work")
+	send("work")
+	if code := send("../x"); code != 400 {
+		t.Errorf("Expected 400 for invalid thread, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	s.HandleMemoryThreads(rec, httptest.NewRequest("GET", "/v1/memory/threads?user=alice", nil))
+	var resp struct {
+		Data []memory.ThreadInfo `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	counts := map[string]int{}
+	for _, info := range resp.Data {
+		counts[info.ID] = info.Messages
+	}
+	if len(counts) != 2 || counts[types.DefaultThread] != 2 || counts["work"] != 4 {
+		t.Errorf("Unexpected threads: %+v", resp.Data)
+	}
+}
+
+func TestServer_EditAndRegenerate(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Close()
+
+	send := func(req ChatCompletionRequest) (*httptest.ResponseRecorder, ChatCompletionResponse) {
+		req.UserID = "alice"
+		body, _ := json.Marshal(req)
+		rec := httptest.NewRecorder()
+		s.HandleChatCompletions(rec, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+		var resp ChatCompletionResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+	user := func(content string) []types.Message {
+		return []types.Message{{Role: "user", Content: content}}
+	}
+
+	_, first := send(ChatCompletionRequest{Messages: user("hello")})
+	reply := first.Choices[0].Message
+	if reply.ID == "" || reply.ParentID == "" {
+		t.Fatalf("Expected reply with message IDs, got %+v", reply)
+	}
+
+	_, edited := send(ChatCompletionRequest{Messages: user("hello again"), EditID: reply.ParentID})
+	_, regenerated := send(ChatCompletionRequest{Regenerate: true})
+	if edited.Choices[0].Message.ID == regenerated.Choices[0].Message.ID ||
+		edited.Choices[0].Message.ParentID != regenerated.Choices[0].Message.ParentID {
+		t.Errorf("Regenerated reply should be a sibling of the previous one: %+v, %+v",
+			edited.Choices[0].Message, regenerated.Choices[0].Message)
+	}
+
+	mm, release := s.acquire("alice")
+	defer release()
+	branch := mm.Branch()
+	if len(branch) != 2 || branch[0].Content != "hello again" {
+		t.Errorf("Unexpected active branch: %+v", branch)
+	}
+	if n := len(mm.GetMemory().Thread(types.DefaultThread).Messages); n != 5 {
+		t.Errorf("Expected all branches to be kept, got %d messages", n)
+	}
+
+	if rec, _ := send(ChatCompletionRequest{Messages: user("x"), EditID: "missing"}); rec.Code != 404 {
+		t.Errorf("Expected 404 for unknown edit_id, got %d", rec.Code)
+	}
+}
+
+func TestServer_ExportImport(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Close()
+	chat(s, "alice", "hello", false)
+
+	rec := httptest.NewRecorder()
+	s.HandleMemoryExport(rec, httptest.NewRequest("GET", "/v1/memory/export?user=alice", nil))
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Export failed: %d %s", rec.Code, rec.Body.String())
+	}
+	exported := rec.Body.Bytes()
+
+	rec = httptest.NewRecorder()
+	s.HandleMemoryImport(rec, httptest.NewRequest("POST", "/v1/memory/import?user=bob", bytes.NewReader(exported)))
+	var result memory.ImportResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != 200 || result.Messages != 2 {
+		t.Fatalf("Import failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.HandleMemoryExport(rec, httptest.NewRequest("GET", "/v1/memory/export?user=bob&format=markdown", nil))
+	if body := rec.Body.String(); rec.Code != 200 || !strings.Contains(body, "hello") || !strings.Contains(body, "ok") {
+		t.Errorf("Expected imported transcript for bob, got %d %s", rec.Code, body)
+	}
+
+	// 已有自己对话的用户，导入的分支单独保留，checkout=true 时切换过去
+	chat(s, "carol", "hi", false)
+	rec = httptest.NewRecorder()
+	s.HandleMemoryImport(rec, httptest.NewRequest("POST", "/v1/memory/import?user=carol&checkout=true", bytes.NewReader(exported)))
+	result = memory.ImportResult{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != 200 || len(result.Branches) != 1 {
+		t.Fatalf("Expected the imported branch reported, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	s.HandleMemoryExport(rec, httptest.NewRequest("GET", "/v1/memory/export?user=carol&format=markdown", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "hello") || strings.Contains(body, "\nhi\n") {
+		t.Errorf("Expected carol switched to the imported branch, got %s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.HandleMemoryImport(rec, httptest.NewRequest("POST", "/v1/memory/import?user=bob", strings.NewReader("not json")))
+	if rec.Code != 400 {
+		t.Errorf("Expected 400 for invalid import, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	s.HandleMemoryExport(rec, httptest.NewRequest("GET", "/v1/memory/export?user=bob&format=pdf", nil))
+	if rec.Code != 400 {
+		t.Errorf("Expected 400 for unknown format, got %d", rec.Code)
+	}
+}
+
+func TestServer_Forget(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Close()
+	chat(s, "alice", "my password is hunter2", false)
+	chat(s, "alice", "hello", false)
+
+	forget := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.HandleMemoryForget(rec, httptest.NewRequest("POST", "/v1/memory/forget?user=alice", strings.NewReader(body)))
+		return rec
+	}
+	rec := forget(`{"topic":"HUNTER2","reason":"user request"}`)
+	var record memory.ForgetRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil || rec.Code != 200 || len(record.Messages) != 1 {
+		t.Fatalf("Forget failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "hunter2") {
+		t.Errorf("Forget record should not contain forgotten content: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.HandleMemoryExport(rec, httptest.NewRequest("GET", "/v1/memory/export?user=alice", nil))
+	if body := rec.Body.String(); strings.Contains(body, "hunter2") || !strings.Contains(body, "hello") {
+		t.Errorf("Expected only the forgotten message to be removed, got %s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.HandleMemoryForget(rec, httptest.NewRequest("GET", "/v1/memory/forget?user=alice", nil))
+	var log struct {
+		Data []memory.ForgetRecord `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &log); err != nil || len(log.Data) != 1 || log.Data[0].Reason != "user request" {
+		t.Errorf("Expected one forget record, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := forget(`{}`); rec.Code != 400 {
+		t.Errorf("Expected 400 for empty query, got %d", rec.Code)
+	}
+	if rec := forget(`{"message_ids":["missing"]}`); rec.Code != 404 {
+		t.Errorf("Expected 404 for unknown message, got %d", rec.Code)
+	}
+}
+
+func TestServer_Facts(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Close()
+	chat(s, "alice", "hello", false)
+	chat(s, "alice", "bye", false)
+	mm, release := s.acquire("alice")
+	mm.Wait()
+	release()
+
+	get := func(query string) (int, []types.Fact) {
+		rec := httptest.NewRecorder()
+		s.HandleMemoryFacts(rec, httptest.NewRequest("GET", "/v1/memory/facts?"+query, nil))
+		var resp struct {
+			Data []types.Fact `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp.Data
+	}
+	if code, facts := get("user=alice"); code != 200 || len(facts) != 1 || facts[0].Value != "bye" {
+		t.Errorf("Expected the latest fact, got %d %+v", code, facts)
+	}
+	if code, facts := get("user=alice&attribute=最近说的话&history=true"); code != 200 || len(facts) != 2 {
+		t.Errorf("Expected fact history, got %d %+v", code, facts)
+	}
+	if code, _ := get("user=alice&history=maybe"); code != 400 {
+		t.Errorf("Expected 400 for invalid history, got %d", code)
+	}
+}
+
+func TestServer_Notes(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Close()
+	chat(s, "alice", "Please remember that I prefer metric units.", false)
+
+	do := func(method, query, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.HandleMemoryNotes(rec, httptest.NewRequest(method, "/v1/memory/notes?"+query, strings.NewReader(body)))
+		return rec
+	}
+	rec := do("POST", "user=alice", `{"content":"Call me Al"}`)
+	var note types.Note
+	if err := json.Unmarshal(rec.Body.Bytes(), &note); err != nil || rec.Code != 201 || note.ID == "" {
+		t.Fatalf("Pin failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("POST", "user=alice", `{"content":""}`); rec.Code != 400 {
+		t.Errorf("Expected 400 for empty note, got %d", rec.Code)
+	}
+
+	list := func() []types.Note {
+		var resp struct {
+			Data []types.Note `json:"data"`
+		}
+		json.Unmarshal(do("GET", "user=alice", "").Body.Bytes(), &resp)
+		return resp.Data
+	}
+	if notes := list(); len(notes) != 2 || notes[0].Content != "I prefer metric units" || notes[1].ID != note.ID {
+		t.Fatalf("Expected detected and pinned notes, got %+v", notes)
+	}
+
+	if rec := do("DELETE", "user=alice&id="+note.ID, ""); rec.Code != 204 {
+		t.Errorf("Expected 204, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do("DELETE", "user=alice&id="+note.ID, ""); rec.Code != 404 {
+		t.Errorf("Expected 404 for unknown note, got %d", rec.Code)
+	}
+	if notes := list(); len(notes) != 1 {
+		t.Errorf("Expected one note after delete, got %+v", notes)
+	}
+	if rec := do("PUT", "user=alice", ""); rec.Code != 405 {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
+
+func TestServer_Language(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Close()
+
+	send := func(language string) int {
+		body, _ := json.Marshal(ChatCompletionRequest{
+			Messages: []types.Message{{Role: "user", Content: "hi"}},
+			UserID:   "alice",
+			Language: language,
+		})
+		rec := httptest.NewRecorder()
+		s.HandleChatCompletions(rec, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+		return rec.Code
+	}
+	if code := send("en-US"); code != 200 {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	// 之后不指定语言的请求沿用该用户的语言
+	send("")
+	mm, release := s.acquire("alice")
+	lang := mm.Language()
+	release()
+	if lang != "en" {
+		t.Errorf("Expected user language en, got %q", lang)
+	}
+	if code := send("xx"); code != 400 {
+		t.Errorf("Expected 400 for unsupported language, got %d", code)
+	}
+}
+
+func TestServer_Subscribe(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	var mu sync.Mutex
+	counts := make(map[memory.EventKind]int)
+	users := make(map[string]bool)
+	unsubscribe := s.Subscribe(func(e memory.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts[e.Kind]++
+		users[e.UserID] = true
+	})
+	defer unsubscribe()
+
+	chat(s, "alice", "hello", false)
+	chat(s, "bob", "hello", true)
+	s.Close() // 写回记忆并等待事件分发完成
+
+	mu.Lock()
+	defer mu.Unlock()
+	if counts[memory.EventMessageAdded] != 4 || counts[memory.EventSaved] < 2 || !users["alice"] || !users["bob"] {
+		t.Errorf("Unexpected events: %v from %v", counts, users)
+	}
+}
@@ -0,0 +1,616 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	usersBucket    = []byte("users")
+	messagesBucket = []byte("messages") // 旧版本单会话的消息，加载时迁移到默认会话
+	threadsBucket  = []byte("threads")
+	journalBucket  = []byte("journal")
+	blobsBucket    = []byte("blobs")
+	metaKey        = []byte("meta")
+)
+
+// BoltStore 基于嵌入式 bbolt 数据库的存储，每个会话的消息逐条保存在
+// threads/{thread_id} 桶中，日志条目按序号保存在 journal 桶中，压缩时只写入新增消息
+type BoltStore struct {
+	db *bolt.DB
+
+	// CompactEvery 日志条目数达到该值时压缩为快照
+	CompactEvery int
+
+	// Keys 设置后元数据、消息、日志条目和附加数据分块都单独加密写入；为 nil 时写入明文。
+	// 明文和加密的记录可以共存，会话的消息在下次保存时按当前配置整体重写
+	Keys *Keyring
+
+	mu sync.Mutex
+	// stale 记录加载时元数据、消息或附加数据不是用当前密钥配置写入的用户，下次写入时整体重写
+	stale map[string]bool
+}
+
+// OpenBoltStore 打开（或创建）bbolt 数据库文件
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init bolt database: %w", err)
+	}
+
+	return &BoltStore{db: db, CompactEvery: DefaultCompactEvery, stale: make(map[string]bool)}, nil
+}
+
+// Load 读取用户元数据和各会话的全部消息，升级旧版本格式后重放日志
+func (s *BoltStore) Load(userID string) (*types.ConversationMemory, error) {
+	var mem *types.ConversationMemory
+	stale := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		m, report, err := loadUser(tx, userID, s.Keys)
+		if err != nil {
+			return err
+		}
+		blobs, err := staleBlobs(tx.Bucket(usersBucket).Bucket([]byte(userID)), s.Keys)
+		if err != nil {
+			return err
+		}
+		mem, stale = m, report.Reencrypt || len(blobs) > 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.stale[userID] = stale
+	s.mu.Unlock()
+	return mem, nil
+}
+
+// loadUser 在事务中读取用户记忆、执行迁移并重放日志，返回记忆和迁移报告
+func loadUser(tx *bolt.Tx, userID string, keys *Keyring) (*types.ConversationMemory, *MigrationReport, error) {
+	ub := tx.Bucket(usersBucket).Bucket([]byte(userID))
+	if ub == nil {
+		return nil, nil, ErrNotFound
+	}
+
+	mem := newMemory(userID)
+	stale := false
+	if data := ub.Get(metaKey); data != nil {
+		stale = !keys.current(data)
+		data, err := keys.open(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read memory: %w", err)
+		}
+		if err := yaml.Unmarshal(data, mem); err != nil {
+			return nil, nil, fmt.Errorf("unmarshal memory: %w", err)
+		}
+	}
+
+	legacy, err := readMessages(ub.Bucket(messagesBucket), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	mem.Messages = append(mem.Messages, legacy...)
+
+	if tb := ub.Bucket(threadsBucket); tb != nil {
+		for _, t := range mem.Threads {
+			mb := tb.Bucket([]byte(t.ID))
+			msgs, err := readMessages(mb, keys)
+			if err != nil {
+				return nil, nil, err
+			}
+			t.Messages = append(msgs, t.Messages...)
+			if mb != nil {
+				if _, first := mb.Cursor().First(); first != nil && !keys.current(first) {
+					stale = true
+				}
+			}
+		}
+	}
+
+	report := &MigrationReport{UserID: userID, FromVersion: mem.SchemaVersion, Reencrypt: stale}
+	if report.Steps, err = Migrate(mem); err != nil {
+		return nil, nil, fmt.Errorf("migrate %s: %w", userID, err)
+	}
+	report.ToVersion = mem.SchemaVersion
+
+	jb := ub.Bucket(journalBucket)
+	if jb == nil {
+		return mem, report, nil
+	}
+	err = jb.ForEach(func(_, v []byte) error {
+		v, err := keys.open(v)
+		if err != nil {
+			return fmt.Errorf("read journal entry: %w", err)
+		}
+		var entry Entry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return fmt.Errorf("unmarshal journal entry: %w", err)
+		}
+		return entry.Apply(mem)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return mem, report, nil
+}
+
+// Save 写入快照并清空日志
+func (s *BoltStore) Save(mem *types.ConversationMemory) error {
+	stale := s.isStale(mem.UserID)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ub, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(mem.UserID))
+		if err != nil {
+			return fmt.Errorf("create user bucket: %w", err)
+		}
+		if stale {
+			return reencrypt(ub, mem, s.Keys)
+		}
+		return saveSnapshot(ub, mem, s.Keys)
+	})
+	if err == nil && stale {
+		s.markFresh(mem.UserID)
+	}
+	return err
+}
+
+// Append 追加日志条目，条目数达到 CompactEvery 时在同一事务中压缩
+func (s *BoltStore) Append(mem *types.ConversationMemory, entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	stale := s.isStale(mem.UserID)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ub, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(mem.UserID))
+		if err != nil {
+			return fmt.Errorf("create user bucket: %w", err)
+		}
+		if stale {
+			return reencrypt(ub, mem, s.Keys)
+		}
+
+		jb, err := ub.CreateBucketIfNotExists(journalBucket)
+		if err != nil {
+			return fmt.Errorf("create journal bucket: %w", err)
+		}
+		if int(jb.Sequence())+len(entries) >= s.CompactEvery {
+			return saveSnapshot(ub, mem, s.Keys)
+		}
+
+		for i := range entries {
+			data, err := json.Marshal(&entries[i])
+			if err != nil {
+				return fmt.Errorf("marshal journal entry: %w", err)
+			}
+			if data, err = s.Keys.seal(data); err != nil {
+				return fmt.Errorf("encrypt journal entry: %w", err)
+			}
+			if err := jb.Put(seqKey(entries[i].Seq), data); err != nil {
+				return fmt.Errorf("write journal entry: %w", err)
+			}
+			// 桶序号只用作条目计数
+			if _, err := jb.NextSequence(); err != nil {
+				return fmt.Errorf("next sequence: %w", err)
+			}
+		}
+		return nil
+	})
+	if err == nil && stale {
+		s.markFresh(mem.UserID)
+	}
+	return err
+}
+
+// isStale 检查加载时是否发现了需要按当前密钥配置重写的数据
+func (s *BoltStore) isStale(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stale[userID]
+}
+
+// markFresh 在用户数据按当前密钥配置整体重写后清除标记
+func (s *BoltStore) markFresh(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.stale, userID)
+}
+
+// reencrypt 写入快照并重写所有不是用当前密钥配置写入的附加数据。
+// 只追加日志的话，加载时发现的明文或旧密钥记录会一直留在数据库中
+func reencrypt(ub *bolt.Bucket, mem *types.ConversationMemory, keys *Keyring) error {
+	blobs, err := staleBlobs(ub, keys)
+	if err != nil {
+		return err
+	}
+	if err := saveSnapshot(ub, mem, keys); err != nil {
+		return err
+	}
+	for _, name := range blobs {
+		if err := rewriteBlob(ub.Bucket(blobsBucket), string(name), keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete 删除用户的全部数据
+func (s *BoltStore) Delete(userID string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(usersBucket).DeleteBucket([]byte(userID))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return fmt.Errorf("delete user bucket: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.markFresh(userID)
+	return nil
+}
+
+// Users 返回数据库中的所有用户
+func (s *BoltStore) Users() ([]string, error) {
+	var users []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, _ []byte) error {
+			users = append(users, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Migrate 在同一事务中升级用户记忆并重写快照，
+// 不是用当前密钥配置写入的附加数据也会重写
+func (s *BoltStore) Migrate(userID string, dryRun bool) (*MigrationReport, error) {
+	var report *MigrationReport
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		mem, r, err := loadUser(tx, userID, s.Keys)
+		if err != nil {
+			return err
+		}
+		report = r
+
+		ub := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		blobs, err := staleBlobs(ub, s.Keys)
+		if err != nil {
+			return err
+		}
+		report.Reencrypt = report.Reencrypt || len(blobs) > 0
+		if dryRun || !report.Pending() {
+			return nil
+		}
+		return reencrypt(ub, mem, s.Keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		s.markFresh(userID)
+	}
+	return report, nil
+}
+
+// staleBlobs 返回含有不是用当前密钥配置写入的分块的附加数据名
+func staleBlobs(ub *bolt.Bucket, keys *Keyring) ([][]byte, error) {
+	blobs := ub.Bucket(blobsBucket)
+	if blobs == nil {
+		return nil, nil
+	}
+	var stale [][]byte
+	err := blobs.ForEach(func(name, _ []byte) error {
+		return blobs.Bucket(name).ForEach(func(_, v []byte) error {
+			if !keys.current(v) && (len(stale) == 0 || !bytes.Equal(stale[len(stale)-1], name)) {
+				stale = append(stale, append([]byte(nil), name...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stale, nil
+}
+
+// LoadBlob 按顺序解密并拼接附加数据的所有分块
+func (s *BoltStore) LoadBlob(userID, name string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		if ub == nil || ub.Bucket(blobsBucket) == nil {
+			return ErrNotFound
+		}
+		bb := ub.Bucket(blobsBucket).Bucket([]byte(name))
+		if bb == nil {
+			return ErrNotFound
+		}
+
+		data = []byte{}
+		return bb.ForEach(func(_, v []byte) error {
+			v, err := s.Keys.open(v)
+			if err != nil {
+				return fmt.Errorf("read blob: %w", err)
+			}
+			data = append(data, v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// SaveBlob 用单个分块替换附加数据
+func (s *BoltStore) SaveBlob(userID, name string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		blobs, err := userBlobs(tx, userID)
+		if err != nil {
+			return err
+		}
+		if err := blobs.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return fmt.Errorf("reset blob: %w", err)
+		}
+		return appendChunk(blobs, name, data, s.Keys)
+	})
+}
+
+// AppendBlob 将数据作为新分块追加，不重写已有分块
+func (s *BoltStore) AppendBlob(userID, name string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		blobs, err := userBlobs(tx, userID)
+		if err != nil {
+			return err
+		}
+		return appendChunk(blobs, name, data, s.Keys)
+	})
+}
+
+// DeleteBlob 删除附加数据的所有分块
+func (s *BoltStore) DeleteBlob(userID, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		if ub == nil || ub.Bucket(blobsBucket) == nil {
+			return nil
+		}
+		if err := ub.Bucket(blobsBucket).DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return fmt.Errorf("delete blob: %w", err)
+		}
+		return nil
+	})
+}
+
+// Close 关闭数据库
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// userBlobs 返回（必要时创建）用户的附加数据桶
+func userBlobs(tx *bolt.Tx, userID string) (*bolt.Bucket, error) {
+	ub, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(userID))
+	if err != nil {
+		return nil, fmt.Errorf("create user bucket: %w", err)
+	}
+	blobs, err := ub.CreateBucketIfNotExists(blobsBucket)
+	if err != nil {
+		return nil, fmt.Errorf("create blobs bucket: %w", err)
+	}
+	return blobs, nil
+}
+
+// appendChunk 向附加数据追加一个分块
+func appendChunk(blobs *bolt.Bucket, name string, data []byte, keys *Keyring) error {
+	bb, err := blobs.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return fmt.Errorf("create blob bucket: %w", err)
+	}
+	seq, err := bb.NextSequence()
+	if err != nil {
+		return fmt.Errorf("next sequence: %w", err)
+	}
+	if data, err = keys.seal(data); err != nil {
+		return fmt.Errorf("encrypt blob: %w", err)
+	}
+	if err := bb.Put(seqKey(seq), data); err != nil {
+		return fmt.Errorf("write blob: %w", err)
+	}
+	return nil
+}
+
+// rewriteBlob 解密附加数据的所有分块，并用当前密钥配置重写为单个分块
+func rewriteBlob(blobs *bolt.Bucket, name string, keys *Keyring) error {
+	var data []byte
+	err := blobs.Bucket([]byte(name)).ForEach(func(_, v []byte) error {
+		v, err := keys.open(v)
+		if err != nil {
+			return fmt.Errorf("read blob: %w", err)
+		}
+		data = append(data, v...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := blobs.DeleteBucket([]byte(name)); err != nil {
+		return fmt.Errorf("reset blob: %w", err)
+	}
+	return appendChunk(blobs, name, data, keys)
+}
+
+// saveSnapshot 写入元数据和各会话新增的消息，并删除已被快照包含的日志
+func saveSnapshot(ub *bolt.Bucket, mem *types.ConversationMemory, keys *Keyring) error {
+	meta := *mem
+	meta.SchemaVersion = CurrentSchemaVersion
+	meta.Threads = make([]*types.Thread, len(mem.Threads))
+	for i, t := range mem.Threads {
+		stripped := *t
+		stripped.Messages = nil
+		meta.Threads[i] = &stripped
+	}
+	data, err := yaml.Marshal(&meta)
+	if err != nil {
+		return fmt.Errorf("marshal memory: %w", err)
+	}
+	if data, err = keys.seal(data); err != nil {
+		return fmt.Errorf("encrypt memory: %w", err)
+	}
+	if err := ub.Put(metaKey, data); err != nil {
+		return fmt.Errorf("write memory: %w", err)
+	}
+
+	tb, err := ub.CreateBucketIfNotExists(threadsBucket)
+	if err != nil {
+		return fmt.Errorf("create threads bucket: %w", err)
+	}
+	for _, t := range mem.Threads {
+		if err := saveThreadMessages(tb, t, keys); err != nil {
+			return err
+		}
+	}
+
+	// 删除已不存在的会话和旧版本的消息桶
+	var stale [][]byte
+	err = tb.ForEach(func(k, _ []byte) error {
+		if mem.Thread(string(k)) == nil {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err := tb.DeleteBucket(k); err != nil {
+			return fmt.Errorf("delete thread bucket: %w", err)
+		}
+	}
+	if err := ub.DeleteBucket(messagesBucket); err != nil && err != bolt.ErrBucketNotFound {
+		return fmt.Errorf("delete legacy messages bucket: %w", err)
+	}
+
+	if err := ub.DeleteBucket(journalBucket); err != nil && err != bolt.ErrBucketNotFound {
+		return fmt.Errorf("reset journal bucket: %w", err)
+	}
+	return nil
+}
+
+// saveThreadMessages 写入会话中尚未保存的消息。已保存的消息被改写过，
+// 或者不是用当前密钥配置写入的（启用加密前的明文或轮换前的密钥）时重建消息桶
+func saveThreadMessages(tb *bolt.Bucket, t *types.Thread, keys *Keyring) error {
+	key := []byte(t.ID)
+	mb, err := tb.CreateBucketIfNotExists(key)
+	if err != nil {
+		return fmt.Errorf("create thread bucket: %w", err)
+	}
+
+	stored := int(mb.Sequence())
+	same, err := lastMessageMatches(mb, t.Messages, stored, keys)
+	if err != nil {
+		return err
+	}
+	if _, first := mb.Cursor().First(); first != nil && !keys.current(first) {
+		same = false
+	}
+	if !same {
+		if err := tb.DeleteBucket(key); err != nil {
+			return fmt.Errorf("reset thread bucket: %w", err)
+		}
+		if mb, err = tb.CreateBucket(key); err != nil {
+			return fmt.Errorf("create thread bucket: %w", err)
+		}
+		stored = 0
+	}
+	return putMessages(mb, t.Messages[stored:], keys)
+}
+
+// readMessages 按顺序读取并解密消息桶中的消息，桶不存在时返回空
+func readMessages(mb *bolt.Bucket, keys *Keyring) ([]types.Message, error) {
+	msgs := []types.Message{}
+	if mb == nil {
+		return msgs, nil
+	}
+	err := mb.ForEach(func(_, v []byte) error {
+		v, err := keys.open(v)
+		if err != nil {
+			return fmt.Errorf("read message: %w", err)
+		}
+		var msg types.Message
+		if err := yaml.Unmarshal(v, &msg); err != nil {
+			return fmt.Errorf("unmarshal message: %w", err)
+		}
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+// lastMessageMatches 检查数据库中最后一条消息是否与内存中对应位置一致
+func lastMessageMatches(mb *bolt.Bucket, msgs []types.Message, stored int, keys *Keyring) (bool, error) {
+	if stored == 0 {
+		return true, nil
+	}
+	if stored > len(msgs) {
+		return false, nil
+	}
+
+	data, err := yaml.Marshal(&msgs[stored-1])
+	if err != nil {
+		return false, fmt.Errorf("marshal message: %w", err)
+	}
+	last, err := keys.open(mb.Get(seqKey(uint64(stored))))
+	if err != nil {
+		return false, fmt.Errorf("read message: %w", err)
+	}
+	return bytes.Equal(last, data), nil
+}
+
+// putMessages 按序号写入消息
+func putMessages(mb *bolt.Bucket, msgs []types.Message, keys *Keyring) error {
+	for i := range msgs {
+		seq, err := mb.NextSequence()
+		if err != nil {
+			return fmt.Errorf("next sequence: %w", err)
+		}
+		data, err := yaml.Marshal(&msgs[i])
+		if err != nil {
+			return fmt.Errorf("marshal message: %w", err)
+		}
+		if data, err = keys.seal(data); err != nil {
+			return fmt.Errorf("encrypt message: %w", err)
+		}
+		if err := mb.Put(seqKey(seq), data); err != nil {
+			return fmt.Errorf("write message: %w", err)
+		}
+	}
+	return nil
+}
+
+// seqKey 将序号编码为大端字节，保证游标按顺序遍历
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoKey 表示数据已加密，但没有可用于解密的密钥
+var ErrNoKey = errors.New("memory is encrypted with an unavailable key")
+
+// 加密数据的信封格式（大端）：
+//
+//	magic(4) | version(1) | key_id(8) | key_nonce(12) | wrapped_key(48) | nonce(12) | length(4) | ciphertext
+//
+// 每个信封使用随机生成的数据密钥加密，数据密钥再由主密钥加密（wrapped_key）。
+// 信封自带长度，可以首尾相接，解密时依次拼接明文
+const (
+	envelopeVersion = 1
+	keyIDLen        = 8
+	nonceLen        = 12
+	dataKeyLen      = 32
+	wrappedKeyLen   = dataKeyLen + 16
+	envelopeHeadLen = len(envelopeMagic) + 1 + keyIDLen                         // 用于判断使用哪个密钥
+	envelopeLen     = envelopeHeadLen + nonceLen + wrappedKeyLen + nonceLen + 4 // 密文之前的全部字段
+)
+
+// envelopeMagic 加密数据的开头，首字节不是合法的 YAML/JSON 字符，不会与明文混淆
+const envelopeMagic = "\x89MCE"
+
+// Keyring 加密密钥环。新写入的数据使用主密钥加密，其余密钥只用于解密，
+// 轮换密钥时把新密钥放在最前面、保留旧密钥，数据在下次保存时用新密钥重新加密
+type Keyring struct {
+	primary [keyIDLen]byte
+	keys    map[[keyIDLen]byte]cipher.AEAD
+}
+
+// NewKeyring 用 AES 密钥（16、24 或 32 字节）创建密钥环，第一个为主密钥。
+// 密钥ID由密钥内容派生，无需单独配置
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring needs at least one key")
+	}
+	k := &Keyring{keys: make(map[[keyIDLen]byte]cipher.AEAD, len(keys))}
+	for i, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		id := keyID(key)
+		if i == 0 {
+			k.primary = id
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// ParseKeyring 解析 base64 编码的密钥列表，密钥之间用逗号或换行分隔，
+// '#' 开头的行是注释。第一个密钥为主密钥
+func ParseKeyring(text string) (*Keyring, error) {
+	var keys [][]byte
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			key, err := base64.StdEncoding.DecodeString(field)
+			if err != nil {
+				return nil, fmt.Errorf("decode key %d: %w", len(keys)+1, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return NewKeyring(keys...)
+}
+
+// keyID 由密钥的 SHA-256 前 8 字节派生密钥ID
+func keyID(key []byte) [keyIDLen]byte {
+	sum := sha256.Sum256(key)
+	var id [keyIDLen]byte
+	copy(id[:], sum[:])
+	return id
+}
+
+// newAEAD 创建 AES-GCM 加密器
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypted 检查数据是否为加密信封
+func encrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+// seal 用主密钥把数据加密为一个信封，密钥环为 nil 时原样返回明文
+func (k *Keyring) seal(plaintext []byte) ([]byte, error) {
+	if k == nil {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, dataKeyLen)
+	keyNonce := make([]byte, nonceLen)
+	nonce := make([]byte, nonceLen)
+	for _, b := range [][]byte{dataKey, keyNonce, nonce} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("generate key: %w", err)
+		}
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("create data key: %w", err)
+	}
+
+	out := make([]byte, 0, envelopeLen+len(plaintext)+dataAEAD.Overhead())
+	out = append(out, envelopeMagic...)
+	out = append(out, envelopeVersion)
+	out = append(out, k.primary[:]...)
+	out = append(out, keyNonce...)
+	out = k.keys[k.primary].Seal(out, keyNonce, dataKey, out[:envelopeHeadLen])
+	out = append(out, nonce...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(plaintext)+dataAEAD.Overhead()))
+	return dataAEAD.Seal(out, nonce, plaintext, out[:envelopeLen]), nil
+}
+
+// open 解密首尾相接的信封并拼接明文，未加密的数据原样返回，
+// 因此加密和明文的记忆可以共存
+func (k *Keyring) open(data []byte) ([]byte, error) {
+	if !encrypted(data) {
+		return data, nil
+	}
+
+	var plaintext []byte
+	for len(data) > 0 {
+		if len(data) < envelopeLen || !encrypted(data) || data[len(envelopeMagic)] != envelopeVersion {
+			return nil, errors.New("decrypt: malformed envelope")
+		}
+		var id [keyIDLen]byte
+		copy(id[:], data[len(envelopeMagic)+1:])
+		var kek cipher.AEAD
+		if k != nil {
+			kek = k.keys[id]
+		}
+		if kek == nil {
+			return nil, fmt.Errorf("decrypt: key %x: %w", id, ErrNoKey)
+		}
+
+		keyNonce := data[envelopeHeadLen : envelopeHeadLen+nonceLen]
+		wrapped := data[envelopeHeadLen+nonceLen : envelopeHeadLen+nonceLen+wrappedKeyLen]
+		dataKey, err := kek.Open(nil, keyNonce, wrapped, data[:envelopeHeadLen])
+		if err != nil {
+			return nil, fmt.Errorf("decrypt data key: %w", err)
+		}
+		dataAEAD, err := newAEAD(dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("create data key: %w", err)
+		}
+
+		nonce := data[envelopeLen-4-nonceLen : envelopeLen-4]
+		n := int(binary.BigEndian.Uint32(data[envelopeLen-4:]))
+		if len(data) < envelopeLen+n {
+			return nil, errors.New("decrypt: truncated envelope")
+		}
+		if plaintext, err = dataAEAD.Open(plaintext, nonce, data[envelopeLen:envelopeLen+n], data[:envelopeLen]); err != nil {
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+		data = data[envelopeLen+n:]
+	}
+	return plaintext, nil
+}
+
+// current 检查数据（至少包含开头的密钥ID）是否已按当前配置保存：
+// 有密钥环时需用主密钥加密，没有密钥环时需为明文。不满足时应在下次写入时重写
+func (k *Keyring) current(data []byte) bool {
+	if k == nil {
+		return !encrypted(data)
+	}
+	return len(data) >= envelopeHeadLen && encrypted(data) &&
+		bytes.Equal(data[len(envelopeMagic)+1:envelopeHeadLen], k.primary[:])
+}
+
+// sealLine 把一条日志加密为一行 base64 文本（不含换行），没有密钥环时原样返回
+func (k *Keyring) sealLine(line []byte) ([]byte, error) {
+	if k == nil {
+		return line, nil
+	}
+	sealed, err := k.seal(line)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+// openLine 解密一行日志，JSON 明文行原样返回
+func (k *Keyring) openLine(line []byte) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '{' {
+		return line, nil
+	}
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, fmt.Errorf("decode journal line: %w", err)
+	}
+	return k.open(sealed[:n])
+}
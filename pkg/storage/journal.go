@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// DefaultCompactEvery 日志条目累积到该数量时压缩为快照
+const DefaultCompactEvery = 200
+
+// EntryKind 日志条目类型
+type EntryKind string
+
+const (
+	// EntryMessage 新增消息
+	EntryMessage EntryKind = "message"
+	// EntrySummary 新增摘要，替换其覆盖范围内的低层摘要
+	EntrySummary EntryKind = "summary"
+	// EntryReflection 新增反思
+	EntryReflection EntryKind = "reflection"
+	// EntryHead 切换会话的当前分支
+	EntryHead EntryKind = "head"
+	// EntryArchive 会话最早的消息已写入归档段
+	EntryArchive EntryKind = "archive"
+	// EntryFact 新增或确认事实，见 AddFact
+	EntryFact EntryKind = "fact"
+	// EntryLanguage 修改用户的提示词语言
+	EntryLanguage EntryKind = "language"
+	// EntryNote 新增置顶笔记
+	EntryNote EntryKind = "note"
+	// EntryUnpin 删除置顶笔记
+	EntryUnpin EntryKind = "unpin"
+)
+
+// Entry 表示追加日志中的一条记录
+type Entry struct {
+	Seq         uint64            `json:"seq"`                  // 日志序号，单调递增
+	Kind        EntryKind         `json:"kind"`                 // 条目类型
+	Thread      string            `json:"thread,omitempty"`     // 消息和摘要所属的会话，为空表示默认会话
+	Message     *types.Message    `json:"message,omitempty"`    // EntryMessage 的消息
+	Summary     *types.Summary    `json:"summary,omitempty"`    // EntrySummary 的摘要
+	Reflection  *types.Reflection `json:"reflection,omitempty"` // EntryReflection 的反思
+	Head        string            `json:"head,omitempty"`       // EntryHead 切换到的消息ID
+	Segment     *types.Segment    `json:"segment,omitempty"`    // EntryArchive 的归档段
+	Fact        *types.Fact       `json:"fact,omitempty"`       // EntryFact 的事实
+	Language    string            `json:"language,omitempty"`   // EntryLanguage 的语言，为空表示恢复默认
+	Note        *types.Note       `json:"note,omitempty"`       // EntryNote 的笔记
+	NoteID      string            `json:"note_id,omitempty"`    // EntryUnpin 删除的笔记ID
+	ContextSize int               `json:"context_size"`         // 写入时所属会话的上下文大小
+}
+
+// Apply 将日志条目应用到记忆上，已包含在快照中的条目会被跳过
+func (e *Entry) Apply(mem *types.ConversationMemory) error {
+	if e.Seq <= mem.JournalSeq {
+		return nil
+	}
+
+	switch e.Kind {
+	case EntryMessage:
+		if e.Message == nil {
+			return fmt.Errorf("journal entry %d: missing message", e.Seq)
+		}
+		t := mem.EnsureThread(e.threadID())
+		msg := *e.Message
+		if msg.ID == "" {
+			// 旧版本日志的消息没有ID，总是接在当前分支之后
+			msg.ID, msg.ParentID = legacyMessageID(len(t.Messages)), t.Head
+		}
+		t.Messages = append(t.Messages, msg)
+		t.Head = msg.ID
+		t.ContextSize = e.ContextSize
+	case EntrySummary:
+		if e.Summary == nil {
+			return fmt.Errorf("journal entry %d: missing summary", e.Seq)
+		}
+		t := mem.EnsureThread(e.threadID())
+		summary := *e.Summary
+		if summary.EndID == "" {
+			linkSummary(t.Branch(), &summary)
+		}
+		AddSummary(t, summary)
+		t.ContextSize = e.ContextSize
+	case EntryHead:
+		t := mem.EnsureThread(e.threadID())
+		if e.Head != "" && t.Find(e.Head) < 0 {
+			return fmt.Errorf("journal entry %d: unknown message %q", e.Seq, e.Head)
+		}
+		t.Head = e.Head
+		t.ContextSize = e.ContextSize
+	case EntryArchive:
+		if e.Segment == nil {
+			return fmt.Errorf("journal entry %d: missing segment", e.Seq)
+		}
+		if err := ArchiveMessages(mem.EnsureThread(e.threadID()), *e.Segment); err != nil {
+			return fmt.Errorf("journal entry %d: %w", e.Seq, err)
+		}
+	case EntryReflection:
+		if e.Reflection == nil {
+			return fmt.Errorf("journal entry %d: missing reflection", e.Seq)
+		}
+		mem.Reflections = append(mem.Reflections, *e.Reflection)
+	case EntryFact:
+		if e.Fact == nil {
+			return fmt.Errorf("journal entry %d: missing fact", e.Seq)
+		}
+		AddFact(mem, *e.Fact)
+	case EntryLanguage:
+		mem.Language = e.Language
+	case EntryNote:
+		if e.Note == nil {
+			return fmt.Errorf("journal entry %d: missing note", e.Seq)
+		}
+		mem.Notes = append(mem.Notes, *e.Note)
+	case EntryUnpin:
+		mem.Notes = RemoveNote(mem.Notes, e.NoteID)
+	default:
+		return fmt.Errorf("journal entry %d: unknown kind %q", e.Seq, e.Kind)
+	}
+
+	mem.JournalSeq = e.Seq
+	return nil
+}
+
+// threadID 返回条目所属的会话ID，旧版本日志没有会话字段
+func (e *Entry) threadID() string {
+	if e.Thread == "" {
+		return types.DefaultThread
+	}
+	return e.Thread
+}
+
+// AddSummary 向会话加入摘要：同一分支上被新摘要范围完全覆盖的低层摘要会被移除，
+// 结果按覆盖范围的起点排序。没有记录消息ID的摘要视为属于所有分支
+func AddSummary(t *types.Thread, summary types.Summary) {
+	onBranch := t.BranchSet(summary.EndID)
+
+	kept := t.Summaries[:0]
+	for _, s := range t.Summaries {
+		sameBranch := summary.EndID == "" || s.EndID == "" || onBranch.Contains(s.EndID)
+		if s.Level < summary.Level && s.Start >= summary.Start && s.End <= summary.End && sameBranch {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	t.Summaries = append(kept, summary)
+	sort.SliceStable(t.Summaries, func(i, j int) bool {
+		return t.Summaries[i].Start < t.Summaries[j].Start
+	})
+}
+
+// AddFact 向记忆加入事实，返回记录该值的事实ID。已有同一主体同一属性的有效事实时：
+// 值相同（不区分大小写）只更新已有事实的确认时间、来源和置信度；值不同则确认时间较新的一方有效，
+// 另一方被标记为已取代。已被取代的事实直接加入，作为历史记录
+func AddFact(mem *types.ConversationMemory, fact types.Fact) string {
+	for i := range mem.Facts {
+		old := &mem.Facts[i]
+		if !fact.Active() || !old.Active() || old.Key() != fact.Key() {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(old.Value), strings.TrimSpace(fact.Value)) {
+			if fact.UpdatedAt.After(old.UpdatedAt) {
+				old.UpdatedAt, old.Thread, old.MessageID = fact.UpdatedAt, fact.Thread, fact.MessageID
+			}
+			old.Confidence = max(old.Confidence, fact.Confidence)
+			return old.ID
+		}
+		if fact.UpdatedAt.Before(old.UpdatedAt) {
+			fact.SupersededBy = old.ID // 例如导入较早的记忆
+		} else {
+			old.SupersededBy = fact.ID
+		}
+		break
+	}
+	mem.Facts = append(mem.Facts, fact)
+	return fact.ID
+}
+
+// RemoveNote 返回删除指定ID的笔记后的列表，没有该笔记时原样返回
+func RemoveNote(notes []types.Note, id string) []types.Note {
+	for i, n := range notes {
+		if n.ID == id {
+			return append(notes[:i:i], notes[i+1:]...)
+		}
+	}
+	return notes
+}
+
+// ArchiveMessages 把会话中最早的 seg.Count 条消息移出 Messages 并记录归档段，
+// 调用前这些消息应已写入归档段的附加数据
+func ArchiveMessages(t *types.Thread, seg types.Segment) error {
+	if seg.Count <= 0 || seg.Count > len(t.Messages) || seg.First != t.Archived() ||
+		t.Messages[0].ID != seg.StartID || t.Messages[seg.Count-1].ID != seg.EndID {
+		return fmt.Errorf("archive segment %s does not match thread %s", seg.Name, t.ID)
+	}
+	t.Messages = append([]types.Message{}, t.Messages[seg.Count:]...)
+	t.Segments = append(t.Segments, seg)
+	return nil
+}
+
+// encodeEntries 将条目编码为JSON行，配置了密钥环时每行单独加密
+func encodeEntries(entries []Entry, keys *Keyring) ([]byte, error) {
+	var buf bytes.Buffer
+	for i := range entries {
+		data, err := json.Marshal(&entries[i])
+		if err != nil {
+			return nil, fmt.Errorf("marshal journal entry: %w", err)
+		}
+		if data, err = keys.sealLine(data); err != nil {
+			return nil, fmt.Errorf("encrypt journal entry: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// replayJournal 读取JSON行日志并应用到记忆，返回读取的条目数。
+// 末尾不完整的一行（写入中途崩溃）会被忽略，下次追加前截掉，加密的行用密钥环解密
+func replayJournal(r io.Reader, mem *types.ConversationMemory, keys *Keyring) (int, error) {
+	reader := bufio.NewReader(r)
+	n := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("read journal: %w", err)
+		}
+
+		if line, err = keys.openLine(line); err != nil {
+			return n, err
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return n, fmt.Errorf("unmarshal journal entry: %w", err)
+		}
+		if err := entry.Apply(mem); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
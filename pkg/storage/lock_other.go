@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package storage
+
+import "sync"
+
+// lockMu 在不支持 flock 的平台上只提供进程内互斥
+var lockMu sync.Mutex
+
+// lockFile 在不支持 flock 的平台上退化为进程内锁
+func lockFile(path string) (func(), error) {
+	lockMu.Lock()
+	return lockMu.Unlock, nil
+}
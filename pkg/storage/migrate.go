@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// CurrentSchemaVersion 当前的记忆文件格式版本，保存快照时写入
+const CurrentSchemaVersion = 8
+
+// ErrSchemaTooNew 表示记忆文件由更新版本的程序写入，无法安全读取
+var ErrSchemaTooNew = errors.New("memory schema version not supported")
+
+// Migration 把记忆从上一个版本升级到 Version 的迁移步骤
+type Migration struct {
+	Version     int    // 升级后的版本
+	Description string // 迁移说明，用于迁移报告
+	// Apply 就地修改记忆，返回是否有内容被修改。没有版本号的记忆会执行全部迁移，
+	// 因此 Apply 需要根据内容判断是否需要修改，对已是新格式的记忆不做任何事
+	Apply func(mem *types.ConversationMemory) bool
+}
+
+// migrations 按版本顺序注册的迁移。修改持久化格式时在末尾追加一个迁移，
+// 并同步增加 CurrentSchemaVersion
+var migrations = []Migration{
+	{Version: 2, Description: "单会话记忆迁移到默认会话", Apply: upgradeLegacy},
+	{Version: 3, Description: "为消息分配ID并连成消息树", Apply: linkLegacy},
+	// 归档段只是新增字段，旧文件无需修改；提升版本使旧程序拒绝读取含归档段的文件，
+	// 避免在不知道归档段的情况下写回而丢失归档的消息
+	{Version: 4, Description: "支持把早期消息移入归档段", Apply: func(*types.ConversationMemory) bool { return false }},
+	// 同样只是新增字段，旧程序写回时会丢失事实
+	{Version: 5, Description: "支持结构化事实", Apply: func(*types.ConversationMemory) bool { return false }},
+	{Version: 6, Description: "反思增加主题、偏好和建议", Apply: func(*types.ConversationMemory) bool { return false }},
+	{Version: 7, Description: "支持按用户设置提示词语言", Apply: func(*types.ConversationMemory) bool { return false }},
+	{Version: 8, Description: "支持置顶笔记", Apply: func(*types.ConversationMemory) bool { return false }},
+}
+
+// Migrations 返回已注册的全部迁移
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
+
+// Migrate 依次执行记忆尚未应用的迁移并把版本号更新为 CurrentSchemaVersion，
+// 返回实际修改了记忆的迁移说明。需在读取快照之后、重放日志之前调用
+func Migrate(mem *types.ConversationMemory) ([]string, error) {
+	if mem.SchemaVersion > CurrentSchemaVersion {
+		return nil, fmt.Errorf("%w: version %d, supported up to %d",
+			ErrSchemaTooNew, mem.SchemaVersion, CurrentSchemaVersion)
+	}
+
+	var applied []string
+	for _, m := range migrations {
+		if mem.SchemaVersion >= m.Version {
+			continue
+		}
+		if m.Apply(mem) {
+			applied = append(applied, m.Description)
+		}
+	}
+	mem.SchemaVersion = CurrentSchemaVersion
+	return applied, nil
+}
+
+// MigrationReport 单个用户记忆的迁移结果
+type MigrationReport struct {
+	UserID      string
+	FromVersion int      // 迁移前的版本，0 表示没有版本号
+	ToVersion   int      // 迁移后的版本
+	Steps       []string // 实际修改了记忆的迁移说明
+	Reencrypt   bool     // 数据不是用当前密钥配置写入的，需要重新加密（或解密为明文）
+}
+
+// Pending 检查记忆是否需要写回才能升级到当前版本和当前密钥
+func (r *MigrationReport) Pending() bool {
+	return r.FromVersion < r.ToVersion || r.Reencrypt
+}
+
+// Migrator 是存储后端可选实现的接口，用于离线升级全部用户的记忆
+type Migrator interface {
+	// Users 返回保存了记忆的全部用户ID，按字典序排列
+	Users() ([]string, error)
+	// Migrate 把用户记忆升级到当前版本并按当前密钥写回快照和附加数据（同时压缩日志）；
+	// dryRun 为 true 时只生成报告，不修改存储
+	Migrate(userID string, dryRun bool) (*MigrationReport, error)
+}
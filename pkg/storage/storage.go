@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+// ErrNotFound 表示用户尚无持久化的记忆
+var ErrNotFound = errors.New("memory not found")
+
+// ErrConflict 表示记忆在上次读取之后被其他进程修改
+var ErrConflict = errors.New("memory modified by another writer")
+
+// Store 定义记忆存储后端接口，按用户读写对话记忆。
+// 记忆由快照和追加日志组成：Save 写入完整快照并清空日志，
+// Append 只追加日志条目，Load 读取快照后重放日志
+type Store interface {
+	// Load 加载用户的完整记忆，用户不存在时返回 ErrNotFound
+	Load(userID string) (*types.ConversationMemory, error)
+	// Save 持久化用户的完整快照
+	Save(mem *types.ConversationMemory) error
+	// Append 追加日志条目；mem 是应用这些条目之后的记忆，
+	// 日志过长时后端会用它压缩出新的快照
+	Append(mem *types.ConversationMemory, entries ...Entry) error
+	// Delete 删除用户的全部记忆
+	Delete(userID string) error
+	// Close 释放存储后端占用的资源
+	Close() error
+}
+
+// BlobStore 是存储后端可选实现的接口，用于保存与用户记忆关联的附加数据
+// （如向量索引）。附加数据不属于快照，也不参与日志重放
+type BlobStore interface {
+	// LoadBlob 读取附加数据，不存在时返回 ErrNotFound
+	LoadBlob(userID, name string) ([]byte, error)
+	// SaveBlob 整体替换附加数据
+	SaveBlob(userID, name string, data []byte) error
+	// AppendBlob 在附加数据末尾追加内容
+	AppendBlob(userID, name string, data []byte) error
+	// DeleteBlob 删除附加数据，不存在时不做任何事
+	DeleteBlob(userID, name string) error
+}
+
+// newMemory 创建空记忆
+func newMemory(userID string) *types.ConversationMemory {
+	return &types.ConversationMemory{
+		UserID:      userID,
+		Reflections: []types.Reflection{},
+	}
+}
+
+// keepRecentOnUpgrade 旧版本摘要生成时保留的最近消息数
+const keepRecentOnUpgrade = 5
+
+// upgradeLegacy 将旧版本的单会话记忆迁移到默认会话，返回是否有内容被迁移。
+// 旧版本的纯文本摘要总是覆盖除最近几条之外的全部消息，据此推算覆盖范围
+func upgradeLegacy(mem *types.ConversationMemory) bool {
+	if len(mem.Messages) == 0 && len(mem.Summaries) == 0 && mem.Summary == "" {
+		return false
+	}
+
+	t := mem.EnsureThread(types.DefaultThread)
+	t.Messages = append(mem.Messages, t.Messages...)
+	t.Summaries = append(mem.Summaries, t.Summaries...)
+	if t.ContextSize == 0 {
+		t.ContextSize = mem.ContextSize
+	}
+	if len(t.Messages) > 0 && !t.Messages[0].Timestamp.IsZero() && t.CreatedAt.After(t.Messages[0].Timestamp) {
+		t.CreatedAt = t.Messages[0].Timestamp
+	}
+
+	if mem.Summary != "" {
+		end := len(t.Messages) - keepRecentOnUpgrade
+		if end < 0 {
+			end = 0
+		}
+		AddSummary(t, types.Summary{
+			Content: mem.Summary,
+			Start:   0,
+			End:     end,
+			Level:   0,
+		})
+	}
+
+	mem.Messages = nil
+	mem.Summaries = nil
+	mem.Summary = ""
+	mem.ContextSize = 0
+	return true
+}
+
+// legacyMessageID 返回旧版本消息的ID。旧版本的消息没有ID，
+// 按其在会话中的位置确定，使每次加载得到的ID相同
+func legacyMessageID(i int) string {
+	return fmt.Sprintf("m%d", i)
+}
+
+// linkLegacy 为没有ID的旧版本消息分配ID，并按原有顺序连成一个分支，
+// 同时补全摘要覆盖的消息ID，返回是否有消息或摘要被修改
+func linkLegacy(mem *types.ConversationMemory) bool {
+	changed := false
+	for _, t := range mem.Threads {
+		for i := range t.Messages {
+			msg := &t.Messages[i]
+			if msg.ID != "" {
+				continue
+			}
+			msg.ID = legacyMessageID(i)
+			if i > 0 {
+				msg.ParentID = t.Messages[i-1].ID
+			}
+			t.Head = msg.ID
+			changed = true
+		}
+
+		branch := t.Branch()
+		for i := range t.Summaries {
+			if t.Summaries[i].EndID == "" {
+				linkSummary(branch, &t.Summaries[i])
+				changed = changed || t.Summaries[i].EndID != ""
+			}
+		}
+	}
+	return changed
+}
+
+// linkSummary 根据旧版本摘要在分支上的覆盖范围补全首尾消息ID
+func linkSummary(branch []types.Message, s *types.Summary) {
+	if s.Start < 0 || s.End > len(branch) || s.Start >= s.End {
+		return
+	}
+	s.StartID = branch[s.Start].ID
+	s.EndID = branch[s.End-1].ID
+}
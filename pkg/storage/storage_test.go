@@ -0,0 +1,639 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+)
+
+func openTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	bolt, err := OpenBoltStore(filepath.Join(tmpDir, "memories.db"))
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	return map[string]Store{
+		"yaml": NewYAMLStore(tmpDir),
+		"bolt": bolt,
+	}
+}
+
+func TestStore_SaveLoadAppendDelete(t *testing.T) {
+	for name, store := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Load("alice"); err != ErrNotFound {
+				t.Fatalf("Expected ErrNotFound for missing user, got %v", err)
+			}
+
+			now := time.Now().Truncate(time.Second)
+			mem := newMemory("alice")
+			thread := mem.EnsureThread(types.DefaultThread)
+			thread.Summaries = []types.Summary{{Content: "summary", End: 1}}
+			thread.Messages = append(thread.Messages,
+				types.Message{Role: "user", Content: "Hello", Timestamp: now},
+				types.Message{Role: "assistant", Content: "Hi", Timestamp: now},
+			)
+			if err := store.Save(mem); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+
+			msg := types.Message{Role: "user", Content: "Again", Timestamp: now}
+			thread.Messages = append(thread.Messages, msg)
+			mem.JournalSeq++
+			entry := Entry{Seq: mem.JournalSeq, Kind: EntryMessage, Message: &msg}
+
+			// 其他会话的消息保存在各自的会话中
+			work := types.Message{Role: "user", Content: "Work item", Timestamp: now}
+			mem.EnsureThread("work").Messages = append(mem.EnsureThread("work").Messages, work)
+			mem.JournalSeq++
+			workEntry := Entry{Seq: mem.JournalSeq, Kind: EntryMessage, Thread: "work", Message: &work}
+			if err := store.Append(mem, entry, workEntry); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+
+			loaded, err := store.Load("alice")
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			def := loaded.Thread(types.DefaultThread)
+			if len(def.Messages) != 3 || def.Messages[2].Content != "Again" {
+				t.Errorf("Unexpected messages after append: %+v", def.Messages)
+			}
+			if len(def.Summaries) != 1 || def.Summaries[0].Content != "summary" {
+				t.Errorf("Expected summary to survive, got %+v", def.Summaries)
+			}
+			if w := loaded.Thread("work"); w == nil || len(w.Messages) != 1 || w.Messages[0].Content != "Work item" {
+				t.Errorf("Expected work thread to be replayed, got %+v", w)
+			}
+
+			// 改写历史后保存应覆盖旧消息，快照中的会话在压缩后仍然独立
+			def.Messages = def.Messages[1:]
+			if err := store.Save(loaded); err != nil {
+				t.Fatalf("Save after rewrite failed: %v", err)
+			}
+			reloaded, err := store.Load("alice")
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if def := reloaded.Thread(types.DefaultThread); len(def.Messages) != 2 || def.Messages[0].Content != "Hi" {
+				t.Errorf("Unexpected messages after rewrite: %+v", def.Messages)
+			}
+			if w := reloaded.Thread("work"); w == nil || len(w.Messages) != 1 {
+				t.Errorf("Expected work thread in snapshot, got %+v", w)
+			}
+
+			if err := store.Delete("alice"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if _, err := store.Load("alice"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound after delete, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_JournalCompaction(t *testing.T) {
+	for name, store := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			switch s := store.(type) {
+			case *YAMLStore:
+				s.CompactEvery = 3
+			case *BoltStore:
+				s.CompactEvery = 3
+			}
+
+			mem := newMemory("bob")
+			thread := mem.EnsureThread(types.DefaultThread)
+			if err := store.Save(mem); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+
+			for i := 0; i < 5; i++ {
+				msg := types.Message{Role: "user", Content: "message", Timestamp: time.Now()}
+				thread.Messages = append(thread.Messages, msg)
+				mem.JournalSeq++
+				entry := Entry{Seq: mem.JournalSeq, Kind: EntryMessage, Message: &msg, ContextSize: i}
+				if err := store.Append(mem, entry); err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+			}
+
+			reflection := types.Reflection{Content: "reflection", Importance: 7}
+			mem.Reflections = append(mem.Reflections, reflection)
+			summary := types.Summary{Content: "summary", Start: 0, End: 3}
+			AddSummary(thread, summary)
+			thread.ContextSize = 9
+			mem.JournalSeq++
+			s1 := Entry{Seq: mem.JournalSeq, Kind: EntrySummary, Summary: &summary, ContextSize: 9}
+			mem.JournalSeq++
+			s2 := Entry{Seq: mem.JournalSeq, Kind: EntryReflection, Reflection: &reflection, ContextSize: 9}
+			if err := store.Append(mem, s1, s2); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+
+			loaded, err := store.Load("bob")
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			lt := loaded.Thread(types.DefaultThread)
+			if len(lt.Messages) != 5 {
+				t.Errorf("Expected 5 messages after replay, got %d", len(lt.Messages))
+			}
+			if len(lt.Summaries) != 1 || len(loaded.Reflections) != 1 {
+				t.Errorf("Summary or reflection not replayed: %+v", loaded)
+			}
+			if loaded.JournalSeq != mem.JournalSeq || lt.ContextSize != 9 {
+				t.Errorf("Expected seq %d and context size 9, got %d and %d",
+					mem.JournalSeq, loaded.JournalSeq, lt.ContextSize)
+			}
+		})
+	}
+}
+
+func TestYAMLStore_ReplaySkipsEntriesInSnapshot(t *testing.T) {
+	store := NewYAMLStore(t.TempDir())
+
+	msg := types.Message{Role: "user", Content: "Hello", Timestamp: time.Now()}
+	mem := newMemory("carol")
+	thread := mem.EnsureThread(types.DefaultThread)
+	thread.Messages = append(thread.Messages, msg)
+	mem.JournalSeq = 1
+	if err := store.Append(mem, Entry{Seq: 1, Kind: EntryMessage, Message: &msg}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	// 模拟快照已写入但日志尚未删除时崩溃
+	journal, err := os.ReadFile(store.JournalPath("carol"))
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	if err := store.Save(mem); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := os.WriteFile(store.JournalPath("carol"), journal, 0644); err != nil {
+		t.Fatalf("restore journal: %v", err)
+	}
+
+	loaded, err := store.Load("carol")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if n := len(loaded.Thread(types.DefaultThread).Messages); n != 1 {
+		t.Errorf("Expected journal entry already in snapshot to be skipped, got %d messages", n)
+	}
+}
+
+func TestYAMLStore_AppendAfterTornWrite(t *testing.T) {
+	store := NewYAMLStore(t.TempDir())
+	mem := newMemory("dave")
+	first := types.Message{ID: "m1", Role: "user", Content: "Hello", Timestamp: time.Now()}
+	if err := store.Append(mem, Entry{Seq: 1, Kind: EntryMessage, Message: &first}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	// 模拟写入第二个条目时崩溃，日志末尾只留下半行
+	f, err := os.OpenFile(store.JournalPath("dave"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	f.WriteString(`{"seq":2,"kind":"message","message":{"id":"m2","ro`)
+	f.Close()
+
+	loaded, err := store.Load("dave")
+	if err != nil {
+		t.Fatalf("Load with torn tail failed: %v", err)
+	}
+	second := types.Message{ID: "m2", ParentID: "m1", Role: "assistant", Content: "Hi", Timestamp: time.Now()}
+	if err := store.Append(loaded, Entry{Seq: 2, Kind: EntryMessage, Message: &second}); err != nil {
+		t.Fatalf("Append after torn write failed: %v", err)
+	}
+
+	loaded, err = store.Load("dave")
+	if err != nil {
+		t.Fatalf("Load after append failed: %v", err)
+	}
+	if msgs := loaded.Thread(types.DefaultThread).Messages; len(msgs) != 2 || msgs[1].ID != "m2" {
+		t.Errorf("Expected both entries after repairing the journal, got %+v", msgs)
+	}
+}
+
+func TestArchiveMessages(t *testing.T) {
+	mem := newMemory("frank")
+	thread := mem.EnsureThread(types.DefaultThread)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		thread.Messages = append(thread.Messages, types.Message{ID: id, ParentID: thread.Head, Role: "user", Content: id})
+		thread.Head = id
+	}
+
+	// 归档段必须接在已归档的消息之后，并与会话开头的消息一致
+	if err := ArchiveMessages(thread, types.Segment{Name: "s", First: 0, Count: 2, StartID: "a", EndID: "c"}); err == nil {
+		t.Fatal("Expected error for mismatched segment")
+	}
+	if err := ArchiveMessages(thread, types.Segment{Name: "s", First: 0, Count: 2, StartID: "a", EndID: "b"}); err != nil {
+		t.Fatalf("ArchiveMessages failed: %v", err)
+	}
+	if err := ArchiveMessages(thread, types.Segment{Name: "s2", First: 0, Count: 1, StartID: "c", EndID: "c"}); err == nil {
+		t.Fatal("Expected error for segment overlapping the archive")
+	}
+
+	if thread.Archived() != 2 || len(thread.Messages) != 2 || thread.Messages[0].ID != "c" {
+		t.Fatalf("Unexpected thread after archiving: %+v", thread)
+	}
+	set := thread.BranchSet(thread.Head)
+	if !set.FromArchive() || !set.Contains("a") || !set.Contains("d") {
+		t.Errorf("Expected branch continuing from the archive, got %+v", set)
+	}
+}
+
+func TestAddFact(t *testing.T) {
+	mem := newMemory("grace")
+	now := time.Now()
+	fact := func(id, value string, at time.Time) types.Fact {
+		return types.Fact{ID: id, Subject: "用户", Attribute: "饮食", Value: value, Confidence: 0.6, CreatedAt: at, UpdatedAt: at}
+	}
+
+	AddFact(mem, fact("a", "素食", now))
+	// 相同的值只确认已有事实
+	confirmed := fact("b", " 素食 ", now.Add(time.Hour))
+	confirmed.Subject, confirmed.Confidence = "用户 ", 0.9
+	if id := AddFact(mem, confirmed); id != "a" || len(mem.Facts) != 1 || mem.Facts[0].Confidence != 0.9 || !mem.Facts[0].UpdatedAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected fact a to be confirmed, got %s %+v", id, mem.Facts)
+	}
+
+	// 冲突的新值取代旧值，冲突的旧值（例如导入的）直接成为历史
+	AddFact(mem, fact("c", "纯素", now.Add(2*time.Hour)))
+	AddFact(mem, fact("d", "不挑食", now.Add(-time.Hour)))
+	if len(mem.Facts) != 3 || mem.Facts[0].SupersededBy != "c" || !mem.Facts[1].Active() || mem.Facts[2].SupersededBy != "c" {
+		t.Errorf("Expected only fact c to stay active, got %+v", mem.Facts)
+	}
+
+	// 通过日志重放得到相同的结果
+	replayed := newMemory("grace")
+	for i, f := range []types.Fact{fact("a", "素食", now), confirmed, fact("c", "纯素", now.Add(2*time.Hour))} {
+		entry := Entry{Seq: uint64(i + 1), Kind: EntryFact, Fact: &f}
+		if err := entry.Apply(replayed); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+	if len(replayed.Facts) != 2 || replayed.Facts[0].SupersededBy != "c" || replayed.Facts[0].Confidence != 0.9 {
+		t.Errorf("Unexpected facts after replay: %+v", replayed.Facts)
+	}
+}
+
+func TestYAMLStore_DetectsExternalModification(t *testing.T) {
+	tmpDir := t.TempDir()
+	store1 := NewYAMLStore(tmpDir)
+	store2 := NewYAMLStore(tmpDir)
+
+	mem := newMemory("dave")
+	if err := store1.Save(mem); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if _, err := store2.Load("dave"); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	mem.EnsureThread(types.DefaultThread).Summaries = []types.Summary{{Content: "changed by store1"}}
+	if err := store1.Save(mem); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if err := store2.Save(newMemory("dave")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+
+	// 临时文件不应残留
+	matches, _ := filepath.Glob(filepath.Join(tmpDir, ".dave.yaml.tmp-*"))
+	if len(matches) != 0 {
+		t.Errorf("Temp files left behind: %v", matches)
+	}
+}
+
+func TestStore_MigratesLegacySingleThread(t *testing.T) {
+	tmpDir := t.TempDir()
+	legacy := "user_id: erin\nsummary: old summary\ncontext_size: 42\nmessages:\n" +
+		strings.Repeat("  - role: user\n    content: hi\n", 7)
+	if err := os.WriteFile(filepath.Join(tmpDir, "erin.yaml"), []byte(legacy), 0644); err != nil {
+		t.Fatalf("write legacy file: %v", err)
+	}
+	journal := `{"seq":1,"kind":"message","message":{"role":"assistant","content":"hello"},"context_size":50}` + "\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, "erin.journal"), []byte(journal), 0644); err != nil {
+		t.Fatalf("write legacy journal: %v", err)
+	}
+
+	mem, err := NewYAMLStore(tmpDir).Load("erin")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(mem.Messages) != 0 || mem.Summary != "" || len(mem.Threads) != 1 {
+		t.Fatalf("Expected legacy fields moved into a thread, got %+v", mem)
+	}
+	thread := mem.Thread(types.DefaultThread)
+	if len(thread.Messages) != 8 || thread.ContextSize != 50 {
+		t.Errorf("Unexpected default thread: %+v", thread)
+	}
+	if len(thread.Summaries) != 1 || thread.Summaries[0].End != 2 || thread.Summaries[0].EndID != thread.Messages[1].ID {
+		t.Errorf("Expected legacy summary covering first 2 messages, got %+v", thread.Summaries)
+	}
+
+	// 旧版本的消息连成一个分支，且每次加载得到相同的ID
+	if branch := thread.Branch(); len(branch) != 8 || branch[7].Content != "hello" {
+		t.Errorf("Expected legacy messages linked into one branch, got %+v", branch)
+	}
+	again, err := NewYAMLStore(tmpDir).Load("erin")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if again.Thread(types.DefaultThread).Head != thread.Head {
+		t.Errorf("Legacy message IDs should be stable across loads")
+	}
+}
+
+func TestMigrations_Registry(t *testing.T) {
+	version := 1
+	for _, m := range Migrations() {
+		if m.Version != version+1 || m.Description == "" || m.Apply == nil {
+			t.Fatalf("Migrations must be registered in version order, got %+v after version %d", m, version)
+		}
+		version = m.Version
+	}
+	if version != CurrentSchemaVersion {
+		t.Errorf("Last migration upgrades to %d, CurrentSchemaVersion is %d", version, CurrentSchemaVersion)
+	}
+}
+
+func TestYAMLStore_MigrateDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	legacy := "user_id: frank\nsummary: old summary\nmessages:\n" +
+		strings.Repeat("  - role: user\n    content: hi\n", 6)
+	if err := os.WriteFile(filepath.Join(tmpDir, "frank.yaml"), []byte(legacy), 0644); err != nil {
+		t.Fatalf("write legacy file: %v", err)
+	}
+	store := NewYAMLStore(tmpDir)
+	current := newMemory("grace")
+	current.EnsureThread(types.DefaultThread)
+	if err := store.Save(current); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	users, err := store.Users()
+	if err != nil {
+		t.Fatalf("Users failed: %v", err)
+	}
+	if len(users) != 2 || users[0] != "frank" || users[1] != "grace" {
+		t.Fatalf("Expected users [frank grace], got %v", users)
+	}
+
+	// 预演只生成报告，不修改文件
+	report, err := store.Migrate("frank", true)
+	if err != nil {
+		t.Fatalf("dry-run Migrate failed: %v", err)
+	}
+	if !report.Pending() || report.FromVersion != 0 || report.ToVersion != CurrentSchemaVersion || len(report.Steps) != 2 {
+		t.Errorf("Unexpected dry-run report: %+v", report)
+	}
+	if data, _ := os.ReadFile(store.Path("frank")); string(data) != legacy {
+		t.Errorf("Dry run must not rewrite the file, got:\n%s", data)
+	}
+
+	if _, err := store.Migrate("frank", false); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	data, _ := os.ReadFile(store.Path("frank"))
+	if !strings.Contains(string(data), fmt.Sprintf("schema_version: %d", CurrentSchemaVersion)) || strings.Contains(string(data), "\nsummary:") {
+		t.Errorf("Expected migrated snapshot in current format, got:\n%s", data)
+	}
+	again, err := store.Migrate("frank", false)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if again.Pending() || len(again.Steps) != 0 {
+		t.Errorf("Expected migrated file to be up to date, got %+v", again)
+	}
+
+	if report, err := store.Migrate("grace", true); err != nil || report.Pending() {
+		t.Errorf("Expected saved memory to be current, got %+v, %v", report, err)
+	}
+}
+
+func TestStore_RejectsNewerSchema(t *testing.T) {
+	tmpDir := t.TempDir()
+	future := fmt.Sprintf("schema_version: %d\nuser_id: heidi\n", CurrentSchemaVersion+1)
+	if err := os.WriteFile(filepath.Join(tmpDir, "heidi.yaml"), []byte(future), 0644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if _, err := NewYAMLStore(tmpDir).Load("heidi"); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestBoltStore_Users(t *testing.T) {
+	store, err := OpenBoltStore(filepath.Join(t.TempDir(), "memories.db"))
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed: %v", err)
+	}
+	defer store.Close()
+
+	for _, id := range []string{"ivan", "judy"} {
+		if err := store.Save(newMemory(id)); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+	users, err := store.Users()
+	if err != nil || len(users) != 2 || users[0] != "ivan" {
+		t.Fatalf("Expected users [ivan judy], got %v, %v", users, err)
+	}
+	report, err := store.Migrate("ivan", false)
+	if err != nil || report.Pending() || report.FromVersion != CurrentSchemaVersion {
+		t.Errorf("Expected saved memory to be current, got %+v, %v", report, err)
+	}
+}
+
+func testKeyring(t *testing.T, seeds ...byte) *Keyring {
+	t.Helper()
+	keys := make([][]byte, len(seeds))
+	for i, seed := range seeds {
+		keys[i] = bytes.Repeat([]byte{seed}, 32)
+	}
+	k, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	return k
+}
+
+func setKeys(store Store, keys *Keyring) {
+	switch s := store.(type) {
+	case *YAMLStore:
+		s.Keys = keys
+	case *BoltStore:
+		s.Keys = keys
+	}
+}
+
+func TestStore_EncryptionAndKeyRotation(t *testing.T) {
+	for name, store := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			blobs := store.(BlobStore)
+
+			// 启用加密之前写入的明文记忆
+			mem := newMemory("kate")
+			thread := mem.EnsureThread(types.DefaultThread)
+			thread.Messages = append(thread.Messages, types.Message{ID: "a", Role: "user", Content: "secret plans"})
+			thread.Head = "a"
+			if err := store.Save(mem); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			if err := blobs.AppendBlob("kate", "vectors.bin", []byte("plain-")); err != nil {
+				t.Fatalf("AppendBlob failed: %v", err)
+			}
+
+			// 启用加密后明文仍可读取，新的日志和附加数据加密写入
+			setKeys(store, testKeyring(t, 1))
+			msg := types.Message{ID: "b", ParentID: "a", Role: "assistant", Content: "more secrets"}
+			thread.Messages = append(thread.Messages, msg)
+			mem.JournalSeq++
+			if err := store.Append(mem, Entry{Seq: mem.JournalSeq, Kind: EntryMessage, Message: &msg}); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+			if err := blobs.AppendBlob("kate", "vectors.bin", []byte("sealed")); err != nil {
+				t.Fatalf("AppendBlob failed: %v", err)
+			}
+			loaded, err := store.Load("kate")
+			if err != nil {
+				t.Fatalf("Load of mixed plaintext and encrypted memory failed: %v", err)
+			}
+			if n := len(loaded.Thread(types.DefaultThread).Messages); n != 2 {
+				t.Errorf("Expected 2 messages, got %d", n)
+			}
+			if data, err := blobs.LoadBlob("kate", "vectors.bin"); err != nil || string(data) != "plain-sealed" {
+				t.Errorf("Expected blob rewritten with both chunks, got %q, %v", data, err)
+			}
+			if err := store.Save(loaded); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			if ys, ok := store.(*YAMLStore); ok {
+				data, _ := os.ReadFile(ys.Path("kate"))
+				if !encrypted(data) || strings.Contains(string(data), "secret") {
+					t.Errorf("Expected encrypted snapshot on disk")
+				}
+			}
+
+			// 没有密钥时无法读取
+			setKeys(store, nil)
+			if _, err := store.Load("kate"); !errors.Is(err, ErrNoKey) {
+				t.Errorf("Expected ErrNoKey without keys, got %v", err)
+			}
+
+			// 轮换：新密钥在前、保留旧密钥，保存后只需新密钥
+			setKeys(store, testKeyring(t, 2, 1))
+			rotated, err := store.Load("kate")
+			if err != nil {
+				t.Fatalf("Load with rotated keyring failed: %v", err)
+			}
+			if err := store.Save(rotated); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			if err := blobs.SaveBlob("kate", "vectors.bin", []byte("rotated")); err != nil {
+				t.Fatalf("SaveBlob failed: %v", err)
+			}
+			setKeys(store, testKeyring(t, 2))
+			again, err := store.Load("kate")
+			if err != nil {
+				t.Fatalf("Expected memory re-encrypted with the new key, got %v", err)
+			}
+			if b := again.Thread(types.DefaultThread).Branch(); len(b) != 2 || b[1].Content != "more secrets" {
+				t.Errorf("Unexpected branch after rotation: %+v", b)
+			}
+			if data, err := blobs.LoadBlob("kate", "vectors.bin"); err != nil || string(data) != "rotated" {
+				t.Errorf("Unexpected blob after rotation: %q, %v", data, err)
+			}
+
+			// 离线迁移按当前密钥重写全部数据
+			migrator := store.(Migrator)
+			setKeys(store, testKeyring(t, 3, 2))
+			report, err := migrator.Migrate("kate", false)
+			if err != nil || !report.Reencrypt || report.FromVersion != CurrentSchemaVersion {
+				t.Fatalf("Expected re-encryption report, got %+v, %v", report, err)
+			}
+			setKeys(store, testKeyring(t, 3))
+			if _, err := store.Load("kate"); err != nil {
+				t.Errorf("Expected memory readable with only the new key, got %v", err)
+			}
+			if data, err := blobs.LoadBlob("kate", "vectors.bin"); err != nil || string(data) != "rotated" {
+				t.Errorf("Expected blob re-encrypted by migrate, got %q, %v", data, err)
+			}
+			if report, err := migrator.Migrate("kate", true); err != nil || report.Pending() {
+				t.Errorf("Expected nothing pending after migrate, got %+v, %v", report, err)
+			}
+
+			// 加载时发现旧密钥的数据，下一次追加就整体重写，不必等压缩或离线迁移
+			setKeys(store, testKeyring(t, 4, 3))
+			current, err := store.Load("kate")
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			reply := types.Message{ID: "c", ParentID: "b", Role: "user", Content: "latest secret"}
+			current.Thread(types.DefaultThread).Messages = append(current.Thread(types.DefaultThread).Messages, reply)
+			current.JournalSeq++
+			if err := store.Append(current, Entry{Seq: current.JournalSeq, Kind: EntryMessage, Message: &reply}); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+			setKeys(store, testKeyring(t, 4))
+			if again, err := store.Load("kate"); err != nil || len(again.Thread(types.DefaultThread).Messages) != 3 {
+				t.Errorf("Expected append after load to re-encrypt with the new key, got %v", err)
+			}
+			if data, err := blobs.LoadBlob("kate", "vectors.bin"); err != nil || string(data) != "rotated" {
+				t.Errorf("Expected blob re-encrypted by append after load, got %q, %v", data, err)
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := blobs.DeleteBlob("kate", "vectors.bin"); err != nil {
+					t.Fatalf("DeleteBlob failed: %v", err)
+				}
+			}
+			if _, err := blobs.LoadBlob("kate", "vectors.bin"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for deleted blob, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	old := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 16))
+	k, err := ParseKeyring("# 主密钥在前\n" + key + "\n" + old + ",\n")
+	if err != nil {
+		t.Fatalf("ParseKeyring failed: %v", err)
+	}
+	if len(k.keys) != 2 || k.primary != keyID(bytes.Repeat([]byte{7}, 32)) {
+		t.Errorf("Unexpected keyring: primary %x, %d keys", k.primary, len(k.keys))
+	}
+
+	sealed, err := k.seal([]byte("hello"))
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := k.open(sealed); err == nil {
+		t.Errorf("Expected tampered envelope to fail authentication")
+	}
+
+	for _, bad := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseKeyring(bad); err == nil {
+			t.Errorf("Expected error for keyring %q", bad)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Heng-Bian/memory-chat/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// YAMLStore 将每个用户的记忆快照保存为目录下的 {user_id}.yaml 文件，
+// 增量变更追加到 {user_id}.journal（每行一个JSON条目）。
+// 每次读写都持有 {user_id}.lock 上的跨进程建议锁，快照通过
+// 临时文件 + fsync + 重命名原子替换
+type YAMLStore struct {
+	dir string
+
+	// CompactEvery 日志条目数达到该值时重写快照
+	CompactEvery int
+
+	// Keys 设置后快照、日志和附加数据都加密写入；为 nil 时写入明文。
+	// 读取时明文和加密的文件都可以识别，因此可以在已有目录上启用或轮换密钥
+	Keys *Keyring
+
+	mu         sync.Mutex
+	journalLen map[string]int
+	seen       map[string]fileState
+	// stale 记录加载时快照或附加数据不是用当前密钥配置写入的用户，下次写入时整体重写
+	stale map[string]bool
+}
+
+// fileState 记录上次读写后用户文件的状态，用于发现其他进程的修改
+type fileState struct {
+	snapshotSize    int64
+	snapshotModTime time.Time
+	journalSize     int64
+}
+
+// NewYAMLStore 创建基于YAML文件的存储
+func NewYAMLStore(dir string) *YAMLStore {
+	return &YAMLStore{
+		dir:          dir,
+		CompactEvery: DefaultCompactEvery,
+		journalLen:   make(map[string]int),
+		seen:         make(map[string]fileState),
+		stale:        make(map[string]bool),
+	}
+}
+
+// Path 返回用户记忆快照文件路径
+func (s *YAMLStore) Path(userID string) string {
+	return filepath.Join(s.dir, userID+".yaml")
+}
+
+// JournalPath 返回用户追加日志文件路径
+func (s *YAMLStore) JournalPath(userID string) string {
+	return filepath.Join(s.dir, userID+".journal")
+}
+
+// blobDir 返回用户附加数据目录
+func (s *YAMLStore) blobDir(userID string) string {
+	return filepath.Join(s.dir, userID+".blobs")
+}
+
+// blobPath 返回用户附加数据文件路径
+func (s *YAMLStore) blobPath(userID, name string) string {
+	return filepath.Join(s.blobDir(userID), name)
+}
+
+// lockPath 返回用户锁文件路径
+func (s *YAMLStore) lockPath(userID string) string {
+	return filepath.Join(s.dir, userID+".lock")
+}
+
+// lock 获取用户文件的跨进程锁
+func (s *YAMLStore) lock(userID string) (func(), error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, fmt.Errorf("create directory: %w", err)
+	}
+	return lockFile(s.lockPath(userID))
+}
+
+// Load 读取YAML快照，升级旧版本格式后重放追加日志
+func (s *YAMLStore) Load(userID string) (*types.ConversationMemory, error) {
+	unlock, err := s.lock(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mem, report, n, err := s.load(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.remember(userID, n); err != nil {
+		return nil, err
+	}
+	if mem == nil {
+		return nil, ErrNotFound
+	}
+
+	blobs, err := s.staleBlobs(userID)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.stale[userID] = report.Reencrypt || len(blobs) > 0
+	s.mu.Unlock()
+	return mem, nil
+}
+
+// load 在已持有锁时读取快照、执行迁移并重放日志，返回记忆、迁移报告和日志条目数。
+// 快照和日志都不存在时返回 nil 记忆
+func (s *YAMLStore) load(userID string) (*types.ConversationMemory, *MigrationReport, int, error) {
+	mem := newMemory(userID)
+	found, stale := false, false
+
+	data, err := os.ReadFile(s.Path(userID))
+	switch {
+	case err == nil:
+		stale = !s.Keys.current(data)
+		if data, err = s.Keys.open(data); err != nil {
+			return nil, nil, 0, fmt.Errorf("read memory file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, mem); err != nil {
+			return nil, nil, 0, fmt.Errorf("unmarshal memory: %w", err)
+		}
+		found = true
+	case !os.IsNotExist(err):
+		return nil, nil, 0, fmt.Errorf("read memory file: %w", err)
+	}
+
+	report := &MigrationReport{UserID: userID, FromVersion: mem.SchemaVersion, Reencrypt: stale}
+	if report.Steps, err = Migrate(mem); err != nil {
+		return nil, nil, 0, fmt.Errorf("migrate %s: %w", userID, err)
+	}
+	report.ToVersion = mem.SchemaVersion
+
+	n := 0
+	f, err := os.Open(s.JournalPath(userID))
+	switch {
+	case err == nil:
+		defer f.Close()
+		if n, err = replayJournal(f, mem, s.Keys); err != nil {
+			return nil, nil, 0, err
+		}
+		found = true
+	case !os.IsNotExist(err):
+		return nil, nil, 0, fmt.Errorf("open journal: %w", err)
+	}
+
+	if !found {
+		return nil, nil, n, nil
+	}
+	return mem, report, n, nil
+}
+
+// Save 原子写入完整快照并清空追加日志
+func (s *YAMLStore) Save(mem *types.ConversationMemory) error {
+	unlock, err := s.lock(mem.UserID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.checkUnchanged(mem.UserID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	stale := s.stale[mem.UserID]
+	s.mu.Unlock()
+	if stale {
+		return s.reencryptLocked(mem)
+	}
+	return s.saveLocked(mem)
+}
+
+// saveLocked 在已持有锁时写入快照
+func (s *YAMLStore) saveLocked(mem *types.ConversationMemory) error {
+	snapshot := *mem
+	snapshot.SchemaVersion = CurrentSchemaVersion
+	data, err := yaml.Marshal(&snapshot)
+	if err != nil {
+		return fmt.Errorf("marshal memory: %w", err)
+	}
+	if data, err = s.Keys.seal(data); err != nil {
+		return fmt.Errorf("encrypt memory: %w", err)
+	}
+
+	if err := writeFileAtomic(s.Path(mem.UserID), data, 0644); err != nil {
+		return fmt.Errorf("write memory file: %w", err)
+	}
+
+	// 快照已包含所有日志条目（JournalSeq），日志可以安全删除
+	if err := os.Remove(s.JournalPath(mem.UserID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove journal: %w", err)
+	}
+
+	return s.remember(mem.UserID, 0)
+}
+
+// reencryptLocked 在已持有锁时写入完整快照，并按当前密钥配置重写附加数据。
+// 只追加日志的话，加载时发现的明文或旧密钥快照会一直留在磁盘上
+func (s *YAMLStore) reencryptLocked(mem *types.ConversationMemory) error {
+	blobs, err := s.staleBlobs(mem.UserID)
+	if err != nil {
+		return err
+	}
+	if err := s.saveLocked(mem); err != nil {
+		return err
+	}
+	if err := s.rewriteBlobs(mem.UserID, blobs); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.stale, mem.UserID)
+	s.mu.Unlock()
+	return nil
+}
+
+// Append 追加日志条目并 fsync，日志过长时压缩为快照
+func (s *YAMLStore) Append(mem *types.ConversationMemory, entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	unlock, err := s.lock(mem.UserID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.checkUnchanged(mem.UserID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	n := s.journalLen[mem.UserID] + len(entries)
+	stale := s.stale[mem.UserID]
+	s.mu.Unlock()
+	if stale {
+		return s.reencryptLocked(mem)
+	}
+	if n >= s.CompactEvery {
+		return s.saveLocked(mem)
+	}
+
+	data, err := encodeEntries(entries, s.Keys)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.JournalPath(mem.UserID), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	defer f.Close()
+
+	if err := trimPartialLine(f); err != nil {
+		return fmt.Errorf("repair journal: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+
+	return s.remember(mem.UserID, n)
+}
+
+// trimPartialLine 截掉日志末尾不完整的一行。写入中途崩溃留下的半行在回放时被忽略，
+// 但新条目如果直接追加在其后，会合成一行无法解析的内容，导致之后每次加载都失败
+func trimPartialLine(f *os.File) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	end := st.Size()
+	for end > 0 {
+		n := min(int64(len(buf)), end)
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end += int64(i) + 1 - n
+			break
+		}
+		end -= n
+	}
+	if end == st.Size() {
+		return nil
+	}
+	return f.Truncate(end)
+}
+
+// Delete 删除用户快照、日志和附加数据
+func (s *YAMLStore) Delete(userID string) error {
+	unlock, err := s.lock(userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, path := range []string{s.Path(userID), s.JournalPath(userID)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove memory file: %w", err)
+		}
+	}
+	if err := os.RemoveAll(s.blobDir(userID)); err != nil {
+		return fmt.Errorf("remove blobs: %w", err)
+	}
+
+	s.mu.Lock()
+	delete(s.stale, userID)
+	s.mu.Unlock()
+	return s.remember(userID, 0)
+}
+
+// Users 根据目录中的快照和日志文件列出所有用户
+func (s *YAMLStore) Users() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read memory directory: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var users []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		ext := filepath.Ext(name)
+		if ext != ".yaml" && ext != ".journal" {
+			continue
+		}
+		if id := strings.TrimSuffix(name, ext); !seen[id] {
+			seen[id] = true
+			users = append(users, id)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// Migrate 升级用户记忆并重写快照，日志中的条目会一并写入快照，
+// 不是用当前密钥配置写入的附加数据也会重写
+func (s *YAMLStore) Migrate(userID string, dryRun bool) (*MigrationReport, error) {
+	unlock, err := s.lock(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mem, report, _, err := s.load(userID)
+	if err != nil {
+		return nil, err
+	}
+	if mem == nil {
+		return nil, ErrNotFound
+	}
+	blobs, err := s.staleBlobs(userID)
+	if err != nil {
+		return nil, err
+	}
+	report.Reencrypt = report.Reencrypt || len(blobs) > 0
+	if dryRun || !report.Pending() {
+		return report, nil
+	}
+
+	if err := s.saveLocked(mem); err != nil {
+		return nil, err
+	}
+	if err := s.rewriteBlobs(userID, blobs); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	delete(s.stale, userID)
+	s.mu.Unlock()
+	return report, nil
+}
+
+// rewriteBlobs 在已持有锁时按当前密钥配置重写附加数据
+func (s *YAMLStore) rewriteBlobs(userID string, names []string) error {
+	for _, name := range names {
+		data, err := s.readBlob(s.blobPath(userID, name))
+		if err != nil {
+			return err
+		}
+		if err := s.writeBlob(userID, name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleBlobs 返回需要按当前密钥配置重写的附加数据名
+func (s *YAMLStore) staleBlobs(userID string) ([]string, error) {
+	entries, err := os.ReadDir(s.blobDir(userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read blob directory: %w", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		stale, err := s.blobStale(s.blobPath(userID, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if stale {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// LoadBlob 读取并解密 {user_id}.blobs/{name}
+func (s *YAMLStore) LoadBlob(userID, name string) ([]byte, error) {
+	unlock, err := s.lock(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	data, err := s.readBlob(s.blobPath(userID, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// readBlob 读取附加数据文件并解密
+func (s *YAMLStore) readBlob(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("read blob: %w", err)
+	}
+	if data, err = s.Keys.open(data); err != nil {
+		return nil, fmt.Errorf("read blob: %w", err)
+	}
+	return data, nil
+}
+
+// SaveBlob 原子替换附加数据文件
+func (s *YAMLStore) SaveBlob(userID, name string, data []byte) error {
+	unlock, err := s.lock(userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return s.writeBlob(userID, name, data)
+}
+
+// writeBlob 在已持有锁时加密并原子替换附加数据文件
+func (s *YAMLStore) writeBlob(userID, name string, data []byte) error {
+	if err := os.MkdirAll(s.blobDir(userID), 0755); err != nil {
+		return fmt.Errorf("create blob directory: %w", err)
+	}
+	data, err := s.Keys.seal(data)
+	if err != nil {
+		return fmt.Errorf("encrypt blob: %w", err)
+	}
+	if err := writeFileAtomic(s.blobPath(userID, name), data, 0644); err != nil {
+		return fmt.Errorf("write blob: %w", err)
+	}
+	return nil
+}
+
+// AppendBlob 追加到附加数据文件末尾并 fsync。加密时每次追加一个独立的信封；
+// 文件不是用当前密钥配置写入的（启用加密前的明文或轮换前的密钥）时整体重写
+func (s *YAMLStore) AppendBlob(userID, name string, data []byte) error {
+	unlock, err := s.lock(userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := s.blobPath(userID, name)
+	stale, err := s.blobStale(path)
+	if err != nil {
+		return err
+	}
+	if stale {
+		old, err := s.readBlob(path)
+		if err != nil {
+			return err
+		}
+		return s.writeBlob(userID, name, append(old, data...))
+	}
+
+	if err := os.MkdirAll(s.blobDir(userID), 0755); err != nil {
+		return fmt.Errorf("create blob directory: %w", err)
+	}
+	if data, err = s.Keys.seal(data); err != nil {
+		return fmt.Errorf("encrypt blob: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open blob: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("write blob: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync blob: %w", err)
+	}
+	return nil
+}
+
+// DeleteBlob 删除附加数据文件
+func (s *YAMLStore) DeleteBlob(userID, name string) error {
+	unlock, err := s.lock(userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(s.blobPath(userID, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove blob: %w", err)
+	}
+	return nil
+}
+
+// blobStale 检查已有的附加数据文件是否需要按当前密钥配置重写
+func (s *YAMLStore) blobStale(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("open blob: %w", err)
+	}
+	defer f.Close()
+
+	head := make([]byte, envelopeHeadLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("read blob: %w", err)
+	}
+	return n > 0 && !s.Keys.current(head[:n]), nil
+}
+
+// Close YAML存储无需释放资源
+func (s *YAMLStore) Close() error {
+	return nil
+}
+
+// stat 读取用户快照和日志的当前状态
+func (s *YAMLStore) stat(userID string) (fileState, error) {
+	var st fileState
+
+	info, err := os.Stat(s.Path(userID))
+	switch {
+	case err == nil:
+		st.snapshotSize = info.Size()
+		st.snapshotModTime = info.ModTime()
+	case !os.IsNotExist(err):
+		return st, fmt.Errorf("stat memory file: %w", err)
+	}
+
+	info, err = os.Stat(s.JournalPath(userID))
+	switch {
+	case err == nil:
+		st.journalSize = info.Size()
+	case !os.IsNotExist(err):
+		return st, fmt.Errorf("stat journal: %w", err)
+	}
+
+	return st, nil
+}
+
+// remember 记录本进程最后一次读写后的文件状态和日志条目数
+func (s *YAMLStore) remember(userID string, journalLen int) error {
+	st, err := s.stat(userID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journalLen[userID] = journalLen
+	s.seen[userID] = st
+	return nil
+}
+
+// checkUnchanged 检查文件自上次读写后是否被其他进程修改。
+// 从未读写过的用户视为文件应当不存在
+func (s *YAMLStore) checkUnchanged(userID string) error {
+	st, err := s.stat(userID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	seen := s.seen[userID]
+	s.mu.Unlock()
+
+	if st.snapshotSize != seen.snapshotSize ||
+		!st.snapshotModTime.Equal(seen.snapshotModTime) ||
+		st.journalSize != seen.journalSize {
+		return fmt.Errorf("%w: %s", ErrConflict, s.Path(userID))
+	}
+	return nil
+}
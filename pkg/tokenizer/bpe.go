@@ -0,0 +1,167 @@
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Cl100kBase GPT-3.5 / GPT-4 使用的编码
+	Cl100kBase = "cl100k_base"
+	// O200kBase GPT-4o 及之后模型使用的编码
+	O200kBase = "o200k_base"
+)
+
+// 预分词正则。原始模式中的 \s+(?!\S) 需要零宽断言，RE2 不支持，
+// 这里只保留 \s+，在 split 中回退最后一个空白字符来等价实现
+var pretokenizers = map[string]*regexp.Regexp{
+	Cl100kBase: regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`),
+	O200kBase: regexp.MustCompile(`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+`),
+}
+
+// BPE 与 tiktoken 兼容的字节级BPE分词器
+type BPE struct {
+	ranks   map[string]int
+	pattern *regexp.Regexp
+}
+
+// LoadBPE 加载 tiktoken 格式的词表文件（每行 "base64(token) rank"）
+func LoadBPE(path, encoding string) (*BPE, error) {
+	pattern, ok := pretokenizers[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open vocabulary: %w", err)
+	}
+	defer f.Close()
+
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("vocabulary line %d: expected token and rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(string(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("vocabulary line %d: decode token: %w", line, err)
+		}
+		rank, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("vocabulary line %d: parse rank: %w", line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read vocabulary: %w", err)
+	}
+
+	return &BPE{ranks: ranks, pattern: pattern}, nil
+}
+
+// Count 返回文本编码后的token数
+func (b *BPE) Count(text string) int {
+	n := 0
+	for _, piece := range b.split(text) {
+		if _, ok := b.ranks[piece]; ok {
+			n++
+			continue
+		}
+		n += len(b.merge([]byte(piece)))
+	}
+	return n
+}
+
+// Encode 将文本编码为token序号
+func (b *BPE) Encode(text string) []int {
+	var ids []int
+	for _, piece := range b.split(text) {
+		if rank, ok := b.ranks[piece]; ok {
+			ids = append(ids, rank)
+			continue
+		}
+		for _, part := range b.merge([]byte(piece)) {
+			ids = append(ids, b.ranks[string(part)])
+		}
+	}
+	return ids
+}
+
+// split 按编码的预分词规则切分文本
+func (b *BPE) split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := b.pattern.FindStringIndex(text)
+		if loc == nil {
+			break
+		}
+		piece := text[loc[0]:loc[1]]
+
+		// 模拟 \s+(?!\S)：空白后紧跟非空白字符时，把最后一个空白留给下一个片段
+		if rest := text[loc[1]:]; rest != "" && isSpaceRun(piece) && utf8.RuneCountInString(piece) > 1 {
+			if next, _ := utf8.DecodeRuneInString(rest); !unicode.IsSpace(next) {
+				_, size := utf8.DecodeLastRuneInString(piece)
+				piece = piece[:len(piece)-size]
+			}
+		}
+
+		pieces = append(pieces, piece)
+		text = text[loc[0]+len(piece):]
+	}
+	return pieces
+}
+
+// isSpaceRun 判断片段是否由 \s+ 分支匹配（全为空白且不以换行结尾）
+func isSpaceRun(piece string) bool {
+	for _, r := range piece {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	last, _ := utf8.DecodeLastRuneInString(piece)
+	return last != '\r' && last != '\n'
+}
+
+// merge 对单个片段执行BPE合并，每次合并排名最低（最早学到）的相邻对
+func (b *BPE) merge(piece []byte) [][]byte {
+	// bounds[i] 是第 i 个部分的起始位置，最后一个元素为片段长度
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+
+	for len(bounds) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i < len(bounds)-2; i++ {
+			rank, ok := b.ranks[string(piece[bounds[i]:bounds[i+2]])]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+
+	parts := make([][]byte, len(bounds)-1)
+	for i := range parts {
+		parts[i] = piece[bounds[i]:bounds[i+1]]
+	}
+	return parts
+}
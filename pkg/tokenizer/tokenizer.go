@@ -0,0 +1,62 @@
+package tokenizer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// MessageOverhead 聊天格式中每条消息除内容外的开销（角色、分隔符等）
+const MessageOverhead = 4
+
+// Counter 计算文本的token数
+type Counter interface {
+	Count(text string) int
+}
+
+// Estimator 在没有词表时按字符类别估算token数：
+// 中日韩字符约1个token，其余文本约4字节1个token
+type Estimator struct{}
+
+// Count 估算token数
+func (Estimator) Count(text string) int {
+	tokens, other := 0, 0
+	for _, r := range text {
+		if isCJK(r) {
+			tokens++
+			continue
+		}
+		other += len(string(r))
+	}
+	return tokens + (other+3)/4
+}
+
+// isCJK 判断是否为中日韩字符
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// EncodingForModel 返回模型使用的编码名称
+func EncodingForModel(model string) string {
+	m := strings.ToLower(model)
+	switch {
+	case strings.HasPrefix(m, "gpt-4o"), strings.HasPrefix(m, "gpt-4.1"),
+		strings.HasPrefix(m, "gpt-5"), strings.HasPrefix(m, "o1"),
+		strings.HasPrefix(m, "o3"), strings.HasPrefix(m, "o4"):
+		return O200kBase
+	default:
+		return Cl100kBase
+	}
+}
+
+// ForModel 从 dir 中加载模型对应的词表文件 {encoding}.tiktoken。
+// 加载失败时返回 Estimator 以及失败原因，调用方可以选择只记录警告
+func ForModel(dir, model string) (Counter, error) {
+	encoding := EncodingForModel(model)
+	bpe, err := LoadBPE(filepath.Join(dir, encoding+".tiktoken"), encoding)
+	if err != nil {
+		return Estimator{}, fmt.Errorf("load %s vocabulary: %w", encoding, err)
+	}
+	return bpe, nil
+}
@@ -0,0 +1,80 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeVocab 写入包含全部单字节和给定合并结果的 tiktoken 词表
+func writeVocab(t *testing.T, merges ...string) string {
+	t.Helper()
+
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, m := range merges {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(m)), 256+i)
+	}
+
+	path := filepath.Join(t.TempDir(), Cl100kBase+".tiktoken")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatalf("write vocabulary: %v", err)
+	}
+	return path
+}
+
+func TestBPE_SplitMatchesCl100kPattern(t *testing.T) {
+	bpe, err := LoadBPE(writeVocab(t), Cl100kBase)
+	if err != nil {
+		t.Fatalf("LoadBPE failed: %v", err)
+	}
+
+	got := bpe.split("Hello world  foo\n\nbar 123456 it's")
+	want := []string{"Hello", " world", " ", " foo", "\n\n", "bar", " ", "123", "456", " it", "'s"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("split mismatch:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestBPE_MergesByRank(t *testing.T) {
+	bpe, err := LoadBPE(writeVocab(t, "ll", "he", "hell", "hello"), Cl100kBase)
+	if err != nil {
+		t.Fatalf("LoadBPE failed: %v", err)
+	}
+
+	if got := bpe.Encode("hello"); !reflect.DeepEqual(got, []int{259}) {
+		t.Errorf("Expected single merged token, got %v", got)
+	}
+	if got := bpe.Count("hellx"); got != 2 {
+		t.Errorf("Expected \"hell\" + \"x\" = 2 tokens, got %d", got)
+	}
+	// 每个汉字在UTF-8中占3字节，没有合并规则时按字节计数
+	if got := bpe.Count("你好"); got != 6 {
+		t.Errorf("Expected 6 byte tokens, got %d", got)
+	}
+}
+
+func TestEstimator_CountsCJKPerRune(t *testing.T) {
+	if got := (Estimator{}).Count("你好世界"); got != 4 {
+		t.Errorf("Expected 4 tokens for 4 Chinese characters, got %d", got)
+	}
+	if got := (Estimator{}).Count("hello world!"); got != 3 {
+		t.Errorf("Expected 3 tokens for 12 ASCII bytes, got %d", got)
+	}
+}
+
+func TestForModel_FallsBackToEstimator(t *testing.T) {
+	counter, err := ForModel(t.TempDir(), "gpt-4o")
+	if err == nil {
+		t.Fatal("Expected error for missing vocabulary")
+	}
+	if _, ok := counter.(Estimator); !ok {
+		t.Errorf("Expected Estimator fallback, got %T", counter)
+	}
+}
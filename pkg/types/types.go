@@ -1,35 +1,273 @@
 package types
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
 
 // Message 表示单条消息
 type Message struct {
-	Role      string    `yaml:"role" json:"role"`           // "user" 或 "assistant" 或 "system"
-	Content   string    `yaml:"content" json:"content"`     // 消息内容
-	Timestamp time.Time `yaml:"timestamp" json:"timestamp"` // 时间戳
+	ID        string    `yaml:"id,omitempty" json:"id,omitempty"`               // 消息ID，会话内唯一
+	ParentID  string    `yaml:"parent_id,omitempty" json:"parent_id,omitempty"` // 上一条消息的ID，为空表示分支的第一条消息
+	Role      string    `yaml:"role" json:"role"`                               // "user" 或 "assistant" 或 "system"
+	Content   string    `yaml:"content" json:"content"`                         // 消息内容
+	Timestamp time.Time `yaml:"timestamp" json:"timestamp"`                     // 时间戳
+}
+
+// NewMessageID 生成随机的消息ID
+func NewMessageID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 // Reflection 表示对对话的反思和观察
 type Reflection struct {
-	Content    string    `yaml:"content"`    // 反思内容
-	Timestamp  time.Time `yaml:"timestamp"`  // 时间戳
-	Importance int       `yaml:"importance"` // 重要性评分 (1-10)
+	Content     string    `yaml:"content" json:"content"`                             // 反思内容
+	Timestamp   time.Time `yaml:"timestamp" json:"timestamp"`                         // 时间戳
+	Importance  int       `yaml:"importance" json:"importance"`                       // 重要性评分 (1-10)
+	Themes      []string  `yaml:"themes,omitempty" json:"themes,omitempty"`           // 对话的关键主题
+	Preferences []string  `yaml:"preferences,omitempty" json:"preferences,omitempty"` // 用户的需求和偏好
+	Suggestions []string  `yaml:"suggestions,omitempty" json:"suggestions,omitempty"` // 对之后对话的建议
+	Thread      string    `yaml:"thread,omitempty" json:"thread,omitempty"`           // 生成反思时所在的会话
+	MessageID   string    `yaml:"message_id,omitempty" json:"message_id,omitempty"`   // 生成反思时分支的最后一条消息
+}
+
+// Fact 从对话中提取的关于用户的结构化事实。同一主体的同一属性只有一个有效值，
+// 新值与之冲突时旧事实被标记为已取代而不是删除，保留变化的历史
+type Fact struct {
+	ID           string    `yaml:"id" json:"id"`                                           // 事实ID
+	Subject      string    `yaml:"subject" json:"subject"`                                 // 主体，例如 "用户"、"用户的女儿"
+	Attribute    string    `yaml:"attribute" json:"attribute"`                             // 属性，例如 "饮食"
+	Value        string    `yaml:"value" json:"value"`                                     // 属性值，例如 "素食"
+	Confidence   float64   `yaml:"confidence" json:"confidence"`                           // 置信度 (0-1)
+	Thread       string    `yaml:"thread,omitempty" json:"thread,omitempty"`               // 来源消息所在的会话
+	MessageID    string    `yaml:"message_id,omitempty" json:"message_id,omitempty"`       // 来源消息
+	CreatedAt    time.Time `yaml:"created_at" json:"created_at"`                           // 首次提取的时间
+	UpdatedAt    time.Time `yaml:"updated_at" json:"updated_at"`                           // 最近一次被对话确认的时间
+	SupersededBy string    `yaml:"superseded_by,omitempty" json:"superseded_by,omitempty"` // 取代它的事实ID，为空表示仍然有效
+}
+
+// NewFactID 生成随机的事实ID
+func NewFactID() string {
+	return NewMessageID()
+}
+
+// Note 用户要求记住的置顶笔记，总是放入上下文，不会被摘要或归档
+type Note struct {
+	ID        string    `yaml:"id" json:"id"`                                     // 笔记ID
+	Content   string    `yaml:"content" json:"content"`                           // 笔记内容
+	Thread    string    `yaml:"thread,omitempty" json:"thread,omitempty"`         // 从消息中识别时，消息所在的会话
+	MessageID string    `yaml:"message_id,omitempty" json:"message_id,omitempty"` // 从消息中识别时的来源消息，为空表示手动添加
+	CreatedAt time.Time `yaml:"created_at" json:"created_at"`
+}
+
+// NewNoteID 生成随机的笔记ID
+func NewNoteID() string {
+	return NewMessageID()
+}
+
+// Key 返回事实的主体和属性，不区分大小写和首尾空白，相同的事实互相冲突
+func (f *Fact) Key() string {
+	return strings.ToLower(strings.TrimSpace(f.Subject)) + "\x00" + strings.ToLower(strings.TrimSpace(f.Attribute))
+}
+
+// Active 检查事实是否仍然有效
+func (f *Fact) Active() bool {
+	return f.SupersededBy == ""
+}
+
+// Summary 表示分支上一段连续消息的摘要
+type Summary struct {
+	Content   string    `yaml:"content" json:"content"`                       // 摘要内容
+	Start     int       `yaml:"start" json:"start"`                           // 覆盖的第一条消息在分支上的位置
+	End       int       `yaml:"end" json:"end"`                               // 覆盖范围的结束位置（不含）
+	StartID   string    `yaml:"start_id,omitempty" json:"start_id,omitempty"` // 覆盖的第一条消息ID
+	EndID     string    `yaml:"end_id,omitempty" json:"end_id,omitempty"`     // 覆盖的最后一条消息ID，摘要只属于包含该消息的分支
+	Level     int       `yaml:"level" json:"level"`                           // 层级：0 由消息直接生成，更高层由下层摘要汇总
+	CreatedAt time.Time `yaml:"created_at" json:"created_at"`                 // 生成时间
+}
+
+// DefaultThread 未指定会话时使用的会话ID
+const DefaultThread = "default"
+
+// Thread 表示用户的一个会话，拥有独立的消息和摘要。
+// 消息通过 ParentID 组成一棵树，编辑消息或重新生成回复会产生新的分支，
+// Head 指向当前分支的最后一条消息
+type Thread struct {
+	ID          string    `yaml:"id" json:"id"`                                 // 会话ID
+	Segments    []Segment `yaml:"segments,omitempty" json:"segments,omitempty"` // 归档段，按消息顺序排列
+	Messages    []Message `yaml:"messages" json:"messages"`                     // 会话内所有分支未归档的消息，按添加顺序排列
+	Head        string    `yaml:"head,omitempty" json:"head,omitempty"`         // 当前分支最后一条消息的ID
+	Summaries   []Summary `yaml:"summaries" json:"summaries"`                   // 按覆盖范围排序的摘要记录
+	ContextSize int       `yaml:"context_size" json:"context_size"`             // 当前分支的上下文大小（token数）
+	CreatedAt   time.Time `yaml:"created_at" json:"created_at"`                 // 创建时间
+}
+
+// Segment 表示一个归档段：会话中按添加顺序最早的一批消息，已被摘要覆盖，
+// 压缩后作为不可变的附加数据单独保存，只在检索和导出时按需读取。
+// 归档的消息都在同一条分支上，未归档的消息只会接在最后一条归档消息之后
+type Segment struct {
+	Name      string    `yaml:"name" json:"name"`             // 附加数据名
+	First     int       `yaml:"first" json:"first"`           // 第一条消息在会话全部消息中的下标
+	Count     int       `yaml:"count" json:"count"`           // 消息数
+	StartID   string    `yaml:"start_id" json:"start_id"`     // 第一条消息的ID
+	EndID     string    `yaml:"end_id" json:"end_id"`         // 最后一条消息的ID
+	CreatedAt time.Time `yaml:"created_at" json:"created_at"` // 归档时间
+}
+
+// Archived 返回已归档的消息数，即 Messages[0] 在会话全部消息中的下标
+func (t *Thread) Archived() int {
+	if n := len(t.Segments); n > 0 {
+		return t.Segments[n-1].First + t.Segments[n-1].Count
+	}
+	return 0
+}
+
+// BranchSet 分支上的消息ID集合，用于判断摘要和反思是否属于某个分支
+type BranchSet struct {
+	ids         map[string]bool
+	hot         map[string]bool // 会话中所有未归档的消息
+	fromArchive bool
+}
+
+// BranchSet 返回以 id 结尾的分支上的消息集合。分支接在归档的消息之后时，
+// 所有已归档的消息也属于该分支；id 本身已归档时，集合只包含归档的消息
+func (t *Thread) BranchSet(id string) *BranchSet {
+	s := &BranchSet{ids: make(map[string]bool), hot: make(map[string]bool, len(t.Messages))}
+	for _, msg := range t.Messages {
+		s.hot[msg.ID] = true
+	}
+	path := t.Path(id)
+	for _, i := range path {
+		s.ids[t.Messages[i].ID] = true
+	}
+	if n := len(t.Segments); n > 0 {
+		if len(path) > 0 {
+			s.fromArchive = t.Messages[path[0]].ParentID == t.Segments[n-1].EndID
+		} else {
+			s.fromArchive = id != "" && !s.hot[id]
+		}
+	}
+	return s
 }
 
-// ConversationMemory 表示完整的对话记忆
+// FromArchive 检查分支是否接在归档的消息之后
+func (s *BranchSet) FromArchive() bool {
+	return s.fromArchive
+}
+
+// Contains 检查消息是否在分支上
+func (s *BranchSet) Contains(id string) bool {
+	if s.ids[id] {
+		return true
+	}
+	return s.fromArchive && id != "" && !s.hot[id]
+}
+
+// Path 返回从分支的第一条消息到指定消息的路径，元素为消息在 Messages 中的下标。
+// id 为空或不存在时返回空路径
+func (t *Thread) Path(id string) []int {
+	index := make(map[string]int, len(t.Messages))
+	for i, msg := range t.Messages {
+		index[msg.ID] = i
+	}
+
+	var path []int
+	for id != "" && len(path) <= len(t.Messages) {
+		i, ok := index[id]
+		if !ok {
+			break
+		}
+		path = append(path, i)
+		id = t.Messages[i].ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Branch 返回当前分支上的消息，按对话顺序排列
+func (t *Thread) Branch() []Message {
+	path := t.Path(t.Head)
+	msgs := make([]Message, len(path))
+	for i, idx := range path {
+		msgs[i] = t.Messages[idx]
+	}
+	return msgs
+}
+
+// Find 返回指定ID的消息在 Messages 中的下标，不存在时返回 -1
+func (t *Thread) Find(id string) int {
+	for i, msg := range t.Messages {
+		if msg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ConversationMemory 表示完整的对话记忆。会话各自保存消息和摘要，反思和事实在用户的所有会话间共享
 type ConversationMemory struct {
-	UserID      string       `yaml:"user_id"`      // 用户ID
-	Messages    []Message    `yaml:"messages"`     // 所有消息
-	Summary     string       `yaml:"summary"`      // 当前对话摘要
-	Reflections []Reflection `yaml:"reflections"`  // 反思记录
-	ContextSize int          `yaml:"context_size"` // 当前上下文大小（token数）
+	SchemaVersion int          `yaml:"schema_version,omitempty" json:"schema_version,omitempty"` // 文件格式版本，旧文件没有该字段
+	UserID        string       `yaml:"user_id" json:"user_id"`                                   // 用户ID
+	Language      string       `yaml:"language,omitempty" json:"language,omitempty"`             // 内部提示词的语言，为空时使用配置的默认语言
+	Threads       []*Thread    `yaml:"threads" json:"threads"`                                   // 会话，按创建顺序排列
+	Reflections   []Reflection `yaml:"reflections" json:"reflections"`                           // 反思记录
+	Facts         []Fact       `yaml:"facts,omitempty" json:"facts,omitempty"`                   // 结构化事实，包括已被取代的，按提取顺序排列
+	Notes         []Note       `yaml:"notes,omitempty" json:"notes,omitempty"`                   // 置顶笔记，按添加顺序排列
+	JournalSeq    uint64       `yaml:"journal_seq,omitempty" json:"journal_seq,omitempty"`       // 已包含的最后一条日志序号
+
+	// 旧版本只有一个会话，加载时迁移到默认会话
+	Messages    []Message `yaml:"messages,omitempty" json:"messages,omitempty"`
+	Summary     string    `yaml:"summary,omitempty" json:"summary,omitempty"`
+	Summaries   []Summary `yaml:"summaries,omitempty" json:"summaries,omitempty"`
+	ContextSize int       `yaml:"context_size,omitempty" json:"context_size,omitempty"`
+}
+
+// Thread 返回指定ID的会话，不存在时返回 nil
+func (m *ConversationMemory) Thread(id string) *Thread {
+	for _, t := range m.Threads {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// EnsureThread 返回指定ID的会话，不存在时创建
+func (m *ConversationMemory) EnsureThread(id string) *Thread {
+	if t := m.Thread(id); t != nil {
+		return t
+	}
+	t := &Thread{ID: id, Messages: []Message{}, CreatedAt: time.Now()}
+	m.Threads = append(m.Threads, t)
+	return t
 }
 
 // LLMRequest 表示发送给LLM的请求
 type LLMRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	MaxTokens int       `json:"max_tokens,omitempty"`
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat 要求模型输出 JSON："json_object" 只保证是 JSON 对象，
+// "json_schema" 还要求符合 JSONSchema
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// JSONSchema 结构化输出的格式定义
+type JSONSchema struct {
+	Name   string                 `json:"name"`
+	Strict bool                   `json:"strict"`
+	Schema map[string]interface{} `json:"schema"`
 }
 
 // LLMStreamRequest 表示流式请求
@@ -63,3 +301,17 @@ type LLMStreamResponse struct {
 		TotalTokens int `json:"total_tokens"`
 	} `json:"usage"`
 }
+
+// EmbeddingRequest 表示发送给 /embeddings 的请求
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// EmbeddingResponse 表示 /embeddings 返回的响应
+type EmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}